@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrAuthFailed is returned by negotiators when the client presents
+// credentials that the configured Authenticator rejects.
+// ErrAuthFailed 表示客户端提供的凭据未通过认证。
+var ErrAuthFailed = errors.New("authentication failed")
+
+// Authenticator validates a username/password pair presented by a client.
+// Authenticator 用于校验客户端提交的用户名和密码。
+type Authenticator interface {
+	Authenticate(ctx *Context, username, password string) bool
+}
+
+// AuthenticateFn is a function adapter that implements the Authenticator interface.
+// AuthenticateFn 是一个实现 Authenticator 接口的函数适配器。
+type AuthenticateFn func(*Context, string, string) bool
+
+// Authenticate calls the function itself.
+// Authenticate 方法直接调用函数本体。
+func (f AuthenticateFn) Authenticate(ctx *Context, username, password string) bool {
+	return f(ctx, username, password)
+}
+
+// StaticAuthenticator authenticates against an in-memory username to password map.
+// StaticAuthenticator 基于内存中的 用户名 -> 密码 映射进行认证。
+type StaticAuthenticator map[string]string
+
+// Authenticate reports whether the password matches the one stored for username.
+// Authenticate 判断密码是否与用户名对应的密码一致。
+func (a StaticAuthenticator) Authenticate(_ *Context, username, password string) bool {
+	expected, ok := a[username]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+}
+
+// HtpasswdAuthenticator authenticates against entries loaded from an
+// htpasswd-style file. Supported hash formats are bcrypt ($2a$, $2b$, $2y$),
+// {SHA} and plain text.
+// HtpasswdAuthenticator 基于 htpasswd 格式的文件进行认证，
+// 支持 bcrypt、{SHA} 和明文三种密码格式。
+type HtpasswdAuthenticator struct {
+	entries map[string]string
+}
+
+// LoadHtpasswd reads an htpasswd-style file where each line is "user:hash".
+// Empty lines and lines starting with '#' are ignored.
+// LoadHtpasswd 读取 htpasswd 格式的文件，每行格式为 "user:hash"，
+// 空行和以 '#' 开头的行会被忽略。
+func LoadHtpasswd(path string) (*HtpasswdAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, errors.New("malformed htpasswd line")
+		}
+		entries[username] = hash
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &HtpasswdAuthenticator{entries: entries}, nil
+}
+
+// Authenticate reports whether the password matches the hash stored for username.
+// Authenticate 判断密码是否与用户名对应的哈希值匹配。
+func (a *HtpasswdAuthenticator) Authenticate(_ *Context, username, password string) bool {
+	hash, ok := a.entries[username]
+	if !ok {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(hash, "$2a$"),
+		strings.HasPrefix(hash, "$2b$"),
+		strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(expected)) == 1
+	default:
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(password)) == 1
+	}
+}
+
+// PasswordLookup returns the plain-text password of a user. It is needed by
+// challenge-response schemes such as HTTP Digest, where the proxy must know
+// the shared secret rather than just verify it.
+// PasswordLookup 返回用户的明文密码，HTTP Digest 等挑战-应答认证方式
+// 需要获取共享密钥而不仅仅是校验密码。
+type PasswordLookup interface {
+	Password(ctx *Context, username string) (string, bool)
+}
+
+// Password returns the password stored for username.
+// Password 返回用户名对应的密码。
+func (a StaticAuthenticator) Password(_ *Context, username string) (string, bool) {
+	password, ok := a[username]
+	return password, ok
+}
@@ -0,0 +1,338 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"os"
+	"software.sslmate.com/src/go-pkcs12"
+	"strings"
+	"time"
+)
+
+// CA is a root certificate authority used to sign forged leaf certificates.
+// CA 表示用于签发伪造服务端证书的根证书颁发机构。
+type CA struct {
+	Cert       *x509.Certificate
+	PrivateKey crypto.PrivateKey
+}
+
+// GenerateCA creates a self-signed root CA with the given subject, key type
+// and validity. Key types are shared with LeafSigner.
+// GenerateCA 使用指定的主题、密钥类型与有效期创建自签名根 CA，密钥类型与 LeafSigner 共用。
+func GenerateCA(subject pkix.Name, key LeafKey, validity time.Duration) (*CA, error) {
+	privateKey, err := key.generate()
+	if err != nil {
+		return nil, err
+	}
+	serialNumber, err := RandomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               subject,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, privateKey.Public(), privateKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{Cert: cert, PrivateKey: privateKey}, nil
+}
+
+// ParseCA parses a CA certificate and private key, each either PEM or DER
+// encoded. Keys may be PKCS#1, PKCS#8 or SEC 1.
+// ParseCA 解析 CA 证书与私钥，两者均可为 PEM 或 DER 编码，私钥支持 PKCS#1、PKCS#8 与 SEC 1 格式。
+func ParseCA(certData, keyData []byte) (*CA, error) {
+	cert, err := x509.ParseCertificate(pemOrDER(certData, "CERTIFICATE"))
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := parsePrivateKey(pemOrDER(keyData, "PRIVATE KEY"))
+	if err != nil {
+		return nil, err
+	}
+	return newCA(cert, privateKey)
+}
+
+// LoadCA reads a CA certificate and private key from PEM or DER files. Both
+// may live in the same PEM file.
+// LoadCA 从 PEM 或 DER 文件中读取 CA 证书与私钥，两者可以位于同一个 PEM 文件中。
+func LoadCA(certPath, keyPath string) (*CA, error) {
+	certData, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	keyData, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCA(certData, keyData)
+}
+
+// ParseCAPKCS12 parses a PKCS#12 (.p12/.pfx) bundle holding a CA.
+// ParseCAPKCS12 解析包含 CA 的 PKCS#12（.p12/.pfx）文件内容。
+func ParseCAPKCS12(data []byte, password string) (*CA, error) {
+	privateKey, cert, _, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return nil, err
+	}
+	return newCA(cert, privateKey)
+}
+
+// LoadCAPKCS12 reads a CA from a PKCS#12 (.p12/.pfx) file.
+// LoadCAPKCS12 从 PKCS#12（.p12/.pfx）文件中读取 CA。
+func LoadCAPKCS12(path, password string) (*CA, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCAPKCS12(data, password)
+}
+
+func newCA(cert *x509.Certificate, privateKey crypto.PrivateKey) (*CA, error) {
+	if !cert.IsCA {
+		return nil, errors.New("certificate is not a CA") // 证书不是 CA 证书
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", privateKey)
+	}
+	if !publicKeyEqual(cert.PublicKey, signer.Public()) {
+		return nil, errors.New("private key does not match certificate") // 私钥与证书不匹配
+	}
+	return &CA{Cert: cert, PrivateKey: privateKey}, nil
+}
+
+// pemOrDER returns the first PEM block whose type ends in blockType, or data
+// itself when it is not PEM encoded.
+// pemOrDER 返回类型以 blockType 结尾的第一个 PEM 块，data 不是 PEM 编码时原样返回。
+func pemOrDER(data []byte, blockType string) []byte {
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if bytes.HasSuffix([]byte(block.Type), []byte(blockType)) {
+			return block.Bytes
+		}
+	}
+	return data
+}
+
+func parsePrivateKey(der []byte) (crypto.PrivateKey, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key format") // 不支持的私钥格式
+}
+
+func publicKeyEqual(a, b crypto.PublicKey) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
+}
+
+// CertPEM returns the CA certificate in PEM form.
+// CertPEM 返回 PEM 格式的 CA 证书。
+func (ca *CA) CertPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Cert.Raw})
+}
+
+// CertDER returns the CA certificate in DER form, e.g. for a .cer/.crt download.
+// CertDER 返回 DER 格式的 CA 证书，例如用于 .cer/.crt 下载。
+func (ca *CA) CertDER() []byte { return ca.Cert.Raw }
+
+// KeyPEM returns the private key as a PKCS#8 PEM block.
+// KeyPEM 返回 PKCS#8 格式的 PEM 私钥。
+func (ca *CA) KeyPEM() ([]byte, error) {
+	der, err := ca.KeyDER()
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// KeyDER returns the private key in PKCS#8 DER form.
+// KeyDER 返回 PKCS#8 DER 格式的私钥。
+func (ca *CA) KeyDER() ([]byte, error) {
+	return x509.MarshalPKCS8PrivateKey(ca.PrivateKey)
+}
+
+// PKCS12 returns the certificate and private key as a password-protected
+// PKCS#12 bundle.
+// PKCS12 返回受密码保护、包含证书与私钥的 PKCS#12 文件内容。
+func (ca *CA) PKCS12(password string) ([]byte, error) {
+	return pkcs12.Modern.Encode(ca.PrivateKey, ca.Cert, nil, password)
+}
+
+// TrustStorePKCS12 returns the certificate alone, without its private key,
+// as a passwordless PKCS#12 trust store that is safe to hand out.
+// TrustStorePKCS12 返回仅包含证书（不含私钥）、无密码的 PKCS#12 信任库，可安全分发。
+func (ca *CA) TrustStorePKCS12() ([]byte, error) {
+	return pkcs12.Passwordless.EncodeTrustStore([]*x509.Certificate{ca.Cert}, "")
+}
+
+// Save writes the certificate and private key as PEM files. The key file is
+// only readable by its owner.
+// Save 将证书与私钥写入 PEM 文件，私钥文件仅所有者可读。
+func (ca *CA) Save(certPath, keyPath string) error {
+	keyPEM, err := ca.KeyPEM()
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(certPath, ca.CertPEM(), 0o644); err != nil {
+		return err
+	}
+	return os.WriteFile(keyPath, keyPEM, 0o600)
+}
+
+// MobileConfig returns an Apple configuration profile installing the CA
+// certificate (without its key) as a trusted root, named displayName.
+// MobileConfig 返回将 CA 证书（不含私钥）安装为受信任根证书的 Apple 描述文件，名称为 displayName。
+func (ca *CA) MobileConfig(displayName string) ([]byte, error) {
+	profileUUID := strings.ToUpper(uuid.New().String())
+	payloadUUID := strings.ToUpper(uuid.New().String())
+
+	var name bytes.Buffer
+	if err := xml.EscapeText(&name, []byte(displayName)); err != nil {
+		return nil, err
+	}
+	return fmt.Appendf(nil, mobileConfigTemplate,
+		base64.StdEncoding.EncodeToString(ca.Cert.Raw), name.String(), payloadUUID, payloadUUID,
+		name.String(), profileUUID, profileUUID), nil
+}
+
+const mobileConfigTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadContent</key>
+			<data>%s</data>
+			<key>PayloadDisplayName</key>
+			<string>%s</string>
+			<key>PayloadIdentifier</key>
+			<string>com.github.vpxuser.proxy.ca.%s</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.root</string>
+			<key>PayloadUUID</key>
+			<string>%s</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDisplayName</key>
+	<string>%s</string>
+	<key>PayloadIdentifier</key>
+	<string>com.github.vpxuser.proxy.%s</string>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>%s</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`
+
+// CrossSign returns a certificate carrying the subject and public key of ca,
+// issued by issuer, so clients trusting issuer also accept leaves of ca.
+// CrossSign 返回一张由 issuer 签发、携带 ca 主题与公钥的证书，使信任 issuer 的客户端也能接受 ca 签发的证书。
+func (ca *CA) CrossSign(issuer *CA) (*x509.Certificate, error) {
+	serialNumber, err := RandomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               ca.Cert.Subject,
+		NotBefore:             ca.Cert.NotBefore,
+		NotAfter:              ca.Cert.NotAfter,
+		KeyUsage:              ca.Cert.KeyUsage,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SubjectKeyId:          ca.Cert.SubjectKeyId,
+	}
+	if template.NotAfter.After(issuer.Cert.NotAfter) {
+		template.NotAfter = issuer.Cert.NotAfter
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer.Cert, ca.Cert.PublicKey, issuer.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// RotatingCA is a TLSConfig for moving from an old CA to a new one. Leaves
+// are signed by the new CA; until the transition ends, their chain also
+// carries the new CA cross-signed by the old one, so clients trusting either
+// root accept them.
+// RotatingCA 是用于从旧 CA 迁移到新 CA 的 TLSConfig。服务端证书由新 CA 签发，在过渡期结束前，
+// 证书链中还会附带由旧 CA 交叉签名的新 CA 证书，使信任任一根证书的客户端都能接受。
+type RotatingCA struct {
+	signer *LeafSigner
+	cross  *x509.Certificate
+	until  time.Time
+}
+
+// NewRotatingCA creates a RotatingCA whose transition window ends at until.
+// opts configure the leaves as for NewLeafSigner.
+// NewRotatingCA 创建过渡期在 until 结束的 RotatingCA，opts 与 NewLeafSigner 相同，用于配置服务端证书。
+func NewRotatingCA(oldCA, newCA *CA, until time.Time, opts ...LeafOption) (*RotatingCA, error) {
+	cross, err := newCA.CrossSign(oldCA)
+	if err != nil {
+		return nil, err
+	}
+	return &RotatingCA{
+		signer: NewLeafSigner(newCA.Cert, newCA.PrivateKey, opts...),
+		cross:  cross,
+		until:  until,
+	}, nil
+}
+
+// CacheKey delegates to the underlying LeafSigner.
+// CacheKey 委托给内部的 LeafSigner。
+func (r *RotatingCA) CacheKey(san string) string { return r.signer.CacheKey(san) }
+
+// From issues a leaf for san signed by the new CA.
+// From 为 san 签发由新 CA 签名的服务端证书。
+func (r *RotatingCA) From(san string) (*tls.Config, error) {
+	cfg, err := r.signer.From(san)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().Before(r.until) {
+		cert := &cfg.Certificates[0]
+		cert.Certificate = append(cert.Certificate, r.cross.Raw)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCA(t *testing.T) {
+	ca, err := GenerateCA(pkix.Name{CommonName: "Test Root", Organization: []string{"Test & Co"}}, LeafKeyECDSAP256, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.Cert.IsCA || ca.Cert.Subject.CommonName != "Test Root" {
+		t.Fatalf("generated CA = %v, IsCA = %v", ca.Cert.Subject, ca.Cert.IsCA)
+	}
+	keyPEM, err := ca.KeyPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := ca.KeyDER()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p12, err := ca.PKCS12("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		parse func() (*CA, error)
+	}{
+		{"pem", func() (*CA, error) { return ParseCA(ca.CertPEM(), keyPEM) }},
+		{"der", func() (*CA, error) { return ParseCA(ca.CertDER(), keyDER) }},
+		{"combined pem", func() (*CA, error) {
+			combined := append(ca.CertPEM(), keyPEM...)
+			return ParseCA(combined, combined)
+		}},
+		{"pkcs1 pem", func() (*CA, error) { return ParseCA([]byte(CERTIFICATE_PEM), []byte(PRIVATE_KEY_PEM)) }},
+		{"pkcs12", func() (*CA, error) { return ParseCAPKCS12(p12, "secret") }},
+		{"files", func() (*CA, error) {
+			dir := t.TempDir()
+			certPath, keyPath := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+			if err := ca.Save(certPath, keyPath); err != nil {
+				return nil, err
+			}
+			return LoadCA(certPath, keyPath)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loaded, err := tt.parse()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = NewLeafSigner(loaded.Cert, loaded.PrivateKey).From("a.test"); err != nil {
+				t.Errorf("signing with loaded CA: %v", err)
+			}
+		})
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		if _, err := ParseCAPKCS12(p12, "wrong"); err == nil {
+			t.Error("wrong PKCS#12 password accepted")
+		}
+		if _, err := ParseCA(ca.CertPEM(), []byte(PRIVATE_KEY_PEM)); err == nil {
+			t.Error("mismatched private key accepted")
+		}
+	})
+
+	t.Run("mobileconfig", func(t *testing.T) {
+		profile, err := ca.MobileConfig("Test & Co Root")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{
+			base64.StdEncoding.EncodeToString(ca.Cert.Raw),
+			"<string>Test &amp; Co Root</string>",
+			"<string>com.apple.security.root</string>",
+		} {
+			if !bytes.Contains(profile, []byte(want)) {
+				t.Errorf("profile lacks %q", want)
+			}
+		}
+	})
+}
+
+func TestRotatingCA(t *testing.T) {
+	oldCA, err := GenerateCA(pkix.Name{CommonName: "Old Root"}, LeafKeyECDSAP256, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCA, err := GenerateCA(pkix.Name{CommonName: "New Root"}, LeafKeyEd25519, 48*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verify := func(chain [][]byte, root *CA) error {
+		leaf, err := x509.ParseCertificate(chain[0])
+		if err != nil {
+			return err
+		}
+		roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+		roots.AddCert(root.Cert)
+		for _, der := range chain[1:] {
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return err
+			}
+			intermediates.AddCert(cert)
+		}
+		_, err = leaf.Verify(x509.VerifyOptions{DNSName: "a.test", Roots: roots, Intermediates: intermediates})
+		return err
+	}
+
+	tests := []struct {
+		name      string
+		until     time.Time
+		trustsOld bool
+	}{
+		{"during transition", time.Now().Add(time.Hour), true},
+		{"after transition", time.Now().Add(-time.Hour), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rotating, err := NewRotatingCA(oldCA, newCA, tt.until)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := rotating.From("a.test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			chain := cfg.Certificates[0].Certificate
+			if err = verify(chain, newCA); err != nil {
+				t.Errorf("new root: %v", err)
+			}
+			if err = verify(chain, oldCA); (err == nil) != tt.trustsOld {
+				t.Errorf("old root: err = %v, want accepted = %v", err, tt.trustsOld)
+			}
+		})
+	}
+}
@@ -6,6 +6,11 @@ import (
 	"encoding/pem"
 )
 
+// Certificate and PrivateKey form the built-in development CA. Its key is
+// public to every user of this package, so production setups should use
+// GenerateCA or LoadCA instead.
+// Certificate 与 PrivateKey 构成内置的开发用 CA，其私钥对本包的所有使用者公开，
+// 生产环境应改用 GenerateCA 或 LoadCA。
 var Certificate *x509.Certificate
 
 const CERTIFICATE_PEM = `-----BEGIN CERTIFICATE-----
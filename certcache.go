@@ -0,0 +1,288 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"golang.org/x/sync/singleflight"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certExpiryMargin is how long before NotAfter a cached certificate is
+// treated as expired, so clients never see a certificate about to lapse.
+// certExpiryMargin 表示缓存证书在 NotAfter 之前多久即视为过期，避免客户端拿到即将失效的证书。
+const certExpiryMargin = time.Hour
+
+// CertCacheOption configures a CertCache.
+// CertCacheOption 用于配置 CertCache。
+type CertCacheOption func(*CertCache)
+
+// WithCacheSize bounds the number of certificates kept in memory.
+// WithCacheSize 设置内存中缓存的证书数量上限。
+func WithCacheSize(size int) CertCacheOption {
+	return func(c *CertCache) { c.size = size }
+}
+
+// WithCacheDir persists generated certificates and keys as PEM files in dir,
+// so they survive restarts. Only the first certificate of each tls.Config is
+// persisted, and configs loaded from disk carry nothing but that certificate.
+// WithCacheDir 将生成的证书与私钥以 PEM 文件形式保存到 dir 目录中，重启后可继续使用。
+// 仅保存每个 tls.Config 的第一张证书，从磁盘加载的配置也只包含该证书。
+func WithCacheDir(dir string) CertCacheOption {
+	return func(c *CertCache) { c.dir = dir }
+}
+
+// CertCache wraps a TLSConfig and caches the configs it returns by SAN. The
+// in-memory cache is a bounded LRU that drops expired certificates first,
+// and concurrent requests for the same SAN share a single generation.
+// CertCache 包装任意 TLSConfig，并按 SAN 缓存其返回的配置。内存缓存为有上限的 LRU，
+// 优先淘汰已过期的证书，同一 SAN 的并发请求只会生成一次。
+type CertCache struct {
+	next  TLSConfig
+	size  int
+	dir   string
+	group singleflight.Group
+	mu    sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+type certCacheEntry struct {
+	san      string
+	cfg      *tls.Config
+	notAfter time.Time // 零值表示永不过期
+}
+
+// NewCertCache creates a CertCache in front of next, holding up to 1024
+// certificates by default.
+// NewCertCache 创建包装 next 的 CertCache，默认最多缓存 1024 张证书。
+func NewCertCache(next TLSConfig, opts ...CertCacheOption) *CertCache {
+	c := &CertCache{
+		next:  next,
+		size:  1024,
+		lru:   list.New(),
+		items: make(map[string]*list.Element),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// From returns the cached config for san, generating it on a miss.
+// From 返回 san 对应的缓存配置，未命中时生成新配置。
+func (c *CertCache) From(san string) (*tls.Config, error) {
+	return c.get(san, func() (*tls.Config, error) { return c.next.From(san) })
+}
+
+// FromContext is like From, but generates through the wrapped config's
+// FromContext when it implements ContextTLSConfig. Note that cache hits skip
+// the wrapped config entirely, e.g. Context.UpstreamCerts stays unset.
+// FromContext 与 From 相同，但被包装的配置实现了 ContextTLSConfig 时通过其 FromContext 生成。
+// 注意命中缓存时不会调用被包装的配置，例如不会设置 Context.UpstreamCerts。
+func (c *CertCache) FromContext(ctx *Context, san string) (*tls.Config, error) {
+	next, ok := c.next.(ContextTLSConfig)
+	if !ok {
+		return c.From(san)
+	}
+	return c.get(san, func() (*tls.Config, error) { return next.FromContext(ctx, san) })
+}
+
+// Len returns the number of certificates held in memory.
+// Len 返回内存中缓存的证书数量。
+func (c *CertCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// cacheKeyer is implemented by TLSConfigs whose certificates cover more than
+// the requested SAN, e.g. LeafSigner issuing wildcards.
+// cacheKeyer 由证书覆盖范围大于所请求 SAN 的 TLSConfig 实现，例如签发通配符证书的 LeafSigner。
+type cacheKeyer interface {
+	CacheKey(string) string
+}
+
+func (c *CertCache) get(san string, generate func() (*tls.Config, error)) (*tls.Config, error) {
+	if keyer, ok := c.next.(cacheKeyer); ok {
+		san = keyer.CacheKey(san)
+	}
+	key := strings.ToLower(san)
+	if cfg, ok := c.lookup(key); ok {
+		return cfg, nil
+	}
+
+	v, err, _ := c.group.Do(key, func() (any, error) {
+		if cfg, ok := c.lookup(key); ok {
+			return cfg, nil
+		}
+
+		if cfg, notAfter, ok := c.load(key); ok {
+			c.add(key, cfg, notAfter)
+			return cfg, nil
+		}
+
+		cfg, err := generate()
+		if err != nil {
+			return nil, err
+		}
+		notAfter := certNotAfter(cfg)
+		c.add(key, cfg, notAfter)
+		c.store(key, cfg)
+		return cfg, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*tls.Config), nil
+}
+
+// lookup returns a live entry and marks it as recently used. Expired entries
+// are removed.
+// lookup 返回未过期的缓存项并将其标记为最近使用，已过期的缓存项会被移除。
+func (c *CertCache) lookup(key string) (*tls.Config, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*certCacheEntry)
+	if certExpired(entry.notAfter) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.cfg, true
+}
+
+// add inserts an entry, evicting expired entries before the least recently
+// used one when the cache is full.
+// add 插入缓存项，缓存已满时先淘汰已过期的缓存项，再淘汰最久未使用的缓存项。
+func (c *CertCache) add(key string, cfg *tls.Config, notAfter time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.remove(elem)
+	}
+	if c.size > 0 && c.lru.Len() >= c.size {
+		for elem := c.lru.Back(); elem != nil; {
+			prev := elem.Prev()
+			if certExpired(elem.Value.(*certCacheEntry).notAfter) {
+				c.remove(elem)
+			}
+			elem = prev
+		}
+		for c.lru.Len() >= c.size {
+			c.remove(c.lru.Back())
+		}
+	}
+	c.items[key] = c.lru.PushFront(&certCacheEntry{san: key, cfg: cfg, notAfter: notAfter})
+}
+
+func (c *CertCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.items, elem.Value.(*certCacheEntry).san)
+}
+
+// certPath returns the file a SAN is persisted to.
+// certPath 返回 SAN 对应的持久化文件路径。
+func (c *CertCache) certPath(key string) string {
+	name := strings.ReplaceAll(url.PathEscape(key), "*", "%2A")
+	return filepath.Join(c.dir, name+".pem")
+}
+
+// load reads a persisted certificate for key, ignoring missing, corrupt and
+// expired files.
+// load 读取 key 对应的持久化证书，忽略不存在、损坏或已过期的文件。
+func (c *CertCache) load(key string) (*tls.Config, time.Time, bool) {
+	if c.dir == "" {
+		return nil, time.Time{}, false
+	}
+	raw, err := os.ReadFile(c.certPath(key))
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	cert, err := tls.X509KeyPair(raw, raw)
+	if err != nil || cert.Leaf == nil || certExpired(cert.Leaf.NotAfter) {
+		return nil, time.Time{}, false
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, cert.Leaf.NotAfter, true
+}
+
+// store persists the first certificate of cfg. Failures only cost a
+// regeneration after restart, so they are not reported.
+// store 持久化 cfg 的第一张证书。失败只会导致重启后重新生成，因此不返回错误。
+func (c *CertCache) store(key string, cfg *tls.Config) {
+	if c.dir == "" || len(cfg.Certificates) == 0 {
+		return
+	}
+	raw, err := encodeCertPEM(cfg.Certificates[0])
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(c.dir, 0o700); err != nil {
+		return
+	}
+
+	//先写入临时文件再重命名，避免并发进程读取到不完整的文件
+	tmp, err := os.CreateTemp(c.dir, ".cert-*")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(raw)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || os.Rename(tmp.Name(), c.certPath(key)) != nil {
+		_ = os.Remove(tmp.Name())
+	}
+}
+
+// encodeCertPEM encodes the chain and private key of cert as PEM blocks.
+// encodeCertPEM 将 cert 的证书链与私钥编码为 PEM 块。
+func encodeCertPEM(cert tls.Certificate) ([]byte, error) {
+	if cert.PrivateKey == nil {
+		return nil, errors.New("certificate has no private key") // 证书缺少私钥
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	for _, der := range cert.Certificate {
+		out = append(out, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	return append(out, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...), nil
+}
+
+// certNotAfter returns the expiry of the first certificate in cfg, or the
+// zero time when it cannot be determined.
+// certNotAfter 返回 cfg 中第一张证书的过期时间，无法确定时返回零值。
+func certNotAfter(cfg *tls.Config) time.Time {
+	if len(cfg.Certificates) == 0 || len(cfg.Certificates[0].Certificate) == 0 {
+		return time.Time{}
+	}
+	if leaf := cfg.Certificates[0].Leaf; leaf != nil {
+		return leaf.NotAfter
+	}
+	leaf, err := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+	if err != nil {
+		return time.Time{}
+	}
+	return leaf.NotAfter
+}
+
+func certExpired(notAfter time.Time) bool {
+	return !notAfter.IsZero() && time.Now().Add(certExpiryMargin).After(notAfter)
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCertCache(t *testing.T) {
+	counting := func(calls *atomic.Int32, next TLSConfig) TLSConfigFn {
+		return func(san string) (*tls.Config, error) {
+			calls.Add(1)
+			time.Sleep(20 * time.Millisecond)
+			return next.From(san)
+		}
+	}
+
+	t.Run("hit", func(t *testing.T) {
+		var calls atomic.Int32
+		cache := NewCertCache(counting(&calls, FromCA(Certificate, PrivateKey)))
+		first, err := cache.From("a.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := cache.From("A.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first != second || calls.Load() != 1 {
+			t.Errorf("calls = %d, same config = %v", calls.Load(), first == second)
+		}
+	})
+
+	t.Run("singleflight", func(t *testing.T) {
+		var calls atomic.Int32
+		cache := NewCertCache(counting(&calls, FromCA(Certificate, PrivateKey)))
+		var wg sync.WaitGroup
+		for range 20 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := cache.From("b.test"); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		if calls.Load() != 1 {
+			t.Errorf("calls = %d, want 1", calls.Load())
+		}
+	})
+
+	t.Run("lru", func(t *testing.T) {
+		var calls atomic.Int32
+		cache := NewCertCache(counting(&calls, FromCA(Certificate, PrivateKey)), WithCacheSize(2))
+		for _, san := range []string{"1.test", "2.test", "1.test", "3.test", "1.test", "2.test"} {
+			if _, err := cache.From(san); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// 2.test 在插入 3.test 时被淘汰，因此共生成 4 次
+		if calls.Load() != 4 || cache.Len() != 2 {
+			t.Errorf("calls = %d, len = %d, want 4 and 2", calls.Load(), cache.Len())
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		var calls atomic.Int32
+		expiring := TLSConfigFn(func(san string) (*tls.Config, error) {
+			calls.Add(1)
+			cfg, err := FromUpstream(Certificate, PrivateKey).From(san)
+			if err != nil {
+				return nil, err
+			}
+			cfg.Certificates[0].Leaf = &x509.Certificate{NotAfter: time.Now().Add(time.Minute)}
+			return cfg, nil
+		})
+		cache := NewCertCache(expiring)
+		for range 2 {
+			if _, err := cache.From("c.test"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if calls.Load() != 2 {
+			t.Errorf("calls = %d, want 2", calls.Load())
+		}
+	})
+
+	t.Run("persist", func(t *testing.T) {
+		dir := t.TempDir()
+		var calls atomic.Int32
+		cache := NewCertCache(counting(&calls, FromUpstream(Certificate, PrivateKey)), WithCacheDir(dir))
+		want, err := cache.From("*.d.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		failing := TLSConfigFn(func(string) (*tls.Config, error) { return nil, errors.New("should load from disk") })
+		got, err := NewCertCache(failing, WithCacheDir(dir)).From("*.d.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got.Certificates[0].Certificate[0]) != string(want.Certificates[0].Certificate[0]) {
+			t.Error("persisted certificate differs from the generated one")
+		}
+		if len(got.Certificates[0].Certificate) != 2 {
+			t.Errorf("chain length = %d, want 2", len(got.Certificates[0].Certificate))
+		}
+	})
+}
@@ -0,0 +1,359 @@
+package proxy
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// TLS extension types inspected when parsing a ClientHello.
+// 解析 ClientHello 时用到的 TLS 扩展类型。
+const (
+	extServerName          uint16 = 0
+	extSupportedGroups     uint16 = 10
+	extPointFormats        uint16 = 11
+	extSignatureAlgorithms uint16 = 13
+	extALPN                uint16 = 16
+	extSupportedVersions   uint16 = 43
+)
+
+// maxClientHelloLen bounds the handshake message reassembled from records,
+// and maxClientHelloRecords the record headers allowed on top of it when
+// bounding the bytes peeked.
+// maxClientHelloLen 限制从多个记录中重组的握手消息大小，maxClientHelloRecords 为限制预读字节数时额外允许的记录头数量。
+const (
+	maxClientHelloLen     = 1 << 16
+	maxClientHelloRecords = 256
+)
+
+// ClientHello is the parsed ClientHello of a TLS client. GREASE values are
+// kept as sent; the fingerprints skip them.
+// ClientHello 表示解析后的 TLS 客户端 ClientHello，保留客户端发送的 GREASE 值，计算指纹时会忽略它们。
+type ClientHello struct {
+	Raw                 []byte   // 完整的握手消息（不含记录头）
+	Version             uint16   // legacy_version 字段
+	SupportedVersions   []uint16 // supported_versions 扩展
+	CipherSuites        []uint16 // 密码套件（按客户端顺序）
+	Extensions          []uint16 // 扩展类型（按客户端顺序）
+	ServerName          string   // SNI
+	ALPN                []string // ALPN 协议列表
+	SupportedGroups     []uint16 // supported_groups 扩展
+	PointFormats        []uint8  // ec_point_formats 扩展
+	SignatureAlgorithms []uint16 // signature_algorithms 扩展
+	ja3, ja4            string   // 解析时计算的指纹
+}
+
+// peekClientHello reads the ClientHello from conn without consuming it,
+// reassembling it when it spans several records.
+// peekClientHello 在不消费数据的情况下从 conn 中读取 ClientHello，跨多个记录时会进行重组。
+func peekClientHello(conn *Conn) (*ClientHello, error) {
+	var msg []byte
+	offset := 0
+	for {
+		header, err := conn.Peek(offset + 5)
+		if err != nil {
+			return nil, err
+		}
+		if len(header) < offset+5 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		header = header[offset:]
+		if header[0] != 0x16 {
+			return nil, errors.New("not a TLS handshake record") // 不是 TLS 握手记录
+		}
+		length := int(header[3])<<8 | int(header[4])
+		if length == 0 {
+			return nil, errors.New("empty TLS handshake record") // TLS 握手记录为空
+		}
+		if offset+5+length > maxClientHelloLen+5*maxClientHelloRecords {
+			return nil, errors.New("ClientHello too large") // ClientHello 过大
+		}
+		record, err := conn.Peek(offset + 5 + length)
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < offset+5+length {
+			return nil, io.ErrUnexpectedEOF
+		}
+		msg = append(msg, record[offset+5:]...)
+		offset += 5 + length
+
+		if len(msg) >= 4 {
+			total := 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+			if total > maxClientHelloLen {
+				return nil, errors.New("ClientHello too large") // ClientHello 过大
+			}
+			if len(msg) >= total {
+				return ParseClientHello(msg[:total])
+			}
+		}
+	}
+}
+
+// ParseClientHello parses a ClientHello handshake message, starting with the
+// handshake type byte.
+// ParseClientHello 解析以握手类型字节开头的 ClientHello 握手消息。
+func ParseClientHello(msg []byte) (*ClientHello, error) {
+	hello := &ClientHello{Raw: msg}
+	s := cryptobyte.String(msg)
+
+	var msgType uint8
+	var body, sessionId, cipherSuites, compression cryptobyte.String
+	if !s.ReadUint8(&msgType) || msgType != 1 || !s.ReadUint24LengthPrefixed(&body) {
+		return nil, errors.New("not a ClientHello") // 不是 ClientHello 消息
+	}
+	if !body.ReadUint16(&hello.Version) || !body.Skip(32) ||
+		!body.ReadUint8LengthPrefixed(&sessionId) ||
+		!body.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!body.ReadUint8LengthPrefixed(&compression) {
+		return nil, errors.New("malformed ClientHello") // ClientHello 格式错误
+	}
+	for !cipherSuites.Empty() {
+		var suite uint16
+		if !cipherSuites.ReadUint16(&suite) {
+			return nil, errors.New("malformed cipher suites") // 密码套件格式错误
+		}
+		hello.CipherSuites = append(hello.CipherSuites, suite)
+	}
+	if body.Empty() {
+		return hello.fingerprint(), nil
+	}
+
+	var extensions cryptobyte.String
+	if !body.ReadUint16LengthPrefixed(&extensions) {
+		return nil, errors.New("malformed extensions") // 扩展格式错误
+	}
+	for !extensions.Empty() {
+		var typ uint16
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&typ) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return nil, errors.New("malformed extensions") // 扩展格式错误
+		}
+		hello.Extensions = append(hello.Extensions, typ)
+		if !hello.parseExtension(typ, data) {
+			return nil, fmt.Errorf("malformed extension %d", typ)
+		}
+	}
+	return hello.fingerprint(), nil
+}
+
+// fingerprint computes the JA3 and JA4 fingerprints once, so that matchers
+// run on every connection do not hash the ClientHello again.
+// fingerprint 一次性计算 JA3 与 JA4 指纹，避免每个连接上的匹配器重复计算哈希。
+func (h *ClientHello) fingerprint() *ClientHello {
+	h.ja3, h.ja4 = h.JA3(), h.JA4()
+	return h
+}
+
+func (h *ClientHello) parseExtension(typ uint16, data cryptobyte.String) bool {
+	var list cryptobyte.String
+	switch typ {
+	case extServerName:
+		if !data.ReadUint16LengthPrefixed(&list) {
+			return false
+		}
+		for !list.Empty() {
+			var nameType uint8
+			var name cryptobyte.String
+			if !list.ReadUint8(&nameType) || !list.ReadUint16LengthPrefixed(&name) {
+				return false
+			}
+			if nameType == 0 {
+				h.ServerName = string(name)
+			}
+		}
+	case extSupportedGroups:
+		return data.ReadUint16LengthPrefixed(&list) && readUint16s(list, &h.SupportedGroups)
+	case extPointFormats:
+		if !data.ReadUint8LengthPrefixed(&list) {
+			return false
+		}
+		h.PointFormats = append(h.PointFormats, list...)
+	case extSignatureAlgorithms:
+		return data.ReadUint16LengthPrefixed(&list) && readUint16s(list, &h.SignatureAlgorithms)
+	case extALPN:
+		if !data.ReadUint16LengthPrefixed(&list) {
+			return false
+		}
+		for !list.Empty() {
+			var proto cryptobyte.String
+			if !list.ReadUint8LengthPrefixed(&proto) {
+				return false
+			}
+			h.ALPN = append(h.ALPN, string(proto))
+		}
+	case extSupportedVersions:
+		return data.ReadUint8LengthPrefixed(&list) && readUint16s(list, &h.SupportedVersions)
+	}
+	return true
+}
+
+func readUint16s(s cryptobyte.String, out *[]uint16) bool {
+	for !s.Empty() {
+		var v uint16
+		if !s.ReadUint16(&v) {
+			return false
+		}
+		*out = append(*out, v)
+	}
+	return true
+}
+
+// isGrease reports whether v is a GREASE value (RFC 8701).
+// isGrease 判断 v 是否为 GREASE 值（RFC 8701）。
+func isGrease(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGrease(values []uint16) []uint16 {
+	out := make([]uint16, 0, len(values))
+	for _, v := range values {
+		if !isGrease(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func joinUint16s(values []uint16, format string, sep string) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprintf(format, v)
+	}
+	return strings.Join(parts, sep)
+}
+
+// JA3String returns the JA3 fingerprint string:
+// SSLVersion,Ciphers,Extensions,EllipticCurves,EllipticCurvePointFormats.
+// JA3String 返回 JA3 指纹原始字符串：SSLVersion,Ciphers,Extensions,EllipticCurves,EllipticCurvePointFormats。
+func (h *ClientHello) JA3String() string {
+	points := make([]string, len(h.PointFormats))
+	for i, p := range h.PointFormats {
+		points[i] = strconv.Itoa(int(p))
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(h.Version)),
+		joinUint16s(withoutGrease(h.CipherSuites), "%d", "-"),
+		joinUint16s(withoutGrease(h.Extensions), "%d", "-"),
+		joinUint16s(withoutGrease(h.SupportedGroups), "%d", "-"),
+		strings.Join(points, "-"),
+	}, ",")
+}
+
+// JA3 returns the JA3 fingerprint, the MD5 of JA3String. For a parsed
+// ClientHello it is computed once, at parse time.
+// JA3 返回 JA3 指纹，即 JA3String 的 MD5 值，解析得到的 ClientHello 在解析时计算一次。
+func (h *ClientHello) JA3() string {
+	if h.ja3 != "" {
+		return h.ja3
+	}
+	sum := md5.Sum([]byte(h.JA3String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// JA4 returns the JA4 fingerprint of a ClientHello received over TCP. For a
+// parsed ClientHello it is computed once, at parse time.
+// JA4 返回通过 TCP 收到的 ClientHello 的 JA4 指纹，解析得到的 ClientHello 在解析时计算一次。
+func (h *ClientHello) JA4() string {
+	if h.ja4 != "" {
+		return h.ja4
+	}
+	ciphers := withoutGrease(h.CipherSuites)
+	extensions := withoutGrease(h.Extensions)
+
+	sni := "i"
+	if slices.Contains(extensions, extServerName) {
+		sni = "d"
+	}
+	a := fmt.Sprintf("t%s%s%02d%02d%s",
+		ja4Version(h), sni, min(len(ciphers), 99), min(len(extensions), 99), ja4ALPN(h.ALPN))
+
+	slices.Sort(ciphers)
+	b := ja4Hash(joinUint16s(ciphers, "%04x", ","))
+
+	sorted := make([]uint16, 0, len(extensions))
+	for _, ext := range extensions {
+		if ext != extServerName && ext != extALPN {
+			sorted = append(sorted, ext)
+		}
+	}
+	slices.Sort(sorted)
+	c := "000000000000"
+	if len(sorted) > 0 {
+		raw := joinUint16s(sorted, "%04x", ",")
+		if len(h.SignatureAlgorithms) > 0 {
+			raw += "_" + joinUint16s(h.SignatureAlgorithms, "%04x", ",")
+		}
+		c = ja4Hash(raw)
+	}
+	return a + "_" + b + "_" + c
+}
+
+func ja4Version(h *ClientHello) string {
+	version := h.Version
+	if versions := withoutGrease(h.SupportedVersions); len(versions) > 0 {
+		version = slices.Max(versions)
+	}
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	default:
+		return "00"
+	}
+}
+
+func ja4ALPN(alpn []string) string {
+	if len(alpn) == 0 || alpn[0] == "" {
+		return "00"
+	}
+	first, last := alpn[0][0], alpn[0][len(alpn[0])-1]
+	if isAlnum(first) && isAlnum(last) {
+		return string([]byte{first, last})
+	}
+	encoded := hex.EncodeToString([]byte(alpn[0]))
+	return encoded[:1] + encoded[len(encoded)-1:]
+}
+
+func isAlnum(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// matchClientFingerprint reports whether the ClientHello of ctx has one of
+// the given JA3 or JA4 fingerprints.
+// matchClientFingerprint 判断 ctx 的 ClientHello 是否具有给定的 JA3 或 JA4 指纹之一。
+func matchClientFingerprint(match map[string]struct{}, ctx *Context) bool {
+	if ctx.ClientHello == nil {
+		return false
+	}
+	if _, ok := match[strings.ToLower(ctx.ClientHello.JA4())]; ok {
+		return true
+	}
+	_, ok := match[ctx.ClientHello.JA3()]
+	return ok
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"testing"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// buildClientHello assembles a ClientHello with GREASE values in every list.
+func buildClientHello() []byte {
+	var b cryptobyte.Builder
+	b.AddUint8(1)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(0x0303)
+		b.AddBytes(make([]byte, 32))
+		b.AddUint8(0)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, suite := range []uint16{0x0a0a, 0x1301, 0xc02b, 0x1302} {
+				b.AddUint16(suite)
+			}
+		})
+		b.AddUint8(1)
+		b.AddUint8(0)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			ext := func(typ uint16, body func(*cryptobyte.Builder)) {
+				b.AddUint16(typ)
+				b.AddUint16LengthPrefixed(body)
+			}
+			ext(0x1a1a, func(*cryptobyte.Builder) {})
+			ext(extServerName, func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint8(0)
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte("a.test")) })
+				})
+			})
+			ext(extSupportedGroups, func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16(0x2a2a)
+					b.AddUint16(29)
+					b.AddUint16(23)
+				})
+			})
+			ext(extPointFormats, func(b *cryptobyte.Builder) {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint8(0) })
+			})
+			ext(extALPN, func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					for _, proto := range []string{"h2", "http/1.1"} {
+						b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte(proto)) })
+					}
+				})
+			})
+			ext(extSignatureAlgorithms, func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16(0x0804)
+					b.AddUint16(0x0403)
+				})
+			})
+			ext(extSupportedVersions, func(b *cryptobyte.Builder) {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint16(0x3a3a)
+					b.AddUint16(0x0304)
+					b.AddUint16(0x0303)
+				})
+			})
+		})
+	})
+	return b.BytesOrPanic()
+}
+
+func TestClientHello(t *testing.T) {
+	msg := buildClientHello()
+	hash := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])[:12]
+	}
+
+	tests := []struct {
+		name    string
+		records [][]byte
+	}{
+		{"single record", [][]byte{msg}},
+		{"fragmented", [][]byte{msg[:10], msg[10:]}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				for _, fragment := range tt.records {
+					record := []byte{0x16, 0x03, 0x01, byte(len(fragment) >> 8), byte(len(fragment))}
+					_, _ = client.Write(append(record, fragment...))
+				}
+				_ = client.Close()
+			}()
+
+			hello, err := peekClientHello(NewConn(server))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hello.ServerName != "a.test" || len(hello.ALPN) != 2 || hello.ALPN[0] != "h2" {
+				t.Errorf("ServerName = %q, ALPN = %v", hello.ServerName, hello.ALPN)
+			}
+			if got, want := hello.JA3String(), "771,4865-49195-4866,0-10-11-16-13-43,29-23,0"; got != want {
+				t.Errorf("JA3String = %s, want %s", got, want)
+			}
+			want := "t13d0306h2_" + hash("1301,1302,c02b") + "_" + hash("000a,000b,000d,002b_0804,0403")
+			if got := hello.JA4(); got != want {
+				t.Errorf("JA4 = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestPeekClientHelloLimit(t *testing.T) {
+	msg := buildClientHello()
+	tiny := make([][]byte, len(msg))
+	for i := range msg {
+		tiny[i] = msg[i : i+1]
+	}
+	tests := []struct {
+		name    string
+		records [][]byte
+		repeat  bool // 不断重复最后一个记录
+		wantErr bool
+	}{
+		{"one byte per record", tiny, false, false},
+		{"empty records", [][]byte{{}}, true, true},
+		{"endless small records", [][]byte{{1, 0x00, 0xff, 0xf0}, {0}}, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				defer client.Close()
+				write := func(fragment []byte) error {
+					record := []byte{0x16, 0x03, 0x01, byte(len(fragment) >> 8), byte(len(fragment))}
+					_, err := client.Write(append(record, fragment...))
+					return err
+				}
+				for _, fragment := range tt.records {
+					if write(fragment) != nil {
+						return
+					}
+				}
+				for tt.repeat && write(tt.records[len(tt.records)-1]) == nil {
+				}
+			}()
+
+			hello, err := peekClientHello(NewConn(server))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("peekClientHello() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && hello.ServerName != "a.test" {
+				t.Errorf("ServerName = %q", hello.ServerName)
+			}
+		})
+	}
+}
+
+func TestClientFingerprintIs(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		tlsClient := tls.Client(client, &tls.Config{ServerName: "a.test", NextProtos: []string{"http/1.1"}, InsecureSkipVerify: true})
+		_ = tlsClient.Handshake()
+		_ = tlsClient.Close()
+	}()
+
+	var hello *ClientHello
+	cfg := NewConfig(FromCA(Certificate, PrivateKey))
+	cfg.Resolver = NewResolver()
+	cfg.HttpHandler = HandleHttpFn(func(ctx *Context) error { hello = ctx.ClientHello; return nil })
+	cfg.TcpHandler = HandleTcpFn(func(ctx *Context) error { hello = ctx.ClientHello; return nil })
+	ctx := NewContext(ctxLogger, "test", cfg)
+	ctx.Conn = NewConn(server)
+	ctx.DstHost = "192.0.2.1"
+	_ = ctx.Dispatcher.Dispatch(ctx)
+
+	if hello == nil || hello.ServerName != "a.test" || len(hello.ALPN) == 0 || hello.ALPN[0] != "http/1.1" {
+		t.Fatalf("ClientHello = %+v", hello)
+	}
+	for _, tt := range []struct {
+		fingerprint string
+		want        bool
+	}{
+		{hello.JA3(), true},
+		{hello.JA4(), true},
+		{"t13d0000h2_000000000000_000000000000", false},
+	} {
+		if got := ClientFingerprintIs(tt.fingerprint).MatchReq(new(http.Request), ctx); got != tt.want {
+			t.Errorf("ClientFingerprintIs(%s) = %v, want %v", tt.fingerprint, got, tt.want)
+		}
+	}
+}
@@ -7,21 +7,36 @@ import (
 )
 
 type Config struct {
-	Limiter         Limiter         // 限速器（可选）
-	Negotiator      Negotiator      // 代理协商（HTTP、SOCKS5）
-	Resolver        Resolver        // 域名解析器
-	Dispatcher      Dispatcher      // 请求分发器
-	DefaultSNI      string          // 默认 SNI
-	TLSConfig       TLSConfig       // TLS 配置回调函数
-	HttpHandler     HttpHandler     // HTTP 请求处理
-	WsHandler       WsHandler       // WebSocket 处理
-	TcpHandler      TcpHandler      // TCP 处理
-	Dialer          proxy.Dialer    // 连接拨号器（可叠加代理）
-	ClientTLSConfig *tls.Config     // 客户端 TLS 配置
-	reqHandlers     []ReqHandlerFn  // 请求处理链
-	respHandlers    []RespHandlerFn // 响应处理链
-	wsHandlers      []WsHandlerFn   // WS 处理链
-	rawHandlers     []RawHandlerFn  // 原始数据处理链
+	Limiter             Limiter           // 限速器（可选）
+	Negotiator          Negotiator        // 代理协商（HTTP、SOCKS5）
+	Resolver            Resolver          // 域名解析器
+	Dispatcher          Dispatcher        // 请求分发器
+	Detectors           *DetectorRegistry // 协议检测器注册表
+	DefaultSNI          string            // 默认 SNI
+	TLSConfig           TLSConfig         // TLS 配置回调函数
+	HttpHandler         HttpHandler       // HTTP 请求处理
+	Http2Handler        HttpHandler       // HTTP/2 连接处理（如 Http2MitmHandler），nil 表示不通告 h2，全部流量经过 HttpHandler
+	WsHandler           WsHandler         // WebSocket 处理
+	TcpHandler          TcpHandler        // TCP 处理
+	UdpHandler          UdpHandler        // UDP 中继处理
+	Dialer              proxy.Dialer      // 连接拨号器（可叠加代理）
+	ClientTLSConfig     *tls.Config       // 客户端 TLS 配置
+	KeyLog              *KeyLog           // TLS 密钥日志（SSLKEYLOGFILE），nil 表示不记录
+	InterceptPolicy     *InterceptPolicy  // TLS 拦截策略（按 SNI、目标网段与端口），nil 表示全部拦截
+	PassthroughList     *PassthroughList  // 不做中间人的 TLS 透传名单（含握手失败自动学习），nil 表示禁用
+	AcceptProxyProtocol bool              // 入站连接必须携带 PROXY protocol（v1/v2）头部
+	SendProxyProtocol   int               // 拨号上游时发送的 PROXY protocol 版本（1 或 2），0 表示不发送
+	MagicHost           string            // 由代理自身提供 CA 下载页面的域名（例如 proxy.local），为空表示禁用
+	MagicCA             *CA               // CA 下载页面提供的证书，设置 MagicHost 时必须设置
+	ProtoDescriptors    *ProtoRegistry    // 转储 protobuf 时查询字段名的描述符，nil 表示以无 schema 的字段编号树输出
+	reqHandlers         []ReqHandlerFn    // 请求处理链
+	respHandlers        []RespHandlerFn   // 响应处理链
+	trailerHandlers     []RespTrailerFn   // 响应体读取完毕后的 trailer 处理链
+	wsHandlers          []WsHandlerFn     // WS 处理链
+	rawHandlers         []RawHandlerFn    // 原始数据处理链
+	udpHandlers         []UdpHandlerFn    // UDP 数据报处理链
+	grpcHandlers        []GrpcHandlerFn   // gRPC 消息处理链
+	impersonateFilters  [][]HelloMatcher  // 上游握手重放客户端 ClientHello 的条件
 }
 
 func NewConfig(tlsConfigFn TLSConfig) *Config {
@@ -29,10 +44,12 @@ func NewConfig(tlsConfigFn TLSConfig) *Config {
 		Negotiator:      HttpNegotiator,
 		Resolver:        defaultResolver,
 		Dispatcher:      defaultDispatcher,
+		Detectors:       NewDetectorRegistry(),
 		TLSConfig:       tlsConfigFn,
 		HttpHandler:     defaultHttpHandler,
 		WsHandler:       defaultWsHandler,
 		TcpHandler:      defaultTcpHandler,
+		UdpHandler:      defaultUdpHandler,
 		Dialer:          new(net.Dialer),
 		ClientTLSConfig: new(tls.Config),
 	}
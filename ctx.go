@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"crypto/x509"
 	"github.com/sirupsen/logrus"
 	"net"
 	"net/http"
@@ -12,11 +13,19 @@ type Context struct {
 	Id     string
 	Conn   *Conn
 	*Config
-	DstHost string
-	DstPort string
-	DstConn net.Conn
-	Req     *http.Request
-	Extra   any
+	DstHost       string
+	DstPort       string
+	DstConn       net.Conn
+	UdpConn       *net.UDPConn        // UDP 关联的中继套接字（仅 UDP ASSOCIATE）
+	User          string              // 认证通过的用户名（未认证时为空）
+	Socks4UserID  string              // SOCKS4 客户端发送的 USERID（未经认证，不可信）
+	Passthrough   bool                // 跳过协议识别，直接交由 TcpHandler 中继（例如 SOCKS5 BIND）
+	ProxyHeader   *ProxyHeader        // 入站 PROXY protocol 头部（未启用时为 nil）
+	Protocol      Protocol            // 协议检测器识别出的协议（未识别时为空）
+	UpstreamCerts []*x509.Certificate // 上游服务器返回的证书链（仅 UpstreamTLSConfig 模式）
+	ClientHello   *ClientHello        // 客户端发送的 ClientHello（仅 TLS 连接）
+	Req           *http.Request
+	Extra         any
 }
 
 func NewContext(logger Logger, id string, cfg *Config) *Context {
@@ -27,6 +36,15 @@ func NewContext(logger Logger, id string, cfg *Config) *Context {
 	}
 }
 
+// ClientAddr returns the original client address, taken from the PROXY
+// protocol header when one was received, or the connection's peer otherwise.
+func (c *Context) ClientAddr() net.Addr {
+	if c.ProxyHeader != nil && c.ProxyHeader.Source != nil {
+		return c.ProxyHeader.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
 var ctxLogger = func() *Logrus {
 	logger := logrus.New()
 	logger.SetFormatter(formatter(8, "ctx.go"))
@@ -1,6 +1,13 @@
 package proxy
 
-import "net/http"
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
 
 // HttpMethods contains the first three bytes of all standard HTTP methods
 // (GET, POST, PUT, HEAD, PATCH, DELETE, CONNECT, OPTIONS, TRACE).
@@ -16,3 +23,282 @@ var HttpMethods = map[string]struct{}{
 	http.MethodOptions[:3]: {},
 	http.MethodTrace[:3]:   {},
 }
+
+// Protocol names an application protocol recognised by a Detector.
+// Protocol 表示由 Detector 识别出的应用层协议。
+type Protocol string
+
+const (
+	ProtocolHTTP     Protocol = "http"     // HTTP/1.x
+	ProtocolTLS      Protocol = "tls"      // TLS
+	ProtocolHTTP2    Protocol = "h2"       // HTTP/2 prior knowledge（明文 HTTP/2）
+	ProtocolSSH      Protocol = "ssh"      // SSH
+	ProtocolRedis    Protocol = "redis"    // Redis RESP
+	ProtocolMySQL    Protocol = "mysql"    // MySQL
+	ProtocolPostgres Protocol = "postgres" // PostgreSQL
+)
+
+// Detector inspects the first bytes of a stream, using Conn.Peek so nothing
+// is consumed, and reports whether it claims the stream.
+// Detector 通过 Conn.Peek 预读取数据流的前几个字节（不消费数据），并判断是否认领该数据流。
+type Detector interface {
+	Detect(*Conn) bool
+}
+
+// DetectFn is a function type adapter that implements the Detector interface.
+// DetectFn 是一个函数类型适配器，用于实现 Detector 接口。
+type DetectFn func(*Conn) bool
+
+// Detect calls the function itself to inspect the stream.
+// Detect 会直接调用函数本身来检查数据流。
+func (f DetectFn) Detect(conn *Conn) bool { return f(conn) }
+
+// defaultGreetingTimeout is how long the client may stay silent before the
+// upstream is dialed to look for a server greeting.
+// defaultGreetingTimeout 是客户端保持静默多久后拨号上游并检查服务端问候报文。
+const defaultGreetingTimeout = 200 * time.Millisecond
+
+type detectorEntry struct {
+	protocol Protocol
+	priority int
+	detector Detector
+}
+
+// DetectorRegistry holds protocol detectors ordered by priority, higher
+// priorities running first, together with the handler of each protocol.
+// Client detectors inspect what the client sends; greeting detectors inspect
+// what the upstream sends first, for server-speaks-first protocols such as
+// MySQL, and only run when the client stays silent for GreetingTimeout and
+// their protocol has a handler, so the upstream is never dialed early for
+// nothing.
+// DetectorRegistry 按优先级（数值越大越先执行）保存协议检测器以及各协议的处理器。
+// 客户端检测器检查客户端发送的数据；问候检测器检查上游先发送的数据，
+// 用于 MySQL 等服务端先发言的协议，仅在客户端静默超过 GreetingTimeout 且其协议注册了处理器时执行，
+// 避免无谓地提前拨号上游。
+type DetectorRegistry struct {
+	GreetingTimeout time.Duration // 客户端静默多久后检查服务端问候报文，0 表示不检查
+
+	mu       sync.RWMutex
+	client   []detectorEntry
+	greeting []detectorEntry
+	handlers map[Protocol]TcpHandler
+}
+
+// NewDetectorRegistry creates a registry holding the built-in detectors for
+// HTTP/1.x, TLS, HTTP/2 prior knowledge, SSH, Redis, PostgreSQL and MySQL.
+// No handlers are registered, so detected streams keep the dispatcher's
+// default routing until one is.
+// NewDetectorRegistry 创建包含 HTTP/1.x、TLS、HTTP/2 prior knowledge、SSH、Redis、
+// PostgreSQL 与 MySQL 内置检测器的注册表。默认不注册处理器，
+// 在注册之前识别出的数据流仍按调度器的默认方式处理。
+func NewDetectorRegistry() *DetectorRegistry {
+	r := &DetectorRegistry{
+		GreetingTimeout: defaultGreetingTimeout,
+		handlers:        make(map[Protocol]TcpHandler),
+	}
+	r.Register(ProtocolHTTP2, 60, Http2Detector)
+	r.Register(ProtocolHTTP, 50, HttpDetector)
+	r.Register(ProtocolTLS, 40, TLSDetector)
+	r.Register(ProtocolSSH, 30, SSHDetector)
+	r.Register(ProtocolRedis, 20, RedisDetector)
+	r.Register(ProtocolPostgres, 10, PostgresDetector)
+	r.RegisterGreeting(ProtocolMySQL, 10, MySQLGreetingDetector)
+	return r
+}
+
+// Register adds a client detector claiming streams for protocol. Detectors of
+// equal priority run in registration order.
+// Register 添加一个为 protocol 认领数据流的客户端检测器，优先级相同时按注册顺序执行。
+func (r *DetectorRegistry) Register(protocol Protocol, priority int, detector Detector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.client = insertDetector(r.client, detectorEntry{protocol, priority, detector})
+}
+
+// RegisterGreeting adds a detector run against the upstream's first bytes.
+// RegisterGreeting 添加一个针对上游首批数据执行的检测器。
+func (r *DetectorRegistry) RegisterGreeting(protocol Protocol, priority int, detector Detector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.greeting = insertDetector(r.greeting, detectorEntry{protocol, priority, detector})
+}
+
+// Handle routes streams detected as protocol to handler.
+// Handle 将识别为 protocol 的数据流交由 handler 处理。
+func (r *DetectorRegistry) Handle(protocol Protocol, handler TcpHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[protocol] = handler
+}
+
+// Handler returns the handler registered for protocol, if any.
+// Handler 返回为 protocol 注册的处理器。
+func (r *DetectorRegistry) Handler(protocol Protocol) (TcpHandler, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	handler, ok := r.handlers[protocol]
+	return handler, ok
+}
+
+func insertDetector(entries []detectorEntry, entry detectorEntry) []detectorEntry {
+	entries = append(entries, entry)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].priority > entries[j].priority
+	})
+	return entries
+}
+
+// Detect identifies the protocol of ctx's stream and returns "" when no
+// detector claims it. When the client stays silent and a greeting detector
+// has a handler registered, the upstream is dialed and kept in ctx.DstConn.
+// Detect 识别 ctx 数据流的协议，没有检测器认领时返回空字符串。
+// 客户端保持静默且某个问候检测器注册了处理器时，会拨号上游并保存在 ctx.DstConn 中。
+func (r *DetectorRegistry) Detect(ctx *Context) Protocol {
+	r.mu.RLock()
+	client := r.client
+	//只有注册了处理器的问候检测器才值得拨号上游
+	var greeting []detectorEntry
+	for _, entry := range r.greeting {
+		if _, ok := r.handlers[entry.protocol]; ok {
+			greeting = append(greeting, entry)
+		}
+	}
+	r.mu.RUnlock()
+
+	if len(greeting) > 0 && r.GreetingTimeout > 0 && ctx.DstConn == nil {
+		_ = ctx.Conn.SetReadDeadline(time.Now().Add(r.GreetingTimeout))
+		_, err := ctx.Conn.Peek(1)
+		_ = ctx.Conn.SetReadDeadline(time.Time{})
+		if IsTimeout(err) {
+			if protocol := detectGreeting(ctx, greeting, r.GreetingTimeout); protocol != "" {
+				return protocol
+			}
+		}
+	}
+
+	for _, entry := range client {
+		if entry.detector.Detect(ctx.Conn) {
+			return entry.protocol
+		}
+	}
+	return ""
+}
+
+// detectGreeting dials the upstream and runs the greeting detectors on what
+// it sends first. The connection is kept in ctx.DstConn for the handler.
+// detectGreeting 拨号上游并对其首批数据执行问候检测器，连接保存在 ctx.DstConn 中供处理器使用。
+func detectGreeting(ctx *Context, greeting []detectorEntry, timeout time.Duration) Protocol {
+	upstream, err := dialTarget(ctx)
+	if err != nil {
+		ctx.Debugf("拨号上游检查问候报文失败：%v", err)
+		return ""
+	}
+	conn := NewConn(upstream)
+	ctx.DstConn = conn
+
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+	if _, err = conn.Peek(1); err != nil {
+		return ""
+	}
+	for _, entry := range greeting {
+		if entry.detector.Detect(conn) {
+			return entry.protocol
+		}
+	}
+	return ""
+}
+
+// peekPrefix reports whether the stream starts with prefix, peeking one more
+// byte at a time so a mismatch never waits for data the peer will not send.
+// peekPrefix 判断数据流是否以 prefix 开头，每次多预读取一个字节，
+// 避免在不匹配时等待对端不会发送的数据。
+func peekPrefix(conn *Conn, prefix []byte) bool {
+	for i := 1; i <= len(prefix); i++ {
+		raw, _ := conn.Peek(i)
+		if len(raw) < i || !bytes.Equal(raw, prefix[:i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// http2Preface is the client connection preface of HTTP/2 (RFC 9113 3.4).
+// http2Preface 是 HTTP/2 客户端连接序言（RFC 9113 3.4）。
+var http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// Http2Detector claims cleartext HTTP/2 streams sent with prior knowledge.
+// Http2Detector 识别基于 prior knowledge 的明文 HTTP/2 数据流。
+var Http2Detector DetectFn = func(conn *Conn) bool {
+	return peekPrefix(conn, http2Preface)
+}
+
+// HttpDetector claims HTTP/1.x streams starting with a standard method.
+// HttpDetector 识别以标准请求方法开头的 HTTP/1.x 数据流。
+var HttpDetector DetectFn = func(conn *Conn) bool {
+	raw, _ := conn.Peek(1)
+	if len(raw) < 1 || raw[0] < 'A' || raw[0] > 'Z' {
+		return false
+	}
+	raw, _ = conn.Peek(3)
+	_, ok := HttpMethods[string(raw)]
+	return ok
+}
+
+// TLSDetector claims streams starting with a TLS handshake record.
+// TLSDetector 识别以 TLS 握手记录开头的数据流。
+var TLSDetector DetectFn = func(conn *Conn) bool {
+	return peekPrefix(conn, []byte{0x16, 0x03})
+}
+
+// SSHDetector claims streams starting with an SSH identification string.
+// SSHDetector 识别以 SSH 版本标识开头的数据流。
+var SSHDetector DetectFn = func(conn *Conn) bool {
+	return peekPrefix(conn, []byte("SSH-"))
+}
+
+// RedisDetector claims streams starting with a RESP array, the form every
+// Redis client uses to send commands.
+// RedisDetector 识别以 RESP 数组开头的数据流，Redis 客户端均以该形式发送命令。
+var RedisDetector DetectFn = func(conn *Conn) bool {
+	if !peekPrefix(conn, []byte("*")) {
+		return false
+	}
+	raw, _ := conn.Peek(2)
+	return len(raw) == 2 && raw[1] >= '1' && raw[1] <= '9'
+}
+
+// PostgreSQL startup codes: protocol 3.0, SSLRequest, GSSENCRequest and
+// CancelRequest.
+// PostgreSQL 启动报文编码：协议 3.0、SSLRequest、GSSENCRequest 与 CancelRequest。
+var postgresStartupCodes = map[uint32]struct{}{
+	0x00030000: {},
+	80877103:   {},
+	80877104:   {},
+	80877102:   {},
+}
+
+// PostgresDetector claims streams starting with a PostgreSQL startup message.
+// PostgresDetector 识别以 PostgreSQL 启动报文开头的数据流。
+var PostgresDetector DetectFn = func(conn *Conn) bool {
+	// The message length is far below 16 MiB, so the first byte is zero
+	// 报文长度远小于 16 MiB，因此首字节为 0
+	if !peekPrefix(conn, []byte{0x00}) {
+		return false
+	}
+	raw, _ := conn.Peek(8)
+	if len(raw) < 8 || binary.BigEndian.Uint32(raw[:4]) < 8 {
+		return false
+	}
+	_, ok := postgresStartupCodes[binary.BigEndian.Uint32(raw[4:8])]
+	return ok
+}
+
+// MySQLGreetingDetector claims upstreams opening with a MySQL protocol 10
+// handshake packet: a 3-byte length, sequence id 0, then version 0x0a.
+// MySQLGreetingDetector 识别以 MySQL 协议 10 握手包开头的上游：
+// 3 字节长度、序号 0，随后为版本号 0x0a。
+var MySQLGreetingDetector DetectFn = func(conn *Conn) bool {
+	raw, _ := conn.Peek(5)
+	return len(raw) == 5 && raw[3] == 0x00 && raw[4] == 0x0a
+}
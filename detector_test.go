@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDetectorRegistry(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want Protocol
+	}{
+		{"http", []byte("GET / HTTP/1.1\r\n\r\n"), ProtocolHTTP},
+		{"h2", http2Preface, ProtocolHTTP2},
+		{"tls", []byte{0x16, 0x03, 0x01, 0x00, 0x05}, ProtocolTLS},
+		{"ssh", []byte("SSH-2.0-OpenSSH_9.6\r\n"), ProtocolSSH},
+		{"redis", []byte("*1\r\n$4\r\nPING\r\n"), ProtocolRedis},
+		{"postgres", []byte{0x00, 0x00, 0x00, 0x08, 0x04, 0xd2, 0x16, 0x2f}, ProtocolPostgres},
+		{"short", []byte("PI"), ""},
+		{"unknown", []byte{0x01, 0x02, 0x03, 0x04}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				_, _ = client.Write(tt.data)
+				_ = client.Close()
+			}()
+
+			ctx := NewContext(ctxLogger, "test", nil)
+			ctx.Conn = NewConn(server)
+			if got := NewDetectorRegistry().Detect(ctx); got != tt.want {
+				t.Fatalf("detected %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetectorGreeting(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte{0x4a, 0x00, 0x00, 0x00, 0x0a, '8', '.', '0'})
+		_, _ = conn.Read(make([]byte, 1))
+	}()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	var handled bool
+	cfg := NewConfig(nil)
+	cfg.Detectors.Handle(ProtocolMySQL, HandleTcpFn(func(ctx *Context) error {
+		handled = ctx.DstConn != nil
+		return nil
+	}))
+
+	host, port, _ := net.SplitHostPort(upstream.Addr().String())
+	ctx := NewContext(ctxLogger, "test", cfg)
+	ctx.Conn = NewConn(server)
+	ctx.DstHost, ctx.DstPort = host, port
+	defer func() {
+		if ctx.DstConn != nil {
+			ctx.DstConn.Close()
+		}
+	}()
+
+	if err = ctx.Dispatcher.Dispatch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Protocol != ProtocolMySQL || !handled {
+		t.Fatalf("protocol = %q, handled = %v", ctx.Protocol, handled)
+	}
+}
+
+func TestDetectorGreetingWithoutHandler(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		time.Sleep(2 * defaultGreetingTimeout)
+		_, _ = client.Write([]byte{0x01, 0x02, 0x03, 0x04})
+		_ = client.Close()
+	}()
+
+	cfg := NewConfig(nil)
+	cfg.Dialer = dialerFn(func(network, addr string) (net.Conn, error) {
+		t.Errorf("unexpected upstream dial to %s", addr)
+		return nil, net.ErrClosed
+	})
+	ctx := NewContext(ctxLogger, "test", cfg)
+	ctx.Conn = NewConn(server)
+	ctx.DstHost, ctx.DstPort = "192.0.2.1", "3306"
+	if got := cfg.Detectors.Detect(ctx); got != "" || ctx.DstConn != nil {
+		t.Fatalf("detected %q, DstConn = %v", got, ctx.DstConn)
+	}
+}
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"golang.org/x/net/proxy"
 	"net"
@@ -44,6 +45,91 @@ func (d *httpDialer) Dial(network, addr string) (net.Conn, error) {
 	return conn, nil
 }
 
+// dialTarget dials ctx.DstHost:ctx.DstPort through Config.Dialer and, when
+// Config.SendProxyProtocol is set, announces the original client with a
+// PROXY protocol header.
+func dialTarget(ctx *Context) (net.Conn, error) {
+	return dialTargetContext(context.Background(), ctx)
+}
+
+// dialTargetContext is like dialTarget, but gives up when c is done. Dialers
+// that do not implement proxy.ContextDialer are abandoned in the background.
+// dialTargetContext 与 dialTarget 相同，但 c 结束时放弃拨号。
+// 未实现 proxy.ContextDialer 的拨号器会在后台被放弃。
+func dialTargetContext(c context.Context, ctx *Context) (net.Conn, error) {
+	proxyAddr := net.JoinHostPort(ctx.DstHost, ctx.DstPort)
+	conn, err := dialContext(c, ctx.Dialer, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if ctx.SendProxyProtocol != 0 {
+		if err = writeProxyHeader(ctx, conn); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// dialContext dials addr through dialer, giving up when c is done.
+// dialContext 通过 dialer 拨号 addr，c 结束时放弃拨号。
+func dialContext(c context.Context, dialer proxy.Dialer, network, addr string) (net.Conn, error) {
+	if d, ok := dialer.(proxy.ContextDialer); ok {
+		return d.DialContext(c, network, addr)
+	}
+	if _, ok := c.Deadline(); !ok {
+		return dialer.Dial(network, addr)
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := dialer.Dial(network, addr)
+		done <- result{conn, err}
+	}()
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-c.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				_ = r.conn.Close()
+			}
+		}()
+		return nil, c.Err()
+	}
+}
+
+// dialUpstream returns the upstream connection of ctx. A connection already
+// stored in ctx.DstConn (e.g. pre-dialed by a negotiator) is reused, otherwise
+// a new one is dialed through Config.Dialer. When the client side has been
+// terminated as TLS, the upstream side is wrapped with ClientTLSConfig too,
+// replaying the client's ClientHello when HelloFilter.Impersonate matches.
+func dialUpstream(ctx *Context) (net.Conn, error) {
+	conn := ctx.DstConn
+	if conn == nil {
+		var err error
+		conn, err = dialTarget(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, ok := conn.(tlsClientConn); !ok && ctx.Conn.IsTLS() {
+		tlsConn, err := upstreamTLSClient(ctx, conn, clientTLSConfig(ctx))
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	return conn, nil
+}
+
 func httpDialerFn(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
 	return &httpDialer{u: u, forward: forward}, nil
 }
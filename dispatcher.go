@@ -3,7 +3,8 @@ package proxy
 import (
 	"bufio"
 	"crypto/tls"
-	"github.com/inconshreveable/go-vhost"
+	"errors"
+	"golang.org/x/net/http2"
 	"net/http"
 	"strings"
 )
@@ -16,156 +17,204 @@ type DispatchFn func(*Context) error
 
 func (f DispatchFn) Dispatch(ctx *Context) error { return f(ctx) }
 
-// 调度器，基于明文TCP进行调度
-var defaultDispatcher DispatchFn = func(ctx *Context) error {
-	//识别TCP流数据是否为http
-	req, parseErr := http.ReadRequest(bufio.NewReader(ctx.Conn.PeekRd))
-	if parseErr != nil {
-		//预读取数据，默认预读取1024字节
-		raw, err := ctx.Conn.Peek(2)
-		if err != nil && len(raw) <= 0 {
-			ctx.Error(err)
-			return err
-		}
+// SNIFallback decides what the dispatcher does with a TLS stream whose server
+// name cannot be learned from the destination, the PTR cache or the ClientHello.
+// SNIFallback 决定当无法从目标地址、反向解析缓存或 ClientHello 中获取 SNI 时，
+// 调度器如何处理该 TLS 流。
+type SNIFallback int
 
-		//tls协议解析,基于前两个字节识别tls协议
-		switch {
-		case raw[0] == 0x16 && raw[1] == 0x03:
-			//获取SNI
-			serverName := ctx.DstHost
-			if !IsDomain(serverName) { //如果目标地址不是域名，手动提取SNI
-				if record, ok := ctx.Resolver.GetPTR(serverName); ok { //检查反向解析缓存是否存储了IP对于的域名
-					serverName = record
-				} else { //通过ClientHello提取SNI
-					rawConn, err := vhost.TLS(ctx.Conn)
-					if err != nil { //解析出错，使用默认设定的SNI
-						serverName = ctx.DefaultSNI
-						if serverName == "" { //默认SNI为空，无法进行中间人攻击，直接使用TCP直连，放弃中间人攻击
-							return ctx.TcpHandler.HandleTcp(ctx)
-						}
-						ctx.Warn("No SNI provided, using fallback cert")
-					} else {
-						serverName = rawConn.Host()
-						ctx.Resolver.SetPTR(ctx.DstHost, serverName)
-						ctx.Conn = NewConn(rawConn)
-					}
-				}
-			}
+const (
+	// SNIFallbackDefault signs for Config.DefaultSNI, or passes the stream
+	// through as raw TCP when DefaultSNI is empty.
+	// SNIFallbackDefault 使用 Config.DefaultSNI 签发证书，DefaultSNI 为空时按 TCP 透传。
+	SNIFallbackDefault SNIFallback = iota
+	// SNIFallbackPassthrough always passes the stream through as raw TCP.
+	// SNIFallbackPassthrough 始终按 TCP 透传。
+	SNIFallbackPassthrough
+	// SNIFallbackDstHost signs for the destination address itself.
+	// SNIFallbackDstHost 使用目标地址本身签发证书。
+	SNIFallbackDstHost
+	// SNIFallbackReject closes the connection.
+	// SNIFallbackReject 直接关闭连接。
+	SNIFallbackReject
+)
 
-			//将连接审计为TLS
-			tlsCfg, err := ctx.TLSConfig.From(serverName)
-			if err != nil {
-				ctx.Error(err)
-				return err
-			}
-			ctx.Conn = NewConn(tls.Server(ctx.Conn, tlsCfg))
+// ErrNoSNI is returned by a dispatcher using SNIFallbackReject when a TLS
+// stream carries no usable server name.
+// ErrNoSNI 表示使用 SNIFallbackReject 策略时 TLS 流中没有可用的 SNI。
+var ErrNoSNI = errors.New("no SNI available")
+
+// DispatchOption configures a dispatcher created by TransparentDispatcher.
+// DispatchOption 用于配置 TransparentDispatcher 创建的调度器。
+type DispatchOption func(*dispatchOptions)
 
-			req, err = http.ReadRequest(bufio.NewReader(ctx.Conn.PeekRd))
-			if err != nil {
-				return ctx.TcpHandler.HandleTcp(ctx)
+type dispatchOptions struct {
+	sniFallback     SNIFallback
+	tlsVersionCheck bool
+	httpMethods     map[string]struct{} // nil 表示直接尝试解析 HTTP 请求
+}
+
+// WithSNIFallback sets the policy used when no server name can be determined.
+// WithSNIFallback 设置无法确定 SNI 时使用的策略。
+func WithSNIFallback(policy SNIFallback) DispatchOption {
+	return func(o *dispatchOptions) { o.sniFallback = policy }
+}
+
+// WithTLSVersionCheck controls whether the third byte of a TLS record header
+// must be a known minor version (<= 0x04) for the stream to be treated as TLS.
+// WithTLSVersionCheck 控制是否要求 TLS 记录头的第三个字节为已知的次版本号（<= 0x04）
+// 才将数据流识别为 TLS。
+func WithTLSVersionCheck(check bool) DispatchOption {
+	return func(o *dispatchOptions) { o.tlsVersionCheck = check }
+}
+
+// WithHttpMethods sets the HTTP methods recognised as plain HTTP. Streams are
+// matched on the first three bytes of each method before being parsed.
+// WithHttpMethods 设置识别为明文 HTTP 的请求方法，解析前先按各方法的前三个字节匹配。
+func WithHttpMethods(methods ...string) DispatchOption {
+	return func(o *dispatchOptions) {
+		o.httpMethods = make(map[string]struct{})
+		for _, method := range methods {
+			if len(method) >= 3 {
+				o.httpMethods[method[:3]] = struct{}{}
 			}
-		default:
-			return ctx.TcpHandler.HandleTcp(ctx)
 		}
 	}
+}
 
-	//当前中间人只支持http、websocket和tcp
-	switch {
-	case isWebSocketUpgrade(req):
-		return ctx.WsHandler.HandleWs(ctx)
-	default:
-		return ctx.HttpHandler.HandleHttp(ctx)
+// TransparentDispatcher creates the dispatcher used in transparent proxy mode,
+// where nothing but the destination address is known up front. By default it
+// recognises the standard HTTP methods, checks the TLS record version and
+// falls back to Config.DefaultSNI.
+// TransparentDispatcher 创建透明代理模式下使用的调度器，该模式下事先只知道目标地址。
+// 默认识别标准 HTTP 方法、校验 TLS 记录版本，并回退到 Config.DefaultSNI。
+func TransparentDispatcher(opts ...DispatchOption) DispatchFn {
+	o := &dispatchOptions{
+		sniFallback:     SNIFallbackDefault,
+		tlsVersionCheck: true,
+		httpMethods:     HttpMethods,
+	}
+	for _, opt := range opts {
+		opt(o)
 	}
+	return o.dispatch
 }
 
-func isWebSocketUpgrade(r *http.Request) bool {
-	return strings.HasPrefix(strings.ToLower(r.Header.Get("Connection")), "upgrade") &&
-		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
-}
+// 调度器，基于明文TCP进行调度
+var defaultDispatcher DispatchFn = (&dispatchOptions{sniFallback: SNIFallbackDefault}).dispatch
 
-var isHttp = map[string]struct{}{
-	http.MethodGet[:3]:     {},
-	http.MethodHead[:3]:    {},
-	http.MethodPost[:3]:    {},
-	http.MethodPut[:3]:     {},
-	http.MethodPatch[:3]:   {},
-	http.MethodDelete[:3]:  {},
-	http.MethodConnect[:3]: {},
-	http.MethodOptions[:3]: {},
-	http.MethodTrace[:3]:   {},
-}
+// dispatch is the code path shared by every dispatcher: it routes protocols
+// with a handler in Config.Detectors, sniffs plain HTTP and h2c, terminates
+// TLS with a forged certificate unless Config.InterceptPolicy or
+// Config.PassthroughList says otherwise, and hands everything else to the
+// TcpHandler.
+// dispatch 是所有调度器共用的流程：将 Config.Detectors 中已注册处理器的协议交由对应处理器，
+// 识别明文 HTTP 与 h2c，除 Config.InterceptPolicy 或 Config.PassthroughList 另有规定外使用伪造证书终止 TLS，
+// 其余流量交由 TcpHandler 处理。
+func (o *dispatchOptions) dispatch(ctx *Context) error {
+	//通过协议检测器识别协议，已注册处理器的协议直接交由对应处理器
+	if ctx.Detectors != nil {
+		ctx.Protocol = ctx.Detectors.Detect(ctx)
+		if handler, ok := ctx.Detectors.Handler(ctx.Protocol); ok && ctx.Protocol != "" {
+			ctx.Debugf("识别为 %s 协议", ctx.Protocol)
+			return handler.HandleTcp(ctx)
+		}
+	}
 
-// 基于透传模式下进行调度
-// tproxyDispatch is the internal dispatcher for transparent proxy mode.
-var tproxyDispatch DispatchFn = func(ctx *Context) error {
-	ctx.Debugf("进入 Dispatcher 处理流程")
+	//明文 HTTP/2（prior knowledge）
+	if ctx.Http2Handler != nil &&
+		(ctx.Protocol == ProtocolHTTP2 || ctx.Detectors == nil && Http2Detector(ctx.Conn)) {
+		ctx.Debugf("h2c 连接（prior knowledge）")
+		return ctx.Http2Handler.HandleHttp(ctx)
+	}
 
 	//识别TCP流数据是否为http
-	raw, err := ctx.Conn.Peek(3)
-	if err != nil && len(raw) == 0 {
+	req, err := o.sniffHttp(ctx)
+	if err != nil {
 		ctx.Error(err)
 		return err
 	}
-	ctx.Debugf("预读取数据：%v", raw)
 
-	ctx.Debugf("开始进行协议解析")
-	var req *http.Request
-	if _, ok := isHttp[string(raw)]; ok {
-		ctx.Debugf("可能是 HTTP 连接")
-		req, err = http.ReadRequest(bufio.NewReader(ctx.Conn.PeekRd))
+	//明文 HTTP/1.1 请求升级为 h2c
+	if req != nil && ctx.Http2Handler != nil && isH2cUpgrade(req) {
+		ctx.Debugf("h2c 升级请求：%s", req.URL.String())
+		return ctx.Http2Handler.HandleHttp(ctx)
+	}
+
+	if req == nil {
+		//tls协议解析,基于记录头识别tls协议
+		ok, err := o.sniffTLS(ctx)
 		if err != nil {
 			ctx.Error(err)
 			return err
 		}
-		ctx.Debugf("提取 HTTP 请求报文")
-	} else if raw[0] == 0x16 && raw[1] == 0x03 && raw[2] <= 0x04 { //tls协议解析,基于前两个字节识别tls协议
-		ctx.Debugf("可能是 TLS 连接")
-		//获取SNI
-		serverName := ctx.DstHost
-		if !IsDomain(serverName) { //如果目标地址不是域名，手动提取SNI
-			if record, ok := ctx.Resolver.GetPTR(serverName); ok { //检查反向解析缓存是否存储了IP对于的域名
-				ctx.Debugf("从缓存中提取 SNI")
-				serverName = record
-			} else { //通过ClientHello提取SNI
-				ctx.Debugf("开始解析 ClientHello 并提取 SNI")
-				rawConn, err := vhost.TLS(ctx.Conn)
-				if err != nil { //解析出错，使用默认设定的SNI
-					ctx.Debugf("提取 SNI 失败：%v", err)
-					serverName = ctx.DefaultSNI
-					if serverName == "" { //默认SNI为空，无法进行中间人攻击，直接使用TCP直连，放弃中间人攻击
-						ctx.Debugf("默认 SNI 为空")
-						return ctx.TcpHandler.HandleTcp(ctx)
-					}
-					ctx.Warn("No SNI provided, using fallback cert")
-					ctx.Debug("使用默认 SNI")
-				} else {
-					ctx.Debugf("提取 SNI 成功")
-					serverName = rawConn.Host()
-					ctx.Resolver.SetPTR(ctx.DstHost, serverName)
-					ctx.Conn = NewConn(rawConn)
-				}
-			}
+		if !ok {
+			ctx.Debugf("直接进行 TCP 透传")
+			return ctx.TcpHandler.HandleTcp(ctx)
 		}
 
+		//完整保留 ClientHello，用于提取 SNI 与客户端指纹识别
+		if ctx.ClientHello, err = peekClientHello(ctx.Conn); err != nil {
+			ctx.Debugf("解析 ClientHello 失败：%v", err)
+		}
+
+		//获取SNI
+		serverName, err := o.serverName(ctx)
+		if err != nil {
+			return err
+		}
+		if serverName == "" { //无法进行中间人攻击，直接使用TCP直连，放弃中间人攻击
+			return ctx.TcpHandler.HandleTcp(ctx)
+		}
 		ctx.Debugf("SNI 域名：%s", serverName)
 
+		//拦截策略要求透传时，已预读的 ClientHello 原样交给 TcpHandler
+		if !ctx.InterceptPolicy.intercept(serverName, ctx) {
+			ctx.Debugf("拦截策略不拦截 %s，直接进行 TCP 透传", serverName)
+			return ctx.TcpHandler.HandleTcp(ctx)
+		}
+
+		//客户端曾多次拒绝伪造证书（如证书固定）的域名直接透传
+		if ctx.PassthroughList.passthrough(serverName) {
+			ctx.Debugf("%s 在透传名单中，直接进行 TCP 透传", serverName)
+			return ctx.TcpHandler.HandleTcp(ctx)
+		}
+
 		//将连接审计为TLS
-		tlsCfg, err := ctx.TLSConfig.From(serverName)
+		tlsCfg, err := tlsConfigFor(ctx, serverName)
 		if err != nil {
 			ctx.Error(err)
 			return err
 		}
-		ctx.Conn = NewConn(tls.Server(ctx.Conn, tlsCfg))
+		if ctx.Http2Handler != nil {
+			tlsCfg = withHttp2(tlsCfg)
+		}
+		tlsConn := tls.Server(ctx.Conn, ctx.KeyLog.apply(tlsCfg, ctx.Id, "client"))
+		ctx.Conn = NewConn(tlsConn)
+
+		if err = tlsConn.Handshake(); err != nil {
+			if switched, saveErr := ctx.PassthroughList.fail(serverName, err); switched {
+				ctx.Warnf("%s 客户端多次握手失败，后续连接改为透传", serverName)
+				if saveErr != nil {
+					ctx.Warnf("保存透传名单失败：%v", saveErr)
+				}
+			}
+			ctx.Debugf("客户端 TLS 握手失败：%v", err)
+			return err
+		}
+		ctx.PassthroughList.succeed(serverName)
+
+		//客户端通过 ALPN 选择了 h2
+		if tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+			ctx.Debugf("HTTP/2 连接")
+			return ctx.Http2Handler.HandleHttp(ctx)
+		}
 
 		req, err = http.ReadRequest(bufio.NewReader(ctx.Conn.PeekRd))
 		if err != nil {
-			ctx.Errorf("预读取请求失败：%v", err)
+			ctx.Debugf("预读取 HTTPS 请求失败：%v", err)
 			return ctx.TcpHandler.HandleTcp(ctx)
 		}
-		ctx.Debugf("提取 HTTPS 请求报文")
-	} else {
-		ctx.Debugf("直接进行 TCP 透传")
-		return ctx.TcpHandler.HandleTcp(ctx)
 	}
 
 	//当前中间人只支持http、websocket和tcp
@@ -178,3 +227,89 @@ var tproxyDispatch DispatchFn = func(ctx *Context) error {
 		return ctx.HttpHandler.HandleHttp(ctx)
 	}
 }
+
+// sniffHttp peeks a plain HTTP request from the stream. It returns a nil
+// request, and no error, when the stream is not HTTP.
+// sniffHttp 从数据流中预读取明文 HTTP 请求，数据流不是 HTTP 时返回 nil 请求且不返回错误。
+func (o *dispatchOptions) sniffHttp(ctx *Context) (*http.Request, error) {
+	if o.httpMethods == nil {
+		req, err := http.ReadRequest(bufio.NewReader(ctx.Conn.PeekRd))
+		if err != nil {
+			return nil, nil
+		}
+		return req, nil
+	}
+
+	raw, err := ctx.Conn.Peek(3)
+	if err != nil && len(raw) == 0 {
+		return nil, err
+	}
+	if _, ok := o.httpMethods[string(raw)]; !ok {
+		return nil, nil
+	}
+
+	ctx.Debugf("可能是 HTTP 连接")
+	return http.ReadRequest(bufio.NewReader(ctx.Conn.PeekRd))
+}
+
+// sniffTLS reports whether the stream starts with a TLS handshake record.
+// sniffTLS 判断数据流是否以 TLS 握手记录开头。
+func (o *dispatchOptions) sniffTLS(ctx *Context) (bool, error) {
+	n := 2
+	if o.tlsVersionCheck {
+		n = 3
+	}
+
+	raw, err := ctx.Conn.Peek(n)
+	if err != nil && len(raw) <= 0 {
+		return false, err
+	}
+	if len(raw) < n || raw[0] != 0x16 || raw[1] != 0x03 {
+		return false, nil
+	}
+	return !o.tlsVersionCheck || raw[2] <= 0x04, nil
+}
+
+// serverName determines the name to forge a certificate for. An empty name
+// means the stream should be passed through as raw TCP.
+// serverName 确定伪造证书使用的域名，返回空字符串表示应按 TCP 透传。
+func (o *dispatchOptions) serverName(ctx *Context) (string, error) {
+	serverName := ctx.DstHost
+	if IsDomain(serverName) {
+		return serverName, nil
+	}
+
+	//如果目标地址不是域名，手动提取SNI
+	if record, ok := ctx.Resolver.GetPTR(serverName); ok { //检查反向解析缓存是否存储了IP对于的域名
+		ctx.Debugf("从缓存中提取 SNI")
+		return record, nil
+	}
+
+	//通过ClientHello提取SNI
+	if ctx.ClientHello != nil && ctx.ClientHello.ServerName != "" {
+		ctx.Resolver.SetPTR(ctx.DstHost, ctx.ClientHello.ServerName)
+		return ctx.ClientHello.ServerName, nil
+	}
+	ctx.Debugf("ClientHello 中没有 SNI")
+
+	switch o.sniFallback {
+	case SNIFallbackPassthrough:
+		return "", nil
+	case SNIFallbackDstHost:
+		ctx.Warn("No SNI provided, signing for destination address")
+		return ctx.DstHost, nil
+	case SNIFallbackReject:
+		return "", ErrNoSNI
+	default:
+		if ctx.DefaultSNI == "" { //默认SNI为空
+			return "", nil
+		}
+		ctx.Warn("No SNI provided, using fallback cert")
+		return ctx.DefaultSNI, nil
+	}
+}
+
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.HasPrefix(strings.ToLower(r.Header.Get("Connection")), "upgrade") &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
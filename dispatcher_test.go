@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTransparentDispatcher(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []DispatchOption
+		data []byte
+		want string
+	}{
+		{"http", nil, []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), "http"},
+		{"websocket", nil, []byte("GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n"), "ws"},
+		{"unknown method", []DispatchOption{WithHttpMethods("GET")}, []byte("POST / HTTP/1.1\r\nHost: example.com\r\n\r\n"), "tcp"},
+		{"bad tls version", nil, []byte{0x16, 0x03, 0x09, 0x00, 0x00}, "tcp"},
+		{"no sni", []DispatchOption{WithSNIFallback(SNIFallbackPassthrough)}, []byte{0x16, 0x03, 0x01, 0x00, 0x00}, "tcp"},
+		{"binary", nil, []byte{0x00, 0x01, 0x02, 0x03}, "tcp"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			go func() {
+				_, _ = client.Write(tt.data)
+				_ = client.Close()
+			}()
+
+			var got string
+			cfg := NewConfig(nil)
+			cfg.HttpHandler = HandleHttpFn(func(*Context) error { got = "http"; return nil })
+			cfg.WsHandler = HandleWsFn(func(*Context) error { got = "ws"; return nil })
+			cfg.TcpHandler = HandleTcpFn(func(*Context) error { got = "tcp"; return nil })
+
+			ctx := NewContext(ctxLogger, "test", cfg)
+			ctx.Conn = NewConn(server)
+			ctx.DstHost = "192.0.2.1"
+			if err := TransparentDispatcher(tt.opts...).Dispatch(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("dispatched to %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
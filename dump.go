@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httputil"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// DumpRequest is like httputil.DumpRequest, except that protobuf bodies are
+// rendered as decoded field trees, or as JSON when Config.ProtoDescriptors
+// knows the message type. The body is restored afterwards. gRPC bodies are
+// streams that only end with the call, so they are never read: only the
+// headers are dumped, and the messages are left to the gRPC handler chain.
+// DumpRequest 与 httputil.DumpRequest 类似，但 protobuf 消息体会以解码后的字段树输出，
+// Config.ProtoDescriptors 中存在对应消息类型时以 JSON 输出。转储后会恢复消息体。
+// gRPC 消息体是随调用结束才结束的流，因此不会读取，仅转储头部，消息交由 gRPC 处理链处理。
+func (c *Context) DumpRequest(req *http.Request, body bool) ([]byte, error) {
+	if isGrpc(req.Header) {
+		return httputil.DumpRequest(req, false)
+	}
+	if !body || req.Body == nil || !isProtoBody(req.Header) {
+		return httputil.DumpRequest(req, body)
+	}
+
+	dump, err := httputil.DumpRequest(req, false)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(raw))
+
+	return append(dump, formatProtoBody(c.ProtoDescriptors, req.Header, raw)...), nil
+}
+
+// DumpResponse is like httputil.DumpResponse, with protobuf bodies rendered
+// and gRPC bodies skipped the same way as DumpRequest. The body is restored
+// afterwards.
+// DumpResponse 与 httputil.DumpResponse 类似，protobuf 消息体的输出方式与 gRPC 消息体的跳过方式
+// 均与 DumpRequest 相同，转储后会恢复消息体。
+func (c *Context) DumpResponse(resp *http.Response, body bool) ([]byte, error) {
+	if isGrpc(resp.Header) {
+		return httputil.DumpResponse(resp, false)
+	}
+	if !body || resp.Body == nil || !isProtoBody(resp.Header) {
+		return httputil.DumpResponse(resp, body)
+	}
+
+	dump, err := httputil.DumpResponse(resp, false)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(raw))
+	return append(dump, formatProtoBody(c.ProtoDescriptors, resp.Header, raw)...), nil
+}
+
+func isProtoBody(header http.Header) bool {
+	ok, _ := isProtobuf(header.Get("Content-Type"))
+	return ok
+}
+
+// formatProtoBody renders a protobuf body, using field names when registry
+// knows the message type.
+// formatProtoBody 输出 protobuf 消息体，registry 中存在对应消息类型时使用字段名。
+func formatProtoBody(registry *ProtoRegistry, header http.Header, raw []byte) []byte {
+	var md protoreflect.MessageDescriptor
+	if _, name := isProtobuf(header.Get("Content-Type")); name != "" && registry != nil {
+		md, _ = registry.FindMessage(name)
+	}
+	return []byte(formatProtoPayload(registry, md, raw))
+}
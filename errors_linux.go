@@ -12,3 +12,15 @@ func IsConnReset(err error) bool {
 func IsConnAborted(err error) bool {
 	return errors.Is(err, syscall.ECONNABORTED)
 }
+
+func IsConnRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+func IsHostUnreachable(err error) bool {
+	return errors.Is(err, syscall.EHOSTUNREACH)
+}
+
+func IsNetUnreachable(err error) bool {
+	return errors.Is(err, syscall.ENETUNREACH)
+}
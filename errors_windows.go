@@ -12,3 +12,22 @@ func IsConnReset(err error) bool {
 func IsConnAborted(err error) bool {
 	return errors.Is(err, syscall.WSAECONNABORTED)
 }
+
+// Winsock error codes that the syscall package does not define.
+const (
+	wsaeNetUnreach  syscall.Errno = 10051
+	wsaeConnRefused syscall.Errno = 10061
+	wsaeHostUnreach syscall.Errno = 10065
+)
+
+func IsConnRefused(err error) bool {
+	return errors.Is(err, wsaeConnRefused)
+}
+
+func IsHostUnreachable(err error) bool {
+	return errors.Is(err, wsaeHostUnreach)
+}
+
+func IsNetUnreachable(err error) bool {
+	return errors.Is(err, wsaeNetUnreach)
+}
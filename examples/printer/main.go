@@ -1,25 +1,40 @@
 package main
 
 import (
+	"flag"
 	"github.com/gobwas/ws"
 	"github.com/vpxuser/proxy"
 	"net/http"
-	"net/http/httputil"
+	"strings"
 )
 
 func main() {
+	protoFiles := flag.String("proto", "", "comma separated FileDescriptorSet files used to decode protobuf payloads")
+	flag.Parse()
+
 	proxy.SetLogLevel(proxy.TraceLevel)
+	var registry *proxy.ProtoRegistry
+	if *protoFiles != "" {
+		var err error
+		if registry, err = proxy.LoadProtoDescriptors(strings.Split(*protoFiles, ",")...); err != nil {
+			proxy.Fatal(err)
+		}
+		proxy.Infof("load protobuf descriptors: %s", *protoFiles)
+	}
 	proxy.Infof("use ca certificate:\n       ├── 证书颁发机构：%s\n       ├── 证书域名：%s\n       └── 证书失效日期：%s",
 		proxy.Certificate.Issuer.String(), proxy.Certificate.Subject.String(), proxy.Certificate.NotAfter.String())
 	tlsConf := proxy.FromCA(proxy.Certificate, proxy.PrivateKey)
 	proxy.Infof("init tls config function")
 	conf := proxy.NewConfig(tlsConf)
+	conf.ProtoDescriptors = registry
 	conf.DefaultSNI = "www.google.com"
 	proxy.Infof("init default sni: www.google.com")
 	conf.ClientTLSConfig.InsecureSkipVerify = true
 	proxy.Infof("allow untrust certificate")
+	conf.Http2Handler = proxy.Http2MitmHandler
+	proxy.Infof("enable http/2 interception")
 	conf.WithReqMatcher().Handle(func(req *http.Request, ctx *proxy.Context) (*http.Request, *http.Response) {
-		request, err := httputil.DumpRequest(req, true)
+		request, err := ctx.DumpRequest(req, true)
 		if err != nil {
 			ctx.Error(err)
 			return req, nil
@@ -28,7 +43,7 @@ func main() {
 		return req, nil
 	})
 	conf.WithRespMatcher().Handle(func(resp *http.Response, ctx *proxy.Context) *http.Response {
-		response, err := httputil.DumpResponse(resp, true)
+		response, err := ctx.DumpResponse(resp, true)
 		if err != nil {
 			ctx.Error(err)
 			return resp
@@ -44,6 +59,10 @@ func main() {
 		ctx.Infof("\n%s", payload)
 		return frame
 	})
+	conf.WithGrpcMatcher().Handle(func(msg *proxy.GrpcMessage, ctx *proxy.Context) *proxy.GrpcMessage {
+		ctx.Infof("%s/%s (outbound: %v)\n%s", msg.Service, msg.Method, msg.Outbound, ctx.FormatGrpcMessage(msg))
+		return msg
+	})
 	conf.WithRawMatcher().Handle(func(raw []byte, ctx *proxy.Context) []byte {
 		ctx.Infof("\n%s", raw)
 		return raw
@@ -8,16 +8,21 @@ require (
 	github.com/elazarl/goproxy v1.7.0
 	github.com/gobwas/ws v1.4.0
 	github.com/google/uuid v1.6.0
-	github.com/inconshreveable/go-vhost v1.0.0
 	github.com/kataras/pio v0.0.2
+	github.com/refraction-networking/utls v1.8.2
 	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/crypto v0.36.0
 	golang.org/x/net v0.38.0
 	golang.org/x/sync v0.12.0
+	golang.org/x/sys v0.31.0
+	google.golang.org/protobuf v1.36.6
+	software.sslmate.com/src/go-pkcs12 v0.5.0
 )
 
 require (
+	github.com/andybalholm/brotli v1.0.6 // indirect
 	github.com/gobwas/httphead v0.1.0 // indirect
 	github.com/gobwas/pool v0.2.1 // indirect
-	golang.org/x/sys v0.31.0 // indirect
+	github.com/klauspost/compress v1.18.0 // indirect
 	golang.org/x/text v0.23.0 // indirect
 )
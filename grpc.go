@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// GrpcMessage is a single length-prefixed gRPC message, with its payload
+// already decompressed. Service and Method are taken from the request path.
+// Once a response body has been read to EOF, the handler chain sees one last
+// message with no Payload whose Trailer carries the response trailers.
+// GrpcMessage 表示单条带长度前缀的 gRPC 消息，Payload 已完成解压，
+// Service 与 Method 取自请求路径。响应体读取完毕后，处理链还会收到最后一条
+// 不含 Payload 的消息，其 Trailer 为响应的 trailer。
+type GrpcMessage struct {
+	Service  string      // 服务全名，例如 helloworld.Greeter
+	Method   string      // 方法名，例如 SayHello
+	Payload  []byte      // 消息内容（已解压）
+	Outbound bool        // true 表示客户端发往服务端，false 表示服务端发往客户端
+	Trailer  http.Header // 仅最后一条响应消息设置，为响应的 trailer；仅含 trailer 的响应为其已发送的头部
+}
+
+// Status returns the grpc-status code and the decoded grpc-message carried by
+// the Trailer of msg. ok is false for every message but the last one of a
+// response.
+// Status 返回 msg 的 Trailer 中的 grpc-status 状态码与解码后的 grpc-message，
+// 除响应的最后一条消息外 ok 均为 false。
+func (msg *GrpcMessage) Status() (code int, message string, ok bool) {
+	return grpcStatus(msg.Trailer)
+}
+
+// grpcHeaderLen is the size of the Compressed-Flag and Message-Length prefix.
+// grpcHeaderLen 是压缩标志与消息长度前缀的长度。
+const grpcHeaderLen = 5
+
+// grpcMaxMessageLen bounds the messages buffered by the proxy.
+// grpcMaxMessageLen 限制代理缓存的单条消息大小。
+const grpcMaxMessageLen = 16 << 20
+
+// isGrpc reports whether header belongs to a gRPC request or response.
+// isGrpc 判断 header 是否属于 gRPC 请求或响应。
+func isGrpc(header http.Header) bool {
+	return strings.HasPrefix(header.Get("Content-Type"), "application/grpc")
+}
+
+// parseGrpcPath splits "/package.Service/Method" into service and method.
+// parseGrpcPath 将 "/package.Service/Method" 拆分为服务名与方法名。
+func parseGrpcPath(path string) (string, string) {
+	service, method, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	return service, method
+}
+
+// GrpcStatus returns the grpc-status code and the decoded grpc-message of
+// resp. They are read from the trailers once the body has been read to EOF,
+// or from the headers of a trailers-only response. Handlers registered with
+// RespFilter.Handle run before the body is read, so call it from a handler
+// registered with RespFilter.HandleTrailer, or use GrpcMessage.Status on the
+// last message of the gRPC handler chain.
+// GrpcStatus 返回 resp 的 grpc-status 状态码与解码后的 grpc-message。
+// 响应体读取完毕后从 trailer 中读取，对于仅包含 trailer 的响应则从头部读取。
+// 通过 RespFilter.Handle 注册的处理器在读取响应体之前执行，因此应在通过 RespFilter.HandleTrailer
+// 注册的处理器中调用，或在 gRPC 处理链的最后一条消息上调用 GrpcMessage.Status。
+func GrpcStatus(resp *http.Response) (int, string, bool) {
+	header := resp.Trailer
+	if header.Get("Grpc-Status") == "" {
+		header = resp.Header
+	}
+	return grpcStatus(header)
+}
+
+func grpcStatus(header http.Header) (int, string, bool) {
+	code, err := strconv.Atoi(header.Get("Grpc-Status"))
+	if err != nil {
+		return 0, "", false
+	}
+	message, err := url.PathUnescape(header.Get("Grpc-Message"))
+	if err != nil {
+		message = header.Get("Grpc-Message")
+	}
+	return code, message, true
+}
+
+// grpcReader re-frames a gRPC body, running each message through the gRPC
+// handler chain. Compressed messages are decompressed before the handlers
+// and compressed again afterwards. For responses, the trailers are run
+// through the chain once the body reaches EOF.
+// grpcReader 重新封装 gRPC 消息体，每条消息都会经过 gRPC 处理链，
+// 压缩的消息在处理前解压，处理后重新压缩。对于响应，消息体读取完毕后 trailer 也会经过处理链。
+type grpcReader struct {
+	src      io.ReadCloser
+	ctx      *Context
+	service  string
+	method   string
+	encoding string
+	outbound bool
+	resp     *http.Response // 非 nil 表示响应体，EOF 后处理其 trailer
+	buf      bytes.Buffer
+}
+
+func newGrpcReader(ctx *Context, src io.ReadCloser, path string, header http.Header, outbound bool) *grpcReader {
+	service, method := parseGrpcPath(path)
+	return &grpcReader{
+		src:      src,
+		ctx:      ctx,
+		service:  service,
+		method:   method,
+		encoding: header.Get("Grpc-Encoding"),
+		outbound: outbound,
+	}
+}
+
+// newGrpcResponseReader wraps the body of resp, a response to the gRPC
+// request at path.
+// newGrpcResponseReader 包装 resp 的响应体，resp 为发往 path 的 gRPC 请求的响应。
+func newGrpcResponseReader(ctx *Context, resp *http.Response, path string) *grpcReader {
+	r := newGrpcReader(ctx, resp.Body, path, resp.Header, false)
+	r.resp = resp
+	return r
+}
+
+func (r *grpcReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if err := r.next(); err != nil {
+			if err == io.EOF {
+				r.trailer()
+			}
+			return 0, err
+		}
+	}
+	return r.buf.Read(p)
+}
+
+// trailer runs the response trailers through the handler chain, once. The
+// trailers are only complete after the body has been read to EOF.
+// trailer 将响应的 trailer 交给处理链处理（仅一次），trailer 要在响应体读取完毕后才完整。
+func (r *grpcReader) trailer() {
+	if r.resp == nil {
+		return
+	}
+	resp := r.resp
+	r.resp = nil
+
+	//仅包含 trailer 的响应，状态位于已发送的头部中，无法再修改
+	trailersOnly := resp.Trailer.Get("Grpc-Status") == "" && resp.Header.Get("Grpc-Status") != ""
+	trailer := resp.Trailer
+	if trailersOnly {
+		trailer = resp.Header.Clone()
+	}
+	if trailer == nil {
+		trailer = make(http.Header)
+	}
+
+	msg := r.ctx.filterGrpc(&GrpcMessage{
+		Service: r.service,
+		Method:  r.method,
+		Trailer: trailer,
+	}, r.ctx)
+	if msg != nil && !trailersOnly {
+		resp.Trailer = msg.Trailer
+	}
+}
+
+func (r *grpcReader) Close() error { return r.src.Close() }
+
+// next reads one message from src and queues its re-framed form in buf.
+// next 从 src 读取一条消息，并将重新封装后的消息放入 buf。
+func (r *grpcReader) next() error {
+	payload, compressed, err := readGrpcMessage(r.src, r.encoding)
+	if err != nil {
+		return err
+	}
+
+	msg := r.ctx.filterGrpc(&GrpcMessage{
+		Service:  r.service,
+		Method:   r.method,
+		Payload:  payload,
+		Outbound: r.outbound,
+	}, r.ctx)
+	if msg == nil {
+		return nil
+	}
+
+	payload = msg.Payload
+	header := make([]byte, grpcHeaderLen)
+	if compressed {
+		if payload, err = gzipCompress(payload); err != nil {
+			return err
+		}
+		header[0] = 1
+	}
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	r.buf.Write(header)
+	r.buf.Write(payload)
+	return nil
+}
+
+// readGrpcMessage reads one length-prefixed message from r and returns its
+// decompressed payload. It returns io.EOF at a clean message boundary.
+// readGrpcMessage 从 r 读取一条带长度前缀的消息并返回解压后的内容，在消息边界处结束时返回 io.EOF。
+func readGrpcMessage(r io.Reader, encoding string) ([]byte, bool, error) {
+	header := make([]byte, grpcHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, false, fmt.Errorf("truncated gRPC message header: %w", err)
+		}
+		return nil, false, err
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > grpcMaxMessageLen {
+		return nil, false, fmt.Errorf("gRPC message too large: %d bytes", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, false, fmt.Errorf("truncated gRPC message: %w", err)
+	}
+
+	compressed := header[0]&0x01 != 0
+	if !compressed {
+		return payload, false, nil
+	}
+	if encoding != "gzip" {
+		return nil, true, fmt.Errorf("unsupported grpc-encoding %q", encoding)
+	}
+	payload, err := gzipDecompress(payload)
+	return payload, true, err
+}
+
+func gzipDecompress(payload []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	payload, err = io.ReadAll(io.LimitReader(zr, grpcMaxMessageLen+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > grpcMaxMessageLen {
+		return nil, fmt.Errorf("gRPC message too large: inflates past %d bytes", grpcMaxMessageLen)
+	}
+	return payload, nil
+}
+
+func gzipCompress(payload []byte) ([]byte, error) {
+	var out bytes.Buffer
+	zw := gzip.NewWriter(&out)
+	if _, err := zw.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,288 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func grpcFrame(t *testing.T, payload []byte, compressed bool) []byte {
+	t.Helper()
+	flag := byte(0)
+	if compressed {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write(payload)
+		_ = zw.Close()
+		payload, flag = buf.Bytes(), 1
+	}
+	frame := binary.BigEndian.AppendUint32([]byte{flag}, uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+func TestGrpcMessages(t *testing.T) {
+	upstream := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if len(body) < grpcHeaderLen || body[0] != 1 {
+			t.Errorf("message not compressed: %q", body)
+			return
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(body[grpcHeaderLen:]))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		msg, _ := io.ReadAll(zr)
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Encoding", "gzip")
+		_, _ = w.Write(grpcFrame(t, append([]byte("echo:"), msg...), false))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "all%20good")
+	}), new(http2.Server)))
+	defer upstream.Close()
+	host, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	cfg := NewConfig(nil)
+	cfg.Http2Handler = Http2MitmHandler
+	cfg.Negotiator = HandshakeFn(func(ctx *Context) error {
+		ctx.DstHost, ctx.DstPort = host, port
+		return nil
+	})
+	cfg.WithGrpcMatcher(GrpcMethodIs("test.Echo/Say")).Handle(func(msg *GrpcMessage, ctx *Context) *GrpcMessage {
+		if msg.Outbound {
+			msg.Payload = bytes.ToUpper(msg.Payload)
+		} else {
+			msg.Payload = append(msg.Payload, '!')
+		}
+		return msg
+	})
+	var status int
+	var message string
+	cfg.WithRespMatcher().Handle(func(resp *http.Response, ctx *Context) *http.Response {
+		body, _ := io.ReadAll(resp.Body)
+		status, message, _ = GrpcStatus(resp)
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return resp
+	})
+
+	l, err := Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() { _ = l.Serve() }()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, l.Addr().String())
+		},
+	}}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com/test.Echo/Say",
+		bytes.NewReader(grpcFrame(t, []byte("ping"), true)))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Grpc-Encoding", "gzip")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if !bytes.Equal(body, grpcFrame(t, []byte("echo:PING!"), false)) {
+		t.Fatalf("unexpected body: %q", body)
+	}
+	if status != 0 || message != "all good" {
+		t.Fatalf("unexpected status seen by response handler: %d %q", status, message)
+	}
+	if resp.Trailer.Get("Grpc-Status") != "0" {
+		t.Fatalf("missing trailers: %v", resp.Trailer)
+	}
+}
+
+func TestGrpcTrailers(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		wantBody []byte
+		want     string   // 客户端收到的 grpc-message
+		wantSeen []string // gRPC 处理链依次收到的消息与状态
+		wantResp string   // 响应 trailer 处理器看到的状态
+	}{
+		{"normal response", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/grpc")
+			_, _ = w.Write(grpcFrame(t, []byte("pong"), false))
+			w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+			w.Header().Set(http.TrailerPrefix+"Grpc-Message", "all%20good")
+		}, grpcFrame(t, []byte("pong"), false), "rewritten", []string{"ping", "pong", "0 all good"}, "0 rewritten"},
+		{"trailers only", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Grpc-Status", "5")
+			w.Header().Set("Grpc-Message", "not%20found")
+			w.WriteHeader(http.StatusOK)
+		}, nil, "not found", []string{"ping", "5 not found"}, "5 not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(h2c.NewHandler(tt.handler, new(http2.Server)))
+			defer upstream.Close()
+			host, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+			cfg := NewConfig(nil)
+			cfg.Http2Handler = Http2MitmHandler
+			cfg.Negotiator = HandshakeFn(func(ctx *Context) error {
+				ctx.DstHost, ctx.DstPort = host, port
+				return nil
+			})
+			var respStatus bool
+			cfg.WithRespMatcher().Handle(func(resp *http.Response, ctx *Context) *http.Response {
+				// The body has not been read yet, so the trailers are still empty
+				_, _, respStatus = GrpcStatus(resp)
+				return resp
+			})
+			var trailerStatus string
+			cfg.WithRespMatcher().HandleTrailer(func(resp *http.Response, ctx *Context) {
+				code, message, _ := GrpcStatus(resp)
+				trailerStatus = strconv.Itoa(code) + " " + message
+			})
+			var seen []string
+			cfg.WithGrpcMatcher(GrpcMethodIs("test.Echo/Say")).Handle(func(msg *GrpcMessage, ctx *Context) *GrpcMessage {
+				if code, message, ok := msg.Status(); ok {
+					seen = append(seen, strconv.Itoa(code)+" "+message)
+					msg.Trailer.Set("Grpc-Message", "rewritten")
+				} else {
+					seen = append(seen, string(msg.Payload))
+				}
+				return msg
+			})
+
+			l, err := Listen("tcp", "127.0.0.1:0", cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			go func() { _ = l.Serve() }()
+
+			client := &http.Client{Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+					return net.Dial(network, l.Addr().String())
+				},
+			}}
+
+			req, _ := http.NewRequest(http.MethodPost, "http://example.com/test.Echo/Say",
+				bytes.NewReader(grpcFrame(t, []byte("ping"), false)))
+			req.Header.Set("Content-Type", "application/grpc")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			if !bytes.Equal(body, tt.wantBody) {
+				t.Errorf("unexpected body: %q", body)
+			}
+			if _, message, _ := GrpcStatus(resp); message != tt.want {
+				t.Errorf("client grpc-message = %q, want %q", message, tt.want)
+			}
+			if !slices.Equal(seen, tt.wantSeen) {
+				t.Errorf("gRPC handler saw %q, want %q", seen, tt.wantSeen)
+			}
+			if trailerStatus != tt.wantResp {
+				t.Errorf("trailer handler saw %q, want %q", trailerStatus, tt.wantResp)
+			}
+			if tt.wantBody != nil && respStatus {
+				t.Error("response handler unexpectedly saw the trailers")
+			}
+		})
+	}
+}
+
+func TestReadGrpcMessageInflateLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		wantErr bool
+	}{
+		{"at limit", grpcMaxMessageLen, false},
+		{"past limit", grpcMaxMessageLen + 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := grpcFrame(t, make([]byte, tt.size), true)
+			payload, _, err := readGrpcMessage(bytes.NewReader(frame), "gzip")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && len(payload) != tt.size {
+				t.Errorf("payload cut to %d bytes, want %d", len(payload), tt.size)
+			}
+		})
+	}
+}
+
+func TestRespTrailerHttp1(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Header().Set("Content-Type", "application/grpc")
+		_, _ = w.Write(grpcFrame(t, []byte("pong"), false))
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "all%20good")
+	}))
+	defer upstream.Close()
+
+	cfg := NewConfig(nil)
+	cfg.Dialer = dialerFn(func(network, addr string) (net.Conn, error) {
+		return net.Dial(network, upstream.Listener.Addr().String())
+	})
+	var status string
+	cfg.WithRespMatcher().HandleTrailer(func(resp *http.Response, ctx *Context) {
+		code, message, _ := GrpcStatus(resp)
+		status = strconv.Itoa(code) + " " + message
+		resp.Trailer.Set("Grpc-Message", "rewritten")
+	})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	ctx := NewContext(ctxLogger, "test", cfg)
+	ctx.Conn = NewConn(server)
+	ctx.DstHost, ctx.DstPort = "example.com", "80"
+	go func() { _ = ctx.HttpHandler.HandleHttp(ctx) }()
+
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com/test.Echo/Say",
+		bytes.NewReader(grpcFrame(t, []byte("ping"), false)))
+	req.Header.Set("Content-Type", "application/grpc")
+	if err := req.Write(client); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(client), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if status != "0 all good" {
+		t.Errorf("trailer handler saw %q", status)
+	}
+	if got := resp.Trailer.Get("Grpc-Message"); got != "rewritten" {
+		t.Errorf("client trailer grpc-message = %q, want rewritten", got)
+	}
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/http2/hpack"
+)
+
+// newH2cProxy starts a proxy whose sessions all go to upstream, with a
+// response handler tagging every intercepted response.
+func newH2cProxy(t *testing.T, upstream string) *Listener {
+	host, port, _ := net.SplitHostPort(upstream)
+	cfg := NewConfig(nil)
+	cfg.Http2Handler = Http2MitmHandler
+	cfg.Negotiator = HandshakeFn(func(ctx *Context) error {
+		ctx.DstHost, ctx.DstPort = host, port
+		return nil
+	})
+	cfg.WithRespMatcher().Handle(func(resp *http.Response, ctx *Context) *http.Response {
+		resp.Header.Set("X-Intercepted", ctx.Req.URL.Path)
+		return resp
+	})
+
+	l, err := Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = l.Serve() }()
+	return l
+}
+
+func TestH2cPriorKnowledge(t *testing.T) {
+	tests := []struct {
+		name         string
+		upstreamH2c  bool
+		wantUpstream string
+	}{
+		{"h2c upstream", true, "HTTP/2.0"},
+		{"http/1.1 upstream", false, "HTTP/1.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, r.Proto)
+			})
+			if tt.upstreamH2c {
+				handler = h2c.NewHandler(handler, new(http2.Server))
+			}
+			upstream := httptest.NewServer(handler)
+			defer upstream.Close()
+
+			l := newH2cProxy(t, upstream.Listener.Addr().String())
+			defer l.Close()
+
+			client := &http.Client{Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+					return net.Dial(network, l.Addr().String())
+				},
+			}}
+			resp, err := client.Get("http://example.com/prior")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			if string(body) != tt.wantUpstream || resp.Header.Get("X-Intercepted") != "/prior" {
+				t.Fatalf("unexpected response: body=%q header=%v", body, resp.Header)
+			}
+		})
+	}
+}
+
+func TestH2cUpgrade(t *testing.T) {
+	upstream := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Proto)
+	}), new(http2.Server)))
+	defer upstream.Close()
+
+	l := newH2cProxy(t, upstream.Listener.Addr().String())
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, "GET /upgrade HTTP/1.1\r\nHost: example.com\r\n"+
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status: %s", resp.Status)
+	}
+
+	if _, err = io.WriteString(conn, http2.ClientPreface); err != nil {
+		t.Fatal(err)
+	}
+	framer := http2.NewFramer(conn, reader)
+	framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	if err = framer.WriteSettings(); err != nil {
+		t.Fatal(err)
+	}
+
+	var intercepted string
+	var body strings.Builder
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Header().StreamID != 1 {
+			continue
+		}
+		switch f := frame.(type) {
+		case *http2.MetaHeadersFrame:
+			intercepted = f.PseudoValue("status") + " " + headerValue(f, "x-intercepted")
+		case *http2.DataFrame:
+			body.Write(f.Data())
+		}
+		if frame.Header().Flags.Has(http2.FlagDataEndStream) {
+			break
+		}
+	}
+
+	if intercepted != "200 /upgrade" || body.String() != "HTTP/2.0" {
+		t.Fatalf("unexpected response: %q body=%q", intercepted, body.String())
+	}
+}
+
+func TestH2cUpgradeBodyTooLarge(t *testing.T) {
+	upgrade := "Host: example.com\r\nConnection: Upgrade, HTTP2-Settings\r\n" +
+		"Upgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n"
+	chunk := strings.Repeat("a", 64<<10)
+	tests := []struct {
+		name    string
+		request string
+	}{
+		{"content length", "POST /upload HTTP/1.1\r\n" + upgrade +
+			"Content-Length: " + strconv.Itoa(h2cMaxUpgradeBody+1) + "\r\n\r\n"},
+		{"chunked", "POST /upload HTTP/1.1\r\n" + upgrade + "Transfer-Encoding: chunked\r\n\r\n" +
+			strings.Repeat(strconv.FormatInt(int64(len(chunk)), 16)+"\r\n"+chunk+"\r\n", h2cMaxUpgradeBody/len(chunk)+1) +
+			"0\r\n\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				t.Error("oversized upgrade request reached the upstream")
+			}))
+			defer upstream.Close()
+
+			l := newH2cProxy(t, upstream.Listener.Addr().String())
+			defer l.Close()
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			go func() { _, _ = io.WriteString(conn, tt.request) }()
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusRequestEntityTooLarge {
+				t.Fatalf("unexpected status: %s", resp.Status)
+			}
+		})
+	}
+}
+
+func headerValue(f *http2.MetaHeadersFrame, name string) string {
+	for _, field := range f.RegularFields() {
+		if field.Name == name {
+			return field.Value
+		}
+	}
+	return ""
+}
@@ -2,9 +2,7 @@ package proxy
 
 import (
 	"bufio"
-	"crypto/tls"
 	"errors"
-	"net"
 	"net/http"
 )
 
@@ -29,6 +27,22 @@ var defaultHttpHandler HandleHttpFn = func(ctx *Context) error {
 			return err
 		}
 
+		// Proxy credentials are meant for this hop only, never forward them
+		// 代理凭据仅用于当前跳，不能转发给上游
+		req.Header.Del("Proxy-Authorization")
+
+		//魔法域名由代理自身响应，不连接上游
+		if isMagicHost(req, ctx) {
+			if err = serveMagicHost(req, ctx).Write(ctx.Conn); err != nil {
+				ctx.Error(err)
+				return err
+			}
+			if req.Close {
+				return nil
+			}
+			continue
+		}
+
 		req, resp := ctx.filterReq(req, ctx)
 		if resp == nil {
 			if req == nil {
@@ -36,17 +50,10 @@ var defaultHttpHandler HandleHttpFn = func(ctx *Context) error {
 				return ErrNilRequest
 			}
 
-			if ctx.DstConn == nil {
-				proxyAddr := net.JoinHostPort(ctx.DstHost, ctx.DstPort)
-				ctx.DstConn, err = ctx.Dialer.Dial("tcp", proxyAddr)
-				if err != nil {
-					ctx.Error(err)
-					return err
-				}
-
-				if ctx.Conn.IsTLS() {
-					ctx.DstConn = tls.Client(ctx.DstConn, ctx.ClientTLSConfig)
-				}
+			ctx.DstConn, err = dialUpstream(ctx)
+			if err != nil {
+				ctx.Error(err)
+				return err
 			}
 
 			err := req.Write(ctx.DstConn)
@@ -66,7 +73,9 @@ var defaultHttpHandler HandleHttpFn = func(ctx *Context) error {
 			}
 		}
 
-		err = ctx.filterResp(resp, ctx).Write(ctx.Conn)
+		resp = ctx.filterResp(resp, ctx)
+		ctx.watchTrailer(resp, ctx)
+		err = resp.Write(ctx.Conn)
 		if err != nil {
 			ctx.Error(err)
 			return err
@@ -0,0 +1,394 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/http2"
+)
+
+// http2Protos is advertised through ALPN on both legs when HTTP/2 is enabled.
+// http2Protos 是启用 HTTP/2 时两端通过 ALPN 通告的协议列表。
+var http2Protos = []string{http2.NextProtoTLS, "http/1.1"}
+
+// hopHeaders are connection-specific headers that must not be relayed,
+// HTTP/2 forbids them outright.
+// hopHeaders 是不允许转发的连接级头部，HTTP/2 中禁止出现。
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Http2MitmHandler serves an HTTP/2 client connection, negotiated through
+// ALPN or, in cleartext, started with prior knowledge or an h2c Upgrade
+// request. Each stream is mapped to an http.Request, run through the request
+// and response handler chains, and forwarded upstream over HTTP/2 when the
+// upstream supports it, or HTTP/1.1 otherwise. It is opt-in through
+// Config.Http2Handler: h2 streams never pass through Config.HttpHandler.
+// Http2MitmHandler 处理 HTTP/2 客户端连接，包括通过 ALPN 协商的连接，
+// 以及以 prior knowledge 或 h2c Upgrade 请求开始的明文连接。每个流都映射为 http.Request，
+// 依次经过请求与响应处理链，上游支持 HTTP/2 时通过 HTTP/2 转发，否则回退到 HTTP/1.1。
+// 需通过 Config.Http2Handler 显式启用：h2 流不会经过 Config.HttpHandler。
+var Http2MitmHandler HandleHttpFn = func(ctx *Context) error {
+	var transport http2Transport
+	switch {
+	case ctx.Conn.IsTLS() && ctx.impersonate(ctx):
+		transport = newImpersonatedTransport(ctx)
+	case ctx.Conn.IsTLS():
+		transport = newHttp2Transport(ctx)
+	default:
+		transport = newH2cTransport(ctx)
+	}
+	defer transport.CloseIdleConnections()
+
+	opts := &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			// Streams run concurrently, each gets its own copy of the context
+			// 各个流并发执行，每个流使用独立的上下文副本
+			stream := *ctx
+			serveHttp2Stream(&stream, transport, w, req)
+		}),
+	}
+
+	conn := net.Conn(ctx.Conn)
+	if !ctx.Conn.IsTLS() && !Http2Detector(ctx.Conn) {
+		var err error
+		if conn, err = acceptH2cUpgrade(ctx, opts); err != nil {
+			ctx.Error(err)
+			return err
+		}
+	}
+
+	new(http2.Server).ServeConn(conn, opts)
+	return nil
+}
+
+// serveHttp2Stream relays a single HTTP/2 stream.
+// serveHttp2Stream 中继单个 HTTP/2 流。
+func serveHttp2Stream(ctx *Context, transport http.RoundTripper, w http.ResponseWriter, req *http.Request) {
+	req.Header.Del("Proxy-Authorization")
+	req.URL.Host = req.Host
+	if req.URL.Scheme == "" {
+		req.URL.Scheme = "https"
+		if !ctx.Conn.IsTLS() {
+			req.URL.Scheme = "http"
+		}
+	}
+	ctx.Req = req
+
+	if isMagicHost(req, ctx) {
+		if err := writeHttp2Response(w, serveMagicHost(req, ctx)); err != nil {
+			ctx.Error(err)
+		}
+		return
+	}
+
+	req, resp := ctx.filterReq(req, ctx)
+	if resp == nil {
+		if req == nil {
+			ctx.Error(ErrNilRequest)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		outReq := req.Clone(req.Context())
+		outReq.RequestURI = ""
+		for _, k := range hopHeaders {
+			outReq.Header.Del(k)
+		}
+		outReq.Header.Del("Http2-Settings")
+		if len(ctx.grpcHandlers) > 0 && isGrpc(outReq.Header) {
+			outReq.Body = newGrpcReader(ctx, outReq.Body, outReq.URL.Path, outReq.Header, true)
+			outReq.ContentLength = -1
+			outReq.Header.Del("Content-Length")
+		}
+
+		var err error
+		resp, err = transport.RoundTrip(outReq)
+		if err != nil {
+			if !errors.Is(err, context.Canceled) {
+				ctx.Error(err)
+			}
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if len(ctx.grpcHandlers) > 0 && isGrpc(resp.Header) {
+			resp.Body = newGrpcResponseReader(ctx, resp, req.URL.Path)
+			resp.ContentLength = -1
+			resp.Header.Del("Content-Length")
+		}
+	}
+	resp = ctx.filterResp(resp, ctx)
+	ctx.watchTrailer(resp, ctx)
+	defer resp.Body.Close()
+
+	if err := writeHttp2Response(w, resp); err != nil && !IsEOF(err) {
+		ctx.Error(err)
+	}
+}
+
+// writeHttp2Response copies resp to w, flushing every chunk so streaming
+// responses are not held back, and relays trailers after the body.
+// writeHttp2Response 将 resp 写入 w，每个数据块都会立即刷新，
+// 避免阻塞流式响应，并在响应体之后转发 trailer。
+func writeHttp2Response(w http.ResponseWriter, resp *http.Response) error {
+	header := w.Header()
+	for k, vv := range resp.Header {
+		header[k] = vv
+	}
+	for _, k := range hopHeaders {
+		header.Del(k)
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for k, vv := range resp.Trailer {
+		header[http.TrailerPrefix+k] = vv
+	}
+	return nil
+}
+
+// http2Transport is the upstream side of an intercepted HTTP/2 connection.
+// http2Transport 是被拦截的 HTTP/2 连接的上游部分。
+type http2Transport interface {
+	http.RoundTripper
+	CloseIdleConnections()
+}
+
+// upstreamDialer returns a dial function for transports whose connections all
+// go to the session's destination through Config.Dialer. A connection
+// pre-dialed by the negotiator is used for the first dial.
+// upstreamDialer 返回一个拨号函数，供所有连接都经 Config.Dialer 发往会话目标地址的 Transport 使用，
+// 协商阶段预先建立的连接用于第一次拨号。
+func upstreamDialer(ctx *Context) func(context.Context, string, string) (net.Conn, error) {
+	var mu sync.Mutex
+	dialed := ctx.DstConn
+	ctx.DstConn = nil
+
+	return func(c context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		conn := dialed
+		dialed = nil
+		mu.Unlock()
+		if conn != nil {
+			return conn, nil
+		}
+		return dialTarget(ctx)
+	}
+}
+
+// newHttp2Transport returns a transport that offers h2 to the upstream and
+// falls back to HTTP/1.1 when the upstream does not select it.
+// newHttp2Transport 返回一个向上游通告 h2 的 Transport，上游未选择 h2 时回退到 HTTP/1.1。
+func newHttp2Transport(ctx *Context) *http.Transport {
+	dial := upstreamDialer(ctx)
+	return &http.Transport{
+		ForceAttemptHTTP2: true,
+		DialContext:       dial,
+		DialTLSContext: func(c context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(c, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			//探测上游证书时已完成握手的连接直接使用
+			if _, ok := conn.(tlsClientConn); ok {
+				return conn, nil
+			}
+
+			cfg := clientTLSConfig(ctx).Clone()
+			if cfg.ServerName == "" {
+				cfg.ServerName, _, _ = net.SplitHostPort(addr)
+			}
+			cfg.NextProtos = http2Protos
+
+			tlsConn := tls.Client(conn, cfg)
+			if err = tlsConn.HandshakeContext(c); err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		},
+	}
+}
+
+// h2cTransport speaks cleartext HTTP/2 with prior knowledge to the upstream,
+// or HTTP/2 over a replayed ClientHello (see newImpersonatedTransport). When
+// the first attempt fails before HTTP/2 ever worked, the upstream is assumed
+// to speak HTTP/1.1 only and every later request uses HTTP/1.1.
+// h2cTransport 以 prior knowledge 方式与上游建立明文 HTTP/2 连接，
+// 或通过重放的 ClientHello 建立 HTTP/2 连接（参见 newImpersonatedTransport）。
+// 若在 HTTP/2 从未成功之前首次尝试即失败，则认为上游仅支持 HTTP/1.1，后续请求均使用 HTTP/1.1。
+type h2cTransport struct {
+	h2       *http2.Transport
+	h1       *http.Transport
+	h2ok     atomic.Bool
+	fallback atomic.Bool
+}
+
+func newH2cTransport(ctx *Context) *h2cTransport {
+	dial := upstreamDialer(ctx)
+	return &h2cTransport{
+		h2: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(c context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(c, network, addr)
+			},
+		},
+		h1: &http.Transport{DialContext: dial},
+	}
+}
+
+func (t *h2cTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.fallback.Load() {
+		resp, err := t.h2.RoundTrip(req)
+		if err == nil {
+			t.h2ok.Store(true)
+			return resp, nil
+		}
+		// Only requests without a body can safely be sent again
+		// 只有不带请求体的请求才能安全地重新发送
+		if t.h2ok.Load() || (req.ContentLength != 0 && req.GetBody == nil) {
+			return nil, err
+		}
+		t.fallback.Store(true)
+		if req.GetBody != nil {
+			req = req.Clone(req.Context())
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return t.h1.RoundTrip(req)
+}
+
+func (t *h2cTransport) CloseIdleConnections() {
+	t.h2.CloseIdleConnections()
+	t.h1.CloseIdleConnections()
+}
+
+// isH2cUpgrade reports whether req asks to upgrade to cleartext HTTP/2.
+// isH2cUpgrade 判断 req 是否请求升级为明文 HTTP/2。
+func isH2cUpgrade(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get("Upgrade"), "h2c") &&
+		req.Header.Get("Http2-Settings") != ""
+}
+
+// h2cMaxUpgradeBody bounds the body of an h2c Upgrade request, which has to
+// be buffered before switching protocols.
+// h2cMaxUpgradeBody 限制 h2c Upgrade 请求体的大小，该请求体需要在切换协议前完整缓存。
+const h2cMaxUpgradeBody = 1 << 20
+
+// errH2cBodyTooLarge is returned for h2c Upgrade requests whose body exceeds
+// h2cMaxUpgradeBody.
+// errH2cBodyTooLarge 表示 h2c Upgrade 请求体超过 h2cMaxUpgradeBody。
+var errH2cBodyTooLarge = errors.New("h2c upgrade request body too large") // h2c 升级请求体过大
+
+// acceptH2cUpgrade reads the h2c Upgrade request from ctx.Conn, answers it
+// with 101 Switching Protocols, and sets it up as stream 1 of opts. The
+// returned connection must be served in place of ctx.Conn. Requests whose
+// body exceeds h2cMaxUpgradeBody are answered with 413.
+// acceptH2cUpgrade 从 ctx.Conn 读取 h2c Upgrade 请求，响应 101 Switching Protocols，
+// 并将其设置为 opts 的第 1 个流。之后必须使用返回的连接代替 ctx.Conn。
+// 请求体超过 h2cMaxUpgradeBody 的请求以 413 响应。
+func acceptH2cUpgrade(ctx *Context, opts *http2.ServeConnOpts) (net.Conn, error) {
+	reader := bufio.NewReader(ctx.Conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !isH2cUpgrade(req) {
+		return nil, errors.New("not an h2c upgrade request") // 不是 h2c 升级请求
+	}
+
+	settings, err := base64.RawURLEncoding.DecodeString(
+		strings.TrimRight(req.Header.Get("Http2-Settings"), "="))
+	if err != nil {
+		return nil, err
+	}
+
+	// The body has to be read off the connection before switching protocols
+	// 切换协议前必须从连接中读取完请求体
+	var body []byte
+	if req.ContentLength <= h2cMaxUpgradeBody {
+		if body, err = io.ReadAll(io.LimitReader(req.Body, h2cMaxUpgradeBody+1)); err != nil {
+			return nil, err
+		}
+	}
+	if req.ContentLength > h2cMaxUpgradeBody || len(body) > h2cMaxUpgradeBody {
+		_, _ = io.WriteString(ctx.Conn, "HTTP/1.1 413 Request Entity Too Large\r\nConnection: close\r\nContent-Length: 0\r\n\r\n")
+		return nil, errH2cBodyTooLarge
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.ContentLength = int64(len(body))
+	req.RemoteAddr = ctx.Conn.RemoteAddr().String()
+
+	_, err = io.WriteString(ctx.Conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+	if err != nil {
+		return nil, err
+	}
+
+	opts.UpgradeRequest = req
+	opts.Settings = settings
+	return &bufferedConn{Conn: ctx.Conn, reader: reader}, nil
+}
+
+// bufferedConn reads through a bufio.Reader that may already hold data read
+// off the connection.
+// bufferedConn 通过可能已缓存连接数据的 bufio.Reader 读取数据。
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.reader.Read(p) }
+
+// withHttp2 returns a copy of cfg that also offers h2 through ALPN.
+// withHttp2 返回通过 ALPN 额外通告 h2 的 cfg 副本。
+func withHttp2(cfg *tls.Config) *tls.Config {
+	for _, proto := range cfg.NextProtos {
+		if strings.EqualFold(proto, http2.NextProtoTLS) {
+			return cfg
+		}
+	}
+	cfg = cfg.Clone()
+	cfg.NextProtos = append([]string{http2.NextProtoTLS}, cfg.NextProtos...)
+	if len(cfg.NextProtos) == 1 {
+		cfg.NextProtos = http2Protos
+	}
+	return cfg
+}
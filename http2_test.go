@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHttp2Mitm(t *testing.T) {
+	tests := []struct {
+		name         string
+		upstreamH2   bool
+		wantUpstream string
+	}{
+		{"h2 upstream", true, "HTTP/2.0"},
+		{"http/1.1 upstream", false, "HTTP/1.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Trailer", "X-Checksum")
+				w.Header().Set("X-Upstream-Proto", r.Proto)
+				_, _ = io.WriteString(w, r.Header.Get("X-Injected"))
+				w.Header().Set("X-Checksum", "ok")
+			}))
+			upstream.EnableHTTP2 = tt.upstreamH2
+			upstream.StartTLS()
+			defer upstream.Close()
+
+			cfg := NewConfig(FromSelfSigned())
+			cfg.Http2Handler = Http2MitmHandler
+			cfg.DefaultSNI = "example.com"
+			cfg.ClientTLSConfig.InsecureSkipVerify = true
+			cfg.WithReqMatcher().Handle(func(req *http.Request, ctx *Context) (*http.Request, *http.Response) {
+				req.Header.Set("X-Injected", "hello")
+				return req, nil
+			})
+			cfg.WithRespMatcher().Handle(func(resp *http.Response, ctx *Context) *http.Response {
+				resp.Header.Set("X-Intercepted", "true")
+				return resp
+			})
+
+			l, err := Listen("tcp", "127.0.0.1:0", cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			go func() { _ = l.Serve() }()
+
+			proxyURL, _ := url.Parse("http://" + l.Addr().String())
+			client := &http.Client{Transport: &http.Transport{
+				Proxy:             http.ProxyURL(proxyURL),
+				TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+				ForceAttemptHTTP2: true,
+			}}
+
+			resp, err := client.Get(upstream.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.ProtoMajor != 2 {
+				t.Fatalf("client leg negotiated %s, want HTTP/2", resp.Proto)
+			}
+			if got := resp.Header.Get("X-Upstream-Proto"); got != tt.wantUpstream {
+				t.Fatalf("upstream leg negotiated %s", got)
+			}
+			if string(body) != "hello" || resp.Header.Get("X-Intercepted") != "true" {
+				t.Fatalf("handlers not applied: body=%q header=%v", body, resp.Header)
+			}
+			if resp.Trailer.Get("X-Checksum") != "ok" {
+				t.Fatalf("missing trailer: %v", resp.Trailer)
+			}
+		})
+	}
+}
+
+func TestHttp2CustomHttpHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		http2     HttpHandler
+		wantProto int
+		wantBody  string
+	}{
+		{"default config", nil, 1, "custom /"},
+		{"http2 enabled", Http2MitmHandler, 2, "upstream"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, "upstream")
+			}))
+			upstream.EnableHTTP2 = true
+			upstream.StartTLS()
+			defer upstream.Close()
+
+			cfg := NewConfig(FromSelfSigned())
+			cfg.Http2Handler = tt.http2
+			cfg.DefaultSNI = "example.com"
+			cfg.ClientTLSConfig.InsecureSkipVerify = true
+			cfg.HttpHandler = HandleHttpFn(func(ctx *Context) error {
+				req, err := http.ReadRequest(bufio.NewReader(ctx.Conn))
+				if err != nil {
+					return err
+				}
+				resp := &http.Response{
+					StatusCode: http.StatusOK,
+					ProtoMajor: 1,
+					ProtoMinor: 1,
+					Body:       io.NopCloser(strings.NewReader("custom " + req.URL.Path)),
+					Close:      true,
+				}
+				return resp.Write(ctx.Conn)
+			})
+
+			l, err := Listen("tcp", "127.0.0.1:0", cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			go func() { _ = l.Serve() }()
+
+			proxyURL, _ := url.Parse("http://" + l.Addr().String())
+			client := &http.Client{Transport: &http.Transport{
+				Proxy:             http.ProxyURL(proxyURL),
+				TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+				ForceAttemptHTTP2: true,
+			}}
+
+			resp, err := client.Get(upstream.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.ProtoMajor != tt.wantProto || string(body) != tt.wantBody {
+				t.Fatalf("got %s %q, want HTTP/%d %q", resp.Proto, body, tt.wantProto, tt.wantBody)
+			}
+		})
+	}
+}
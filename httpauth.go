@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// digestNonceTTL bounds how long a Digest nonce issued in a 407 challenge
+// stays valid.
+// digestNonceTTL 限定 407 挑战中下发的 Digest nonce 的有效期。
+const digestNonceTTL = 5 * time.Minute
+
+// httpAuth validates Proxy-Authorization headers and builds the matching
+// Proxy-Authenticate challenges for the HTTP negotiator.
+// httpAuth 负责校验 Proxy-Authorization 请求头，并为 HTTP 握手器生成
+// 对应的 Proxy-Authenticate 挑战。
+type httpAuth struct {
+	realm  string
+	basic  Authenticator
+	digest PasswordLookup
+	secret []byte
+}
+
+func (a *httpAuth) enabled() bool { return a.basic != nil || a.digest != nil }
+
+// authenticate returns the user identity carried by req, or false when the
+// credentials are missing or invalid.
+// authenticate 返回请求中携带的用户身份，凭据缺失或无效时返回 false。
+func (a *httpAuth) authenticate(ctx *Context, req *http.Request) (string, bool) {
+	scheme, params, _ := strings.Cut(req.Header.Get("Proxy-Authorization"), " ")
+	switch {
+	case strings.EqualFold(scheme, "Basic") && a.basic != nil:
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(params))
+		if err != nil {
+			return "", false
+		}
+		username, password, ok := strings.Cut(string(raw), ":")
+		if !ok || !a.basic.Authenticate(ctx, username, password) {
+			return "", false
+		}
+		return username, true
+
+	case strings.EqualFold(scheme, "Digest") && a.digest != nil:
+		return a.verifyDigest(ctx, req.Method, parseAuthParams(params))
+
+	default:
+		return "", false
+	}
+}
+
+// challenges returns the Proxy-Authenticate header values for a 407 reply.
+// challenges 返回 407 响应中 Proxy-Authenticate 头的取值。
+func (a *httpAuth) challenges() []string {
+	var values []string
+	if a.digest != nil {
+		values = append(values, fmt.Sprintf(
+			`Digest realm=%q, qop="auth", algorithm=MD5, nonce=%q`,
+			a.realm, a.newNonce()))
+	}
+	if a.basic != nil {
+		values = append(values, fmt.Sprintf(`Basic realm=%q`, a.realm))
+	}
+	return values
+}
+
+// newNonce issues a stateless nonce: an issue timestamp followed by its HMAC,
+// so that any connection can validate it without shared session state.
+// newNonce 生成无状态 nonce：签发时间戳加上其 HMAC，
+// 任何连接都可以在无共享会话状态的情况下校验。
+func (a *httpAuth) newNonce() string {
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, uint64(time.Now().Unix()))
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(ts)
+	return base64.RawURLEncoding.EncodeToString(append(ts, mac.Sum(nil)...))
+}
+
+func (a *httpAuth) validNonce(nonce string) bool {
+	raw, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(raw) != 8+sha256.Size {
+		return false
+	}
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(raw[:8])
+	if !hmac.Equal(raw[8:], mac.Sum(nil)) {
+		return false
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(raw[:8])), 0)
+	return time.Since(issued) < digestNonceTTL
+}
+
+// verifyDigest checks a Digest response as described in RFC 7616, using the
+// MD5 and MD5-sess algorithms.
+// verifyDigest 按照 RFC 7616 校验 Digest 应答，支持 MD5 与 MD5-sess 算法。
+func (a *httpAuth) verifyDigest(ctx *Context, method string, params map[string]string) (string, bool) {
+	username := params["username"]
+	if params["realm"] != a.realm || !a.validNonce(params["nonce"]) {
+		return "", false
+	}
+
+	password, ok := a.digest.Password(ctx, username)
+	if !ok {
+		return "", false
+	}
+
+	ha1 := md5Hex(username + ":" + a.realm + ":" + password)
+	if strings.EqualFold(params["algorithm"], "MD5-sess") {
+		ha1 = md5Hex(ha1 + ":" + params["nonce"] + ":" + params["cnonce"])
+	}
+	ha2 := md5Hex(method + ":" + params["uri"])
+
+	var expected string
+	switch params["qop"] {
+	case "auth":
+		expected = md5Hex(strings.Join([]string{
+			ha1, params["nonce"], params["nc"], params["cnonce"], params["qop"], ha2,
+		}, ":"))
+	case "":
+		expected = md5Hex(ha1 + ":" + params["nonce"] + ":" + ha2)
+	default:
+		return "", false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(params["response"]))) != 1 {
+		return "", false
+	}
+	return username, true
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseAuthParams parses the comma separated auth-param list of a
+// credentials header, e.g. `username="a", nc=00000001`.
+// parseAuthParams 解析认证头中以逗号分隔的参数列表。
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " \t,")
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " \t")
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			value = b.String()
+			if i < len(rest) {
+				i++
+			}
+			s = rest[i:]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+	}
+	return params
+}
+
+func newAuthSecret() []byte {
+	secret := make([]byte, 32)
+	_, _ = rand.Read(secret)
+	return secret
+}
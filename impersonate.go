@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+)
+
+// tlsClientConn is the upstream TLS connection returned by upstreamTLSClient,
+// either a *tls.Conn or a uTLS connection replaying the client's ClientHello.
+// tlsClientConn 是 upstreamTLSClient 返回的上游 TLS 连接，可能是 *tls.Conn，
+// 也可能是重放客户端 ClientHello 的 uTLS 连接。
+type tlsClientConn interface {
+	net.Conn
+	HandshakeContext(context.Context) error
+	ConnectionState() tls.ConnectionState
+}
+
+// upstreamTLSClient wraps conn as the upstream TLS leg of ctx. When the
+// connection matches a filter registered with HelloFilter.Impersonate, the
+// handshake replays the client's ClientHello (cipher suites, extensions and
+// their order, curves, ALPN) through uTLS; otherwise crypto/tls is used.
+// upstreamTLSClient 将 conn 包装为 ctx 的上游 TLS 连接。连接匹配 HelloFilter.Impersonate 注册的条件时，
+// 通过 uTLS 重放客户端的 ClientHello（密码套件、扩展及其顺序、曲线、ALPN），否则使用 crypto/tls。
+func upstreamTLSClient(ctx *Context, conn net.Conn, cfg *tls.Config) (tlsClientConn, error) {
+	if !ctx.impersonate(ctx) {
+		return tls.Client(conn, cfg), nil
+	}
+
+	raw := ctx.ClientHello.Raw
+	record := append([]byte{0x16, 0x03, 0x01, byte(len(raw) >> 8), byte(len(raw))}, raw...)
+	spec, err := (&utls.Fingerprinter{AllowBluntMimicry: true}).FingerprintClientHello(record)
+	if err != nil {
+		return nil, err
+	}
+	//ALPN 只保留调用方能够处理的协议
+	restrictALPN(spec, upstreamProtos(ctx, cfg))
+
+	serverName := cfg.ServerName
+	if serverName == "" {
+		serverName = ctx.ClientHello.ServerName
+	}
+	uconn := utls.UClient(conn, &utls.Config{
+		Rand:                  cfg.Rand,
+		Time:                  cfg.Time,
+		RootCAs:               cfg.RootCAs,
+		ServerName:            serverName,
+		InsecureSkipVerify:    cfg.InsecureSkipVerify,
+		VerifyPeerCertificate: cfg.VerifyPeerCertificate,
+		KeyLogWriter:          cfg.KeyLogWriter,
+	}, utls.HelloCustom)
+	if err = uconn.ApplyPreset(spec); err != nil {
+		return nil, err
+	}
+	ctx.Debugf("上游握手重放客户端 ClientHello：%s", ctx.ClientHello.JA4())
+	return &impersonatedConn{UConn: uconn}, nil
+}
+
+// upstreamProtos returns the ALPN protocols the upstream may select: those of
+// cfg when set, otherwise the one negotiated with the client. Without either,
+// every protocol but h2 is allowed, as the stream is relayed as HTTP/1.1 or
+// raw TCP.
+// upstreamProtos 返回上游可以选择的 ALPN 协议：cfg 设置了 NextProtos 时使用之，否则使用与客户端协商出的协议；
+// 两者都没有时允许除 h2 以外的所有协议，因为数据流将按 HTTP/1.1 或原始 TCP 转发。
+func upstreamProtos(ctx *Context, cfg *tls.Config) []string {
+	if len(cfg.NextProtos) > 0 {
+		return cfg.NextProtos
+	}
+	if tlsConn, ok := ctx.Conn.Conn.(*tls.Conn); ok {
+		if proto := tlsConn.ConnectionState().NegotiatedProtocol; proto != "" {
+			return []string{proto}
+		}
+	}
+	return slices.DeleteFunc(slices.Clone(ctx.ClientHello.ALPN), func(proto string) bool {
+		return proto == http2.NextProtoTLS
+	})
+}
+
+// restrictALPN keeps the protocols of the ALPN extension of spec that appear
+// in allowed, replacing them with allowed when none does, and drops the
+// extension when allowed is empty.
+// restrictALPN 仅保留 spec 中 ALPN 扩展里出现在 allowed 中的协议，一个都没有时替换为 allowed，
+// allowed 为空时移除该扩展。
+func restrictALPN(spec *utls.ClientHelloSpec, allowed []string) {
+	spec.Extensions = slices.DeleteFunc(spec.Extensions, func(ext utls.TLSExtension) bool {
+		alpn, ok := ext.(*utls.ALPNExtension)
+		if !ok {
+			return false
+		}
+		protos := slices.DeleteFunc(slices.Clone(alpn.AlpnProtocols), func(proto string) bool {
+			return !slices.Contains(allowed, proto)
+		})
+		if len(protos) == 0 {
+			protos = allowed
+		}
+		alpn.AlpnProtocols = protos
+		return len(protos) == 0
+	})
+}
+
+// impersonatedConn exposes the state of a uTLS connection as a
+// tls.ConnectionState.
+// impersonatedConn 以 tls.ConnectionState 的形式暴露 uTLS 连接的状态。
+type impersonatedConn struct {
+	*utls.UConn
+}
+
+// ConnectionState returns the fields of the uTLS state that crypto/tls
+// callers rely on.
+// ConnectionState 返回 crypto/tls 调用方所依赖的 uTLS 连接状态字段。
+func (c *impersonatedConn) ConnectionState() tls.ConnectionState {
+	state := c.UConn.ConnectionState()
+	return tls.ConnectionState{
+		Version:            state.Version,
+		HandshakeComplete:  state.HandshakeComplete,
+		DidResume:          state.DidResume,
+		CipherSuite:        state.CipherSuite,
+		NegotiatedProtocol: state.NegotiatedProtocol,
+		ServerName:         state.ServerName,
+		PeerCertificates:   state.PeerCertificates,
+		VerifiedChains:     state.VerifiedChains,
+	}
+}
+
+// newImpersonatedTransport returns the upstream transport of an HTTP/2 client
+// connection whose upstream handshake replays the client's ClientHello. As
+// http.Transport only hands *tls.Conn to HTTP/2, h2 is spoken through
+// http2.Transport first, falling back to HTTP/1.1 when the upstream does not
+// select it.
+// newImpersonatedTransport 返回上游握手重放客户端 ClientHello 的 HTTP/2 客户端连接所使用的上游 Transport。
+// 由于 http.Transport 只会将 *tls.Conn 交给 HTTP/2，因此先通过 http2.Transport 使用 h2，
+// 上游未选择 h2 时回退到 HTTP/1.1。
+func newImpersonatedTransport(ctx *Context) *h2cTransport {
+	dial := upstreamDialer(ctx)
+	dialTLS := func(c context.Context, network, addr string, h2 bool) (net.Conn, error) {
+		conn, err := dial(c, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		//探测上游证书时已完成握手的连接直接使用，其 ALPN 协议仍需与预期一致
+		tlsConn, ok := conn.(tlsClientConn)
+		if !ok {
+			cfg := clientTLSConfig(ctx).Clone()
+			if cfg.ServerName == "" {
+				cfg.ServerName, _, _ = net.SplitHostPort(addr)
+			}
+			cfg.NextProtos = http2Protos
+
+			tlsConn, err = upstreamTLSClient(ctx, conn, cfg)
+			if err == nil {
+				err = tlsConn.HandshakeContext(c)
+			}
+		}
+		if err == nil && (tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS) != h2 {
+			err = fmt.Errorf("unexpected ALPN protocol %q", tlsConn.ConnectionState().NegotiatedProtocol) // 上游协商出非预期的 ALPN 协议
+		}
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+
+	return &h2cTransport{
+		h2: &http2.Transport{
+			DialTLSContext: func(c context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dialTLS(c, network, addr, true)
+			},
+		},
+		h1: &http.Transport{
+			DialContext: dial,
+			DialTLSContext: func(c context.Context, network, addr string) (net.Conn, error) {
+				return dialTLS(c, network, addr, false)
+			},
+		},
+	}
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+// helloListener records the ClientHello of every accepted connection.
+type helloListener struct {
+	net.Listener
+	hellos chan *ClientHello
+}
+
+func (l *helloListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := NewConn(conn)
+	hello, _ := peekClientHello(c)
+	l.hellos <- hello
+	return c, nil
+}
+
+func TestImpersonate(t *testing.T) {
+	tests := []struct {
+		name  string
+		hosts []string
+		http2 bool
+		want  bool
+	}{
+		{"crypto/tls", nil, false, false},
+		{"replay http/1.1", []string{"a.test"}, false, true},
+		{"replay h2", []string{"a.test"}, true, true},
+		{"other host", []string{"b.test"}, false, false},
+		{"mixed case host", []string{"A.Test"}, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(r.Proto))
+			}))
+			upstream.EnableHTTP2 = true
+			hellos := make(chan *ClientHello, 4)
+			upstream.Listener = &helloListener{Listener: upstream.Listener, hellos: hellos}
+			upstream.StartTLS()
+			defer upstream.Close()
+
+			cfg := NewConfig(FromCA(Certificate, PrivateKey))
+			if tt.http2 {
+				cfg.Http2Handler = Http2MitmHandler
+			}
+			cfg.ClientTLSConfig = &tls.Config{InsecureSkipVerify: true}
+			cfg.Dialer = dialerFn(func(network, addr string) (net.Conn, error) {
+				return net.Dial(network, upstream.Listener.Addr().String())
+			})
+			if tt.hosts != nil {
+				cfg.WithHelloMatcher(HelloHostIs(tt.hosts...)).Impersonate()
+			}
+
+			client, server := net.Pipe()
+			ctx := NewContext(ctxLogger, "test", cfg)
+			ctx.Conn = NewConn(server)
+			ctx.DstHost, ctx.DstPort = "a.test", "443"
+			go func() { _ = ctx.Dispatcher.Dispatch(ctx) }()
+
+			clientCfg := &tls.Config{
+				ServerName:         "a.test",
+				InsecureSkipVerify: true,
+				MaxVersion:         tls.VersionTLS12,
+				CipherSuites: []uint16{
+					tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+					tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+					tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+				},
+				CurvePreferences: []tls.CurveID{tls.CurveP256, tls.X25519},
+				NextProtos:       []string{"http/1.1"},
+			}
+			var transport http.RoundTripper = &http.Transport{
+				DialTLSContext: func(context.Context, string, string) (net.Conn, error) {
+					return tls.Client(client, clientCfg), nil
+				},
+			}
+			if tt.http2 {
+				clientCfg.NextProtos = http2Protos
+				transport = &http2.Transport{
+					DialTLSContext: func(context.Context, string, string, *tls.Config) (net.Conn, error) {
+						return tls.Client(client, clientCfg), nil
+					},
+				}
+			}
+			defer client.Close()
+
+			req, _ := http.NewRequest(http.MethodGet, "https://a.test/", nil)
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if want := map[bool]string{false: "HTTP/1.1", true: "HTTP/2.0"}[tt.http2]; string(body) != want {
+				t.Errorf("upstream protocol = %q, want %q", body, want)
+			}
+
+			upstreamHello := <-hellos
+			if upstreamHello == nil || ctx.ClientHello == nil {
+				t.Fatal("ClientHello not captured")
+			}
+			if got := upstreamHello.JA3() == ctx.ClientHello.JA3(); got != tt.want {
+				t.Errorf("upstream JA3 %s, client JA3 %s", upstreamHello.JA3String(), ctx.ClientHello.JA3String())
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"net/netip"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// InterceptPolicy decides which TLS streams are intercepted. Streams it
+// rejects are handed to the TcpHandler untouched, ClientHello included, as
+// if no certificate could be forged for them.
+// InterceptPolicy 决定哪些 TLS 流会被拦截。被拒绝的流（包括 ClientHello）原样交由 TcpHandler 处理，
+// 与无法为其伪造证书时相同。
+type InterceptPolicy struct {
+	Intercept []InterceptRule // 非空时仅拦截匹配任一规则的 TLS 流
+	Bypass    []InterceptRule // 匹配任一规则的 TLS 流直接透传，优先于 Intercept
+}
+
+// intercept reports whether the TLS stream of ctx to serverName is
+// intercepted. Everything is intercepted when p is nil.
+// intercept 判断 ctx 中发往 serverName 的 TLS 流是否被拦截，p 为 nil 时全部拦截。
+func (p *InterceptPolicy) intercept(serverName string, ctx *Context) bool {
+	if p == nil {
+		return true
+	}
+	for _, rule := range p.Bypass {
+		if rule.MatchTLS(serverName, ctx) {
+			return false
+		}
+	}
+	if len(p.Intercept) == 0 {
+		return true
+	}
+	for _, rule := range p.Intercept {
+		if rule.MatchTLS(serverName, ctx) {
+			return true
+		}
+	}
+	return false
+}
+
+// InterceptRule matches a TLS stream by its server name and destination.
+// InterceptRule 根据服务名称与目标地址匹配 TLS 流。
+type InterceptRule interface {
+	MatchTLS(serverName string, ctx *Context) bool
+}
+
+type InterceptRuleFn func(string, *Context) bool
+
+func (f InterceptRuleFn) MatchTLS(serverName string, ctx *Context) bool {
+	return f(serverName, ctx)
+}
+
+// SNIGlob matches server names against shell patterns, case-insensitively,
+// e.g. "*.internal.test". A '*' also spans dots, so "*.internal.test" matches
+// "a.b.internal.test" but not "internal.test". Malformed patterns never match.
+// SNIGlob 使用 shell 通配模式（忽略大小写）匹配服务名称，例如 "*.internal.test"。
+// '*' 可跨越点号，因此 "*.internal.test" 可匹配 "a.b.internal.test"，但不匹配 "internal.test"。
+// 格式错误的模式不会匹配任何名称。
+func SNIGlob(patterns ...string) InterceptRuleFn {
+	lower := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		lower[i] = strings.ToLower(pattern)
+	}
+
+	return func(serverName string, ctx *Context) bool {
+		serverName = strings.ToLower(serverName)
+		for _, pattern := range lower {
+			if ok, _ := path.Match(pattern, serverName); ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// SNIRegexp matches server names against regular expressions.
+// SNIRegexp 使用正则表达式匹配服务名称。
+func SNIRegexp(exprs ...*regexp.Regexp) InterceptRuleFn {
+	return func(serverName string, ctx *Context) bool {
+		for _, expr := range exprs {
+			if expr.MatchString(serverName) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// DstCIDR matches streams whose destination address is in one of the given
+// prefixes. Destinations known only by domain name never match.
+// DstCIDR 匹配目标地址位于指定网段之一的数据流，仅知道域名的目标地址不会匹配。
+func DstCIDR(prefixes ...netip.Prefix) InterceptRuleFn {
+	return func(serverName string, ctx *Context) bool {
+		addr, err := netip.ParseAddr(ctx.DstHost)
+		if err != nil {
+			return false
+		}
+		addr = addr.Unmap()
+		for _, prefix := range prefixes {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// DstPortIs matches streams to one of the given destination ports.
+// DstPortIs 匹配发往指定目标端口之一的数据流。
+func DstPortIs(ports ...string) InterceptRuleFn {
+	match := make(map[string]struct{})
+	for _, port := range ports {
+		match[port] = struct{}{}
+	}
+
+	return func(serverName string, ctx *Context) bool {
+		_, ok := match[ctx.DstPort]
+		return ok
+	}
+}
+
+// AllRules matches streams matched by every one of rules.
+// AllRules 匹配同时满足所有规则的数据流。
+func AllRules(rules ...InterceptRule) InterceptRuleFn {
+	return func(serverName string, ctx *Context) bool {
+		for _, rule := range rules {
+			if !rule.MatchTLS(serverName, ctx) {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"net/netip"
+	"regexp"
+	"testing"
+)
+
+func TestInterceptPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *InterceptPolicy
+		host   string
+		port   string
+		want   bool
+	}{
+		{"no policy", nil, "a.bank.test", "443", true},
+		{"bypass glob", &InterceptPolicy{Bypass: []InterceptRule{SNIGlob("*.BANK.test")}}, "a.bank.test", "443", false},
+		{"bypass glob miss", &InterceptPolicy{Bypass: []InterceptRule{SNIGlob("*.bank.test")}}, "bank.test", "443", true},
+		{"intercept only", &InterceptPolicy{Intercept: []InterceptRule{SNIGlob("*.internal.test")}}, "a.bank.test", "443", false},
+		{"intercept regexp", &InterceptPolicy{Intercept: []InterceptRule{SNIRegexp(regexp.MustCompile(`^a\.bank\.`))}}, "a.bank.test", "443", true},
+		{"bypass cidr", &InterceptPolicy{Bypass: []InterceptRule{DstCIDR(netip.MustParsePrefix("192.0.2.0/24"))}}, "192.0.2.1", "443", false},
+		{"bypass cidr miss", &InterceptPolicy{Bypass: []InterceptRule{DstCIDR(netip.MustParsePrefix("198.51.100.0/24"))}}, "192.0.2.1", "443", true},
+		{"bypass port", &InterceptPolicy{Bypass: []InterceptRule{DstPortIs("8443")}}, "a.bank.test", "8443", false},
+		{"bypass wins", &InterceptPolicy{
+			Intercept: []InterceptRule{SNIGlob("*.test")},
+			Bypass:    []InterceptRule{AllRules(SNIGlob("*.bank.test"), DstPortIs("443"))},
+		}, "a.bank.test", "443", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			go func() {
+				tlsClient := tls.Client(client, &tls.Config{ServerName: "a.bank.test", InsecureSkipVerify: true})
+				if tlsClient.Handshake() == nil {
+					_, _ = tlsClient.Write([]byte("GET / HTTP/1.1\r\nHost: a.bank.test\r\n\r\n"))
+				}
+				_ = tlsClient.Close()
+			}()
+
+			var intercepted bool
+			var passed []byte
+			cfg := NewConfig(FromCA(Certificate, PrivateKey))
+			cfg.Resolver = NewResolver()
+			cfg.InterceptPolicy = tt.policy
+			cfg.HttpHandler = HandleHttpFn(func(ctx *Context) error { intercepted = true; return nil })
+			cfg.TcpHandler = HandleTcpFn(func(ctx *Context) error {
+				if ctx.ClientHello != nil {
+					passed, _ = ctx.Conn.Peek(5 + len(ctx.ClientHello.Raw))
+				}
+				return nil
+			})
+			ctx := NewContext(ctxLogger, "test", cfg)
+			ctx.Conn = NewConn(server)
+			ctx.DstHost, ctx.DstPort = tt.host, tt.port
+			_ = ctx.Dispatcher.Dispatch(ctx)
+			_ = server.Close()
+
+			if intercepted != tt.want {
+				t.Errorf("intercepted = %v, want %v", intercepted, tt.want)
+			}
+			if !tt.want && (len(passed) < 5 || passed[0] != 0x16 || !bytes.Equal(passed[5:], ctx.ClientHello.Raw)) {
+				t.Errorf("ClientHello not passed through untouched: % x", passed)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"os"
+	"sync"
+)
+
+// KeyLog is a sink for TLS secrets in the NSS key log format (SSLKEYLOGFILE),
+// which Wireshark uses to decrypt captures. Every line is preceded by a
+// comment naming the session Id and the leg ("client" or "upstream") it
+// belongs to.
+// KeyLog 是 NSS 密钥日志格式（SSLKEYLOGFILE）的 TLS 密钥输出，Wireshark 可据此解密抓包数据。
+// 每行密钥之前都有一行注释，标明其所属的会话 Id 与连接方向（client 或 upstream）。
+type KeyLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewKeyLog creates a KeyLog writing to w.
+// NewKeyLog 创建写入 w 的 KeyLog。
+func NewKeyLog(w io.Writer) *KeyLog {
+	return &KeyLog{w: w}
+}
+
+// OpenKeyLog creates a KeyLog appending to the file at path.
+// OpenKeyLog 创建追加写入 path 文件的 KeyLog。
+func OpenKeyLog(path string) (*KeyLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyLog(file), nil
+}
+
+// Close closes the underlying writer when it is an io.Closer.
+// Close 在底层 writer 实现 io.Closer 时将其关闭。
+func (k *KeyLog) Close() error {
+	if closer, ok := k.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// keyLogWriter tags the lines written by one TLS connection.
+// keyLogWriter 为单个 TLS 连接写入的密钥行添加标记。
+type keyLogWriter struct {
+	log *KeyLog
+	tag []byte
+}
+
+func (w *keyLogWriter) Write(p []byte) (int, error) {
+	w.log.mu.Lock()
+	defer w.log.mu.Unlock()
+	if _, err := w.log.w.Write(append(w.tag[:len(w.tag):len(w.tag)], p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// apply returns cfg with key logging for the given session and leg. cfg is
+// cloned, as it may be shared between connections, and returned unchanged
+// when k is nil.
+// apply 返回为指定会话与连接方向记录密钥的 cfg。由于 cfg 可能被多个连接共享，会先复制一份；
+// k 为 nil 时原样返回。
+func (k *KeyLog) apply(cfg *tls.Config, id, leg string) *tls.Config {
+	if k == nil {
+		return cfg
+	}
+	cfg = cfg.Clone()
+	cfg.KeyLogWriter = &keyLogWriter{log: k, tag: []byte("# " + id + " " + leg + "\n")}
+	return cfg
+}
+
+// clientTLSConfig returns ClientTLSConfig for the upstream leg of ctx.
+// clientTLSConfig 返回 ctx 上游连接使用的 ClientTLSConfig。
+func clientTLSConfig(ctx *Context) *tls.Config {
+	return ctx.KeyLog.apply(ctx.ClientTLSConfig, ctx.Id, "upstream")
+}
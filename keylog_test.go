@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestKeyLog(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	var buf bytes.Buffer
+	cfg := NewConfig(FromCA(Certificate, PrivateKey))
+	cfg.KeyLog = NewKeyLog(&buf)
+	cfg.ClientTLSConfig = &tls.Config{InsecureSkipVerify: true}
+	cfg.Dialer = dialerFn(func(network, addr string) (net.Conn, error) {
+		return net.Dial(network, upstream.Listener.Addr().String())
+	})
+
+	client, server := net.Pipe()
+	ctx := NewContext(ctxLogger, "session-1", cfg)
+	ctx.Conn = NewConn(server)
+	ctx.DstHost, ctx.DstPort = "a.test", "443"
+	go func() { _ = ctx.Dispatcher.Dispatch(ctx) }()
+
+	tlsClient := tls.Client(client, &tls.Config{ServerName: "a.test", InsecureSkipVerify: true})
+	defer tlsClient.Close()
+	req, _ := http.NewRequest(http.MethodGet, "https://a.test/", nil)
+	if err := req.Write(tlsClient); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(tlsClient), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	for _, leg := range []string{"client", "upstream"} {
+		pattern := regexp.MustCompile(`(?m)^# session-1 ` + leg + "\n" + `[A-Z_]+ [0-9a-f]{64} [0-9a-f]+$`)
+		if !pattern.Match(buf.Bytes()) {
+			t.Errorf("no %s key log line in:\n%s", leg, buf.String())
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// LeafKey selects the key type of generated leaf certificates.
+// LeafKey 指定生成的服务端证书所使用的密钥类型。
+type LeafKey int
+
+const (
+	LeafKeyECDSAP256 LeafKey = iota // ECDSA P-256（默认）
+	LeafKeyECDSAP384                // ECDSA P-384
+	LeafKeyEd25519                  // Ed25519
+	LeafKeyRSA2048                  // RSA 2048 位
+	LeafKeyRSA3072                  // RSA 3072 位
+	LeafKeyRSA4096                  // RSA 4096 位
+)
+
+func (k LeafKey) generate() (crypto.Signer, error) {
+	switch k {
+	case LeafKeyECDSAP384:
+		return generateLeafKey(x509.ECDSA, 0, elliptic.P384())
+	case LeafKeyEd25519:
+		return generateLeafKey(x509.Ed25519, 0, nil)
+	case LeafKeyRSA2048:
+		return generateLeafKey(x509.RSA, 2048, nil)
+	case LeafKeyRSA3072:
+		return generateLeafKey(x509.RSA, 3072, nil)
+	case LeafKeyRSA4096:
+		return generateLeafKey(x509.RSA, 4096, nil)
+	default:
+		return generateLeafKey(x509.ECDSA, 0, elliptic.P256())
+	}
+}
+
+// SerialFn returns the serial number of the next leaf certificate.
+// SerialFn 返回下一张服务端证书的序列号。
+type SerialFn func() (*big.Int, error)
+
+// RandomSerial returns a random 128-bit serial number.
+// RandomSerial 返回 128 位随机序列号。
+func RandomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// SequentialSerial returns a SerialFn counting up from start.
+// SequentialSerial 返回从 start 开始递增的 SerialFn。
+func SequentialSerial(start int64) SerialFn {
+	var mu sync.Mutex
+	next := big.NewInt(start)
+	return func() (*big.Int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		serial := new(big.Int).Set(next)
+		next.Add(next, big.NewInt(1))
+		return serial, nil
+	}
+}
+
+// LeafOption configures a LeafSigner.
+// LeafOption 用于配置 LeafSigner。
+type LeafOption func(*LeafSigner)
+
+// WithLeafKey sets the key type of generated certificates.
+// WithLeafKey 设置生成证书的密钥类型。
+func WithLeafKey(key LeafKey) LeafOption {
+	return func(s *LeafSigner) { s.key = key }
+}
+
+// WithLeafValidity sets how long generated certificates are valid for. The
+// validity window never extends beyond the CA's.
+// WithLeafValidity 设置生成证书的有效期，有效期不会超出 CA 证书的有效期。
+func WithLeafValidity(validity time.Duration) LeafOption {
+	return func(s *LeafSigner) { s.validity = validity }
+}
+
+// WithLeafSerial sets the serial number strategy, RandomSerial by default.
+// WithLeafSerial 设置序列号生成策略，默认为 RandomSerial。
+func WithLeafSerial(serial SerialFn) LeafOption {
+	return func(s *LeafSigner) { s.serial = serial }
+}
+
+// WithLeafSANs adds DNS names or IP addresses to every generated certificate.
+// WithLeafSANs 为每张生成的证书添加额外的域名或 IP 地址。
+func WithLeafSANs(sans ...string) LeafOption {
+	return func(s *LeafSigner) { s.sans = append(s.sans, sans...) }
+}
+
+// WithLeafWildcard issues "*.example.com" for subdomains such as
+// "a.example.com", so one certificate covers all siblings. Wildcards never
+// reach the registrable domain or above: "example.co.uk" is issued as is
+// rather than as "*.co.uk".
+// WithLeafWildcard 为 "a.example.com" 等子域名签发 "*.example.com" 证书，使一张证书覆盖所有同级域名。
+// 通配符不会覆盖可注册域名本身及其上级：例如 "example.co.uk" 按原样签发，而不是 "*.co.uk"。
+func WithLeafWildcard(wildcard bool) LeafOption {
+	return func(s *LeafSigner) { s.wildcard = wildcard }
+}
+
+// LeafSigner is a TLSConfig issuing leaf certificates signed by a CA under a
+// configurable policy. A SAN that is an IP address, e.g. when no SNI is known,
+// is issued as an IP SAN.
+// LeafSigner 是按可配置策略签发由 CA 签名的服务端证书的 TLSConfig，
+// 当 SAN 为 IP 地址时（例如无法获取 SNI），以 IP SAN 的形式签发。
+type LeafSigner struct {
+	cert       *x509.Certificate
+	privateKey crypto.PrivateKey
+	key        LeafKey
+	validity   time.Duration
+	serial     SerialFn
+	sans       []string
+	wildcard   bool
+}
+
+// NewLeafSigner creates a LeafSigner for the given CA. By default it issues
+// ECDSA P-256 certificates valid for a year with random serial numbers.
+// NewLeafSigner 创建使用指定 CA 的 LeafSigner，默认签发有效期一年、随机序列号的 ECDSA P-256 证书。
+func NewLeafSigner(cert *x509.Certificate, privateKey crypto.PrivateKey, opts ...LeafOption) *LeafSigner {
+	s := &LeafSigner{
+		cert:       cert,
+		privateKey: privateKey,
+		key:        LeafKeyECDSAP256,
+		validity:   365 * 24 * time.Hour,
+		serial:     RandomSerial,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// CacheKey returns the name a certificate for san is issued for, letting
+// CertCache share one wildcard certificate between sibling subdomains. Only
+// names below their eTLD+1 (per the public suffix list) are widened.
+// CacheKey 返回为 san 签发证书时使用的名称，使 CertCache 可以在同级子域名之间共享同一张通配符证书。
+// 仅对低于其 eTLD+1（依据公共后缀列表）的域名使用通配符。
+func (s *LeafSigner) CacheKey(san string) string {
+	if !s.wildcard || net.ParseIP(san) != nil || strings.HasPrefix(san, "*.") {
+		return san
+	}
+	//san 本身就是可注册域名（或公共后缀）时，其父域名的通配符会覆盖他人的域名
+	registrable, err := publicsuffix.EffectiveTLDPlusOne(san)
+	if err != nil || strings.EqualFold(registrable, san) {
+		return san
+	}
+	_, parent, _ := strings.Cut(san, ".")
+	return "*." + parent
+}
+
+// From issues a certificate for san.
+// From 为 san 签发证书。
+func (s *LeafSigner) From(san string) (*tls.Config, error) {
+	serialNumber, err := s.serial()
+	if err != nil {
+		return nil, err
+	}
+
+	name := s.CacheKey(san)
+	notBefore := time.Now().Add(-time.Hour) //容忍客户端时钟偏差
+	if notBefore.Before(s.cert.NotBefore) {
+		notBefore = s.cert.NotBefore
+	}
+	notAfter := time.Now().Add(s.validity)
+	if notAfter.After(s.cert.NotAfter) {
+		notAfter = s.cert.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	addSAN(template, name)
+	if name != san {
+		//通配符不匹配父域名本身，因此同时签发父域名
+		addSAN(template, strings.TrimPrefix(name, "*."))
+	}
+	for _, extra := range s.sans {
+		addSAN(template, extra)
+	}
+
+	privateKey, err := s.key.generate()
+	if err != nil {
+		return nil, err
+	}
+	if s.key >= LeafKeyRSA2048 {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, s.cert, privateKey.Public(), s.privateKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{
+			{
+				Certificate: [][]byte{certDER, s.cert.Raw},
+				PrivateKey:  privateKey,
+				Leaf:        leaf,
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLeafSigner(t *testing.T) {
+	roots := x509.NewCertPool()
+	roots.AddCert(Certificate)
+
+	tests := []struct {
+		name   string
+		opts   []LeafOption
+		san    string
+		verify []string // 证书必须覆盖的名称
+		check  func(*testing.T, *x509.Certificate)
+	}{
+		{name: "default ecdsa p256", san: "a.test", verify: []string{"a.test"},
+			check: func(t *testing.T, leaf *x509.Certificate) {
+				if pub, ok := leaf.PublicKey.(*ecdsa.PublicKey); !ok || pub.Curve != elliptic.P256() {
+					t.Errorf("public key = %T, want ECDSA P-256", leaf.PublicKey)
+				}
+			}},
+		{name: "ecdsa p384", opts: []LeafOption{WithLeafKey(LeafKeyECDSAP384)}, san: "a.test", verify: []string{"a.test"},
+			check: func(t *testing.T, leaf *x509.Certificate) {
+				if pub, ok := leaf.PublicKey.(*ecdsa.PublicKey); !ok || pub.Curve != elliptic.P384() {
+					t.Errorf("public key = %T, want ECDSA P-384", leaf.PublicKey)
+				}
+			}},
+		{name: "ed25519", opts: []LeafOption{WithLeafKey(LeafKeyEd25519)}, san: "a.test", verify: []string{"a.test"},
+			check: func(t *testing.T, leaf *x509.Certificate) {
+				if leaf.PublicKeyAlgorithm != x509.Ed25519 {
+					t.Errorf("key algorithm = %v, want Ed25519", leaf.PublicKeyAlgorithm)
+				}
+			}},
+		{name: "rsa 3072", opts: []LeafOption{WithLeafKey(LeafKeyRSA3072)}, san: "a.test", verify: []string{"a.test"},
+			check: func(t *testing.T, leaf *x509.Certificate) {
+				if pub, ok := leaf.PublicKey.(*rsa.PublicKey); !ok || pub.N.BitLen() != 3072 {
+					t.Errorf("public key = %T, want RSA 3072", leaf.PublicKey)
+				}
+				if leaf.KeyUsage&x509.KeyUsageKeyEncipherment == 0 {
+					t.Error("RSA leaf lacks key encipherment usage")
+				}
+			}},
+		{name: "validity", opts: []LeafOption{WithLeafValidity(24 * time.Hour)}, san: "a.test", verify: []string{"a.test"},
+			check: func(t *testing.T, leaf *x509.Certificate) {
+				if d := time.Until(leaf.NotAfter); d > 24*time.Hour || d < 23*time.Hour {
+					t.Errorf("NotAfter in %v, want about 24h", d)
+				}
+			}},
+		{name: "sequential serial", opts: []LeafOption{WithLeafSerial(SequentialSerial(1000))}, san: "a.test", verify: []string{"a.test"},
+			check: func(t *testing.T, leaf *x509.Certificate) {
+				if leaf.SerialNumber.Int64() != 1000 {
+					t.Errorf("serial = %v, want 1000", leaf.SerialNumber)
+				}
+			}},
+		{name: "extra sans", opts: []LeafOption{WithLeafSANs("extra.test", "10.0.0.1")}, san: "a.test",
+			verify: []string{"a.test", "extra.test", "10.0.0.1"}},
+		{name: "wildcard", opts: []LeafOption{WithLeafWildcard(true)}, san: "a.example.test",
+			verify: []string{"a.example.test", "b.example.test", "example.test"}},
+		{name: "wildcard two labels", opts: []LeafOption{WithLeafWildcard(true)}, san: "example.test",
+			verify: []string{"example.test"}},
+		{name: "wildcard public suffix", opts: []LeafOption{WithLeafWildcard(true)}, san: "example.co.uk",
+			verify: []string{"example.co.uk"},
+			check: func(t *testing.T, leaf *x509.Certificate) {
+				if len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != "example.co.uk" {
+					t.Errorf("DNSNames = %v, want only example.co.uk", leaf.DNSNames)
+				}
+			}},
+		{name: "wildcard below public suffix", opts: []LeafOption{WithLeafWildcard(true)}, san: "www.example.co.uk",
+			verify: []string{"www.example.co.uk", "mail.example.co.uk", "example.co.uk"}},
+		{name: "ip san", san: "192.0.2.7", verify: []string{"192.0.2.7"},
+			check: func(t *testing.T, leaf *x509.Certificate) {
+				if len(leaf.DNSNames) != 0 || len(leaf.IPAddresses) != 1 || !leaf.IPAddresses[0].Equal(net.ParseIP("192.0.2.7")) {
+					t.Errorf("SANs = %v %v, want only IP 192.0.2.7", leaf.DNSNames, leaf.IPAddresses)
+				}
+			}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsCfg, err := NewLeafSigner(Certificate, PrivateKey, tt.opts...).From(tt.san)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf := tlsCfg.Certificates[0].Leaf
+			for _, name := range tt.verify {
+				if _, err = leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots}); err != nil {
+					t.Errorf("verify %s: %v", name, err)
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, leaf)
+			}
+		})
+	}
+
+	t.Run("cache shares wildcard", func(t *testing.T) {
+		var calls atomic.Int32
+		signer := NewLeafSigner(Certificate, PrivateKey, WithLeafWildcard(true))
+		cache := NewCertCache(&countingSigner{LeafSigner: signer, calls: &calls})
+		for _, san := range []string{"a.example.test", "b.example.test"} {
+			if _, err := cache.From(san); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if calls.Load() != 1 {
+			t.Errorf("calls = %d, want 1", calls.Load())
+		}
+	})
+}
+
+type countingSigner struct {
+	*LeafSigner
+	calls *atomic.Int32
+}
+
+func (s *countingSigner) From(san string) (*tls.Config, error) {
+	s.calls.Add(1)
+	return s.LeafSigner.From(san)
+}
@@ -3,8 +3,14 @@ package proxy
 import (
 	"errors"
 	"net"
+	"time"
 )
 
+// proxyHeaderTimeout bounds the wait for the PROXY protocol header of an
+// accepted connection, so that silent clients do not pin a goroutine.
+// proxyHeaderTimeout 限制等待入站连接 PROXY protocol 头部的时间，避免静默的客户端长期占用协程。
+var proxyHeaderTimeout = 5 * time.Second
+
 // Listener wraps a net.Listener and associates it with a proxy Config.
 // Use Listen or NewListener to create one, then call Serve to start
 // the proxy loop, or Shutdown to stop gracefully.
@@ -47,6 +53,15 @@ func (ln *Listener) Serve() error {
 		ctx.Conn = NewConn(inner)
 		go func() {
 			defer ctx.Conn.Close()
+			if ctx.AcceptProxyProtocol {
+				_ = ctx.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+				ctx.ProxyHeader, err = ReadProxyHeader(ctx.Conn)
+				if err != nil {
+					ctx.Error(err)
+					return
+				}
+				_ = ctx.Conn.SetReadDeadline(time.Time{})
+			}
 			if ctx.Negotiator != nil {
 				err = ctx.Negotiator.Handshake(ctx)
 				if err != nil {
@@ -54,6 +69,24 @@ func (ln *Listener) Serve() error {
 					return
 				}
 			}
+			// A UDP association carries no stream data on the control
+			// connection, its datagrams are relayed by the UdpHandler.
+			if ctx.UdpConn != nil {
+				defer ctx.UdpConn.Close()
+				if ctx.UdpHandler != nil {
+					_ = ctx.UdpHandler.HandleUdp(ctx)
+				}
+				return
+			}
+			defer func() {
+				if ctx.DstConn != nil {
+					_ = ctx.DstConn.Close()
+				}
+			}()
+			if ctx.Passthrough {
+				_ = ctx.TcpHandler.HandleTcp(ctx)
+				return
+			}
 			_ = ctx.Dispatcher.Dispatch(ctx)
 		}()
 	}
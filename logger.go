@@ -33,9 +33,11 @@ type Logrus struct {
 }
 
 func (l *Logrus) Log(ctx *Context, level Level, args ...any) {
-	l.WithFields(logrus.Fields{
-		"id": ctx.Id,
-	}).Log(logrus.Level(level), args...)
+	fields := logrus.Fields{"id": ctx.Id}
+	if ctx.User != "" {
+		fields["user"] = ctx.User
+	}
+	l.WithFields(fields).Log(logrus.Level(level), args...)
 }
 
 func (l *Logrus) Logf(ctx *Context, level Level, format string, args ...any) {
@@ -119,6 +121,10 @@ func formatter(skip int, name string) formatFn {
 			base += fmt.Sprintf(" [%s]", id)
 		}
 
+		if user, ok := entry.Data["user"]; ok {
+			base += fmt.Sprintf(" [%s]", user)
+		}
+
 		return []byte(fmt.Sprintf("%s %s\n",
 			base,
 			entry.Message,
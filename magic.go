@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrNoMagicCA is reported when Config.MagicHost is set without
+// Config.MagicCA. The magic host then answers 500 rather than guessing which
+// CA the proxy signs with.
+// ErrNoMagicCA 表示设置了 Config.MagicHost 却未设置 Config.MagicCA，
+// 此时魔法域名返回 500，而不是猜测代理使用哪个 CA 签发证书。
+var ErrNoMagicCA = errors.New("MagicHost is set without MagicCA")
+
+// magicFile is a download offered by the magic host.
+// magicFile 表示魔法域名提供的一个下载文件。
+type magicFile struct {
+	path        string
+	contentType string
+	encode      func(*CA) ([]byte, error)
+}
+
+var magicFiles = []magicFile{
+	{"/ca.pem", "application/x-pem-file", func(ca *CA) ([]byte, error) { return ca.CertPEM(), nil }},
+	{"/ca.crt", "application/x-x509-ca-cert", func(ca *CA) ([]byte, error) { return ca.CertDER(), nil }},
+	{"/ca.p12", "application/x-pkcs12", (*CA).TrustStorePKCS12},
+	{"/ca.mobileconfig", "application/x-apple-aspen-config", func(ca *CA) ([]byte, error) {
+		return ca.MobileConfig(ca.Cert.Subject.CommonName)
+	}},
+}
+
+// isMagicHost reports whether req is addressed to Config.MagicHost.
+// isMagicHost 判断 req 的目标是否为 Config.MagicHost。
+func isMagicHost(req *http.Request, ctx *Context) bool {
+	if ctx.MagicHost == "" {
+		return false
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.EqualFold(host, ctx.MagicHost)
+}
+
+// serveMagicHost answers a request to the magic host with the CA download
+// page or one of the CA files. Nothing is dialed upstream.
+// serveMagicHost 使用 CA 下载页面或 CA 文件响应发往魔法域名的请求，不会连接上游。
+func serveMagicHost(req *http.Request, ctx *Context) *http.Response {
+	ca := ctx.MagicCA
+	if ca == nil {
+		ctx.Error(ErrNoMagicCA)
+		return magicResponse(req, http.StatusInternalServerError, "text/plain; charset=utf-8",
+			[]byte(ErrNoMagicCA.Error()+"\n"))
+	}
+	path := req.URL.Path
+	if path == "/" || path == "" {
+		var body bytes.Buffer
+		if err := magicPage.Execute(&body, ca.Cert.Subject.CommonName); err != nil {
+			ctx.Error(err)
+			return magicResponse(req, http.StatusInternalServerError, "text/plain; charset=utf-8", nil)
+		}
+		return magicResponse(req, http.StatusOK, "text/html; charset=utf-8", body.Bytes())
+	}
+
+	for _, file := range magicFiles {
+		if file.path != path {
+			continue
+		}
+		raw, err := file.encode(ca)
+		if err != nil {
+			ctx.Error(err)
+			return magicResponse(req, http.StatusInternalServerError, "text/plain; charset=utf-8", nil)
+		}
+		resp := magicResponse(req, http.StatusOK, file.contentType, raw)
+		resp.Header.Set("Content-Disposition", `attachment; filename="`+path[1:]+`"`)
+		return resp
+	}
+	return magicResponse(req, http.StatusNotFound, "text/plain; charset=utf-8", []byte("404 page not found\n"))
+}
+
+func magicResponse(req *http.Request, status int, contentType string, body []byte) *http.Response {
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         req.Proto,
+		ProtoMajor:    req.ProtoMajor,
+		ProtoMinor:    req.ProtoMinor,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         req.Close,
+		Request:       req,
+	}
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Set("Cache-Control", "no-store")
+	return resp
+}
+
+var magicPage = template.Must(template.New("magic").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.}} - CA Certificate</title>
+<style>
+body { font-family: sans-serif; max-width: 44em; margin: 2em auto; padding: 0 1em; line-height: 1.5; }
+code { background: #f2f2f2; padding: 0 .2em; }
+</style>
+</head>
+<body>
+<h1>{{.}}</h1>
+<p>Install this CA certificate to let the proxy inspect HTTPS traffic on this device.</p>
+<ul>
+<li><a href="/ca.pem">ca.pem</a> – PEM (Linux, Firefox, most tools)</li>
+<li><a href="/ca.crt">ca.crt</a> – DER (Windows, Android)</li>
+<li><a href="/ca.p12">ca.p12</a> – PKCS#12 trust store, no password and no private key</li>
+<li><a href="/ca.mobileconfig">ca.mobileconfig</a> – configuration profile (iOS, macOS)</li>
+</ul>
+<h2>Windows</h2>
+<p>Open <code>ca.crt</code>, choose <em>Install Certificate</em>, pick <em>Local Machine</em> and place it in <em>Trusted Root Certification Authorities</em>.</p>
+<h2>macOS</h2>
+<p>Open <code>ca.mobileconfig</code> and install it in <em>System Settings › Privacy &amp; Security › Profiles</em>, or run <code>sudo security add-trusted-cert -d -r trustRoot -k /Library/Keychains/System.keychain ca.pem</code>.</p>
+<h2>iOS / iPadOS</h2>
+<p>Open this page in Safari, download <code>ca.mobileconfig</code>, install it in <em>Settings › General › VPN &amp; Device Management</em>, then enable full trust in <em>Settings › General › About › Certificate Trust Settings</em>.</p>
+<h2>Android</h2>
+<p>Download <code>ca.crt</code> and install it in <em>Settings › Security › Encryption &amp; credentials › Install a certificate › CA certificate</em>. Apps targeting Android 7+ only trust user CAs when their network security config allows it.</p>
+<h2>Linux</h2>
+<p>Debian/Ubuntu: copy <code>ca.pem</code> to <code>/usr/local/share/ca-certificates/proxy.crt</code> and run <code>sudo update-ca-certificates</code>. Fedora/RHEL: copy it to <code>/etc/pki/ca-trust/source/anchors/</code> and run <code>sudo update-ca-trust</code>.</p>
+<h2>Firefox</h2>
+<p>Firefox keeps its own store: import <code>ca.pem</code> in <em>Settings › Privacy &amp; Security › Certificates › View Certificates › Authorities</em>.</p>
+</body>
+</html>
+`))
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestMagicHost(t *testing.T) {
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+		check       func([]byte) error
+	}{
+		{"/", http.StatusOK, "text/html; charset=utf-8", func(body []byte) error {
+			if !bytes.Contains(body, []byte(`href="/ca.crt"`)) || !bytes.Contains(body, []byte("Android")) {
+				return errors.New("page lacks download links or instructions")
+			}
+			return nil
+		}},
+		{"/ca.pem", http.StatusOK, "application/x-pem-file", func(body []byte) error {
+			_, err := x509.ParseCertificate(pemOrDER(body, "CERTIFICATE"))
+			return err
+		}},
+		{"/ca.crt", http.StatusOK, "application/x-x509-ca-cert", func(body []byte) error {
+			if !bytes.Equal(body, Certificate.Raw) {
+				return errors.New("DER differs from the active CA")
+			}
+			return nil
+		}},
+		{"/ca.p12", http.StatusOK, "application/x-pkcs12", func(body []byte) error {
+			certs, err := pkcs12.DecodeTrustStore(body, "")
+			if err == nil && (len(certs) != 1 || !certs[0].Equal(Certificate)) {
+				err = errors.New("trust store does not hold the active CA")
+			}
+			return err
+		}},
+		{"/ca.mobileconfig", http.StatusOK, "application/x-apple-aspen-config", nil},
+		{"/missing", http.StatusNotFound, "text/plain; charset=utf-8", nil},
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	cfg := NewConfig(nil)
+	cfg.MagicHost = "proxy.local"
+	cfg.MagicCA = &CA{Cert: Certificate, PrivateKey: PrivateKey}
+	cfg.Dialer = dialerFn(func(network, addr string) (net.Conn, error) {
+		t.Errorf("unexpected upstream dial to %s", addr)
+		return nil, errors.New("dial disabled")
+	})
+	ctx := NewContext(ctxLogger, "test", cfg)
+	ctx.Conn = NewConn(server)
+	done := make(chan error, 1)
+	go func() { done <- ctx.HttpHandler.HandleHttp(ctx) }()
+
+	reader := bufio.NewReader(client)
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://PROXY.local:80"+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = req.WriteProxy(client); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.ReadResponse(reader, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status || resp.Header.Get("Content-Type") != tt.contentType {
+				t.Fatalf("got %d %s, want %d %s", resp.StatusCode, resp.Header.Get("Content-Type"), tt.status, tt.contentType)
+			}
+			if tt.check != nil {
+				if err = tt.check(body); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+	t.Run("connection close", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, "http://proxy.local/", nil)
+		req.Close = true
+		if err := req.WriteProxy(client); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !resp.Close {
+			t.Error("response lacks Connection: close")
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		if err = <-done; err != nil {
+			t.Errorf("handler returned %v, want nil", err)
+		}
+	})
+}
+
+func TestMagicHostWithoutCA(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	cfg := NewConfig(nil)
+	cfg.MagicHost = "proxy.local"
+	ctx := NewContext(ctxLogger, "test", cfg)
+	ctx.Conn = NewConn(server)
+	go func() { _ = ctx.HttpHandler.HandleHttp(ctx) }()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://proxy.local/ca.pem", nil)
+	if err := req.WriteProxy(client); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(client), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500 instead of serving the built-in CA", resp.StatusCode)
+	}
+}
@@ -2,7 +2,9 @@ package proxy
 
 import (
 	"github.com/gobwas/ws"
+	"io"
 	"net/http"
+	"strings"
 )
 
 type ReqMatcher interface {
@@ -69,6 +71,32 @@ func ReqHostIs(hosts ...string) ReqMatchFn {
 	}
 }
 
+func ReqUserIs(users ...string) ReqMatchFn {
+	match := make(map[string]struct{})
+	for _, user := range users {
+		match[user] = struct{}{}
+	}
+
+	return func(req *http.Request, ctx *Context) bool {
+		_, ok := match[ctx.User]
+		return ok
+	}
+}
+
+// ClientFingerprintIs matches clients whose ClientHello has one of the given
+// JA3 or JA4 fingerprints.
+// ClientFingerprintIs 匹配 ClientHello 具有给定 JA3 或 JA4 指纹之一的客户端。
+func ClientFingerprintIs(fingerprints ...string) ReqMatchFn {
+	match := make(map[string]struct{})
+	for _, fingerprint := range fingerprints {
+		match[strings.ToLower(fingerprint)] = struct{}{}
+	}
+
+	return func(req *http.Request, ctx *Context) bool {
+		return matchClientFingerprint(match, ctx)
+	}
+}
+
 type RespMatcher interface {
 	MatchResp(*http.Response, *Context) bool
 }
@@ -103,6 +131,60 @@ func (c *Config) filterResp(resp *http.Response, ctx *Context) *http.Response {
 	return resp
 }
 
+// RespTrailerFn inspects a response once its body has been read to EOF.
+// RespTrailerFn 在响应体读取完毕后处理响应。
+type RespTrailerFn func(*http.Response, *Context)
+
+// HandleTrailer registers handle to run once the body of a matched response
+// has been relayed to EOF, when its trailers (e.g. grpc-status and
+// grpc-message) are known. Handlers registered with Handle run before the
+// body is read and only see the trailers of trailers-only responses. Changes
+// made to resp.Trailer in place are relayed to the client.
+// HandleTrailer 注册在匹配的响应体转发完毕后执行的 handle，此时 trailer（例如 grpc-status 与
+// grpc-message）已经可用。通过 Handle 注册的处理器在读取响应体之前执行，只能看到仅含 trailer 的响应的状态。
+// 对 resp.Trailer 的原地修改会转发给客户端。
+func (r *RespFilter) HandleTrailer(handle RespTrailerFn) {
+	r.cfg.trailerHandlers = append(r.cfg.trailerHandlers,
+		func(resp *http.Response, ctx *Context) {
+			for _, matcher := range r.matcher {
+				if !matcher.MatchResp(resp, ctx) {
+					return
+				}
+			}
+			handle(resp, ctx)
+		})
+}
+
+// watchTrailer arranges for the trailer handlers to run once the body of
+// resp reaches EOF.
+// watchTrailer 使 trailer 处理链在 resp 的响应体读取完毕时执行。
+func (c *Config) watchTrailer(resp *http.Response, ctx *Context) {
+	if len(c.trailerHandlers) == 0 || resp.Body == nil {
+		return
+	}
+	resp.Body = &eofHookBody{ReadCloser: resp.Body, hook: func() {
+		for _, handle := range c.trailerHandlers {
+			handle(resp, ctx)
+		}
+	}}
+}
+
+// eofHookBody calls hook once, when the body first returns io.EOF.
+// eofHookBody 在响应体首次返回 io.EOF 时调用一次 hook。
+type eofHookBody struct {
+	io.ReadCloser
+	hook func()
+}
+
+func (b *eofHookBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF && b.hook != nil {
+		b.hook()
+		b.hook = nil
+	}
+	return n, err
+}
+
 type RespMatchFn func(*http.Response, *Context) bool
 
 func (f RespMatchFn) MatchResp(resp *http.Response, ctx *Context) bool {
@@ -172,6 +254,31 @@ func WsHostIs(hosts ...string) WsMatchFn {
 	}
 }
 
+func WsUserIs(users ...string) WsMatchFn {
+	match := make(map[string]struct{})
+	for _, user := range users {
+		match[user] = struct{}{}
+	}
+
+	return func(frame ws.Frame, ctx *Context) bool {
+		_, ok := match[ctx.User]
+		return ok
+	}
+}
+
+// WsClientFingerprintIs is the WebSocket counterpart of ClientFingerprintIs.
+// WsClientFingerprintIs 是 ClientFingerprintIs 的 WebSocket 版本。
+func WsClientFingerprintIs(fingerprints ...string) WsMatchFn {
+	match := make(map[string]struct{})
+	for _, fingerprint := range fingerprints {
+		match[strings.ToLower(fingerprint)] = struct{}{}
+	}
+
+	return func(frame ws.Frame, ctx *Context) bool {
+		return matchClientFingerprint(match, ctx)
+	}
+}
+
 type RawMatcher interface {
 	Match(raw []byte, ctx *Context) bool
 }
@@ -223,3 +330,244 @@ func RawHostIs(hosts ...string) RawMatchFn {
 		return ok
 	}
 }
+
+func RawUserIs(users ...string) RawMatchFn {
+	match := make(map[string]struct{})
+	for _, user := range users {
+		match[user] = struct{}{}
+	}
+
+	return func(raw []byte, ctx *Context) bool {
+		_, ok := match[ctx.User]
+		return ok
+	}
+}
+
+// RawClientFingerprintIs is the raw TCP counterpart of ClientFingerprintIs.
+// RawClientFingerprintIs 是 ClientFingerprintIs 的原始 TCP 版本。
+func RawClientFingerprintIs(fingerprints ...string) RawMatchFn {
+	match := make(map[string]struct{})
+	for _, fingerprint := range fingerprints {
+		match[strings.ToLower(fingerprint)] = struct{}{}
+	}
+
+	return func(raw []byte, ctx *Context) bool {
+		return matchClientFingerprint(match, ctx)
+	}
+}
+
+type UdpMatcher interface {
+	Match(dgram *Datagram, ctx *Context) bool
+}
+
+type UdpFilter struct {
+	cfg     *Config
+	matcher []UdpMatcher
+}
+
+func (c *Config) WithUdpMatcher(matcher ...UdpMatcher) *UdpFilter {
+	return &UdpFilter{cfg: c, matcher: matcher}
+}
+
+// UdpHandlerFn handles a single datagram; returning nil drops it.
+type UdpHandlerFn func(*Datagram, *Context) *Datagram
+
+func (u *UdpFilter) Handle(handle UdpHandlerFn) {
+	u.cfg.udpHandlers = append(u.cfg.udpHandlers,
+		func(dgram *Datagram, ctx *Context) *Datagram {
+			for _, matcher := range u.matcher {
+				if !matcher.Match(dgram, ctx) {
+					return dgram
+				}
+			}
+			return handle(dgram, ctx)
+		})
+}
+
+func (c *Config) filterUdp(dgram *Datagram, ctx *Context) *Datagram {
+	for _, handle := range c.udpHandlers {
+		if dgram = handle(dgram, ctx); dgram == nil {
+			return nil
+		}
+	}
+	return dgram
+}
+
+type UdpMatchFn func(*Datagram, *Context) bool
+
+func (f UdpMatchFn) Match(dgram *Datagram, ctx *Context) bool {
+	return f(dgram, ctx)
+}
+
+func UdpHostIs(hosts ...string) UdpMatchFn {
+	match := make(map[string]struct{})
+	for _, host := range hosts {
+		match[host] = struct{}{}
+	}
+
+	return func(dgram *Datagram, ctx *Context) bool {
+		_, ok := match[dgram.Host]
+		return ok
+	}
+}
+
+func UdpPortIs(ports ...string) UdpMatchFn {
+	match := make(map[string]struct{})
+	for _, port := range ports {
+		match[port] = struct{}{}
+	}
+
+	return func(dgram *Datagram, ctx *Context) bool {
+		_, ok := match[dgram.Port]
+		return ok
+	}
+}
+
+type GrpcMatcher interface {
+	Match(msg *GrpcMessage, ctx *Context) bool
+}
+
+type GrpcFilter struct {
+	cfg     *Config
+	matcher []GrpcMatcher
+}
+
+func (c *Config) WithGrpcMatcher(matcher ...GrpcMatcher) *GrpcFilter {
+	return &GrpcFilter{cfg: c, matcher: matcher}
+}
+
+// GrpcHandlerFn handles a single gRPC message; returning nil drops it. The
+// trailer message that ends a response cannot be dropped: returning nil
+// relays the trailers unchanged.
+type GrpcHandlerFn func(*GrpcMessage, *Context) *GrpcMessage
+
+func (g *GrpcFilter) Handle(handle GrpcHandlerFn) {
+	g.cfg.grpcHandlers = append(g.cfg.grpcHandlers,
+		func(msg *GrpcMessage, ctx *Context) *GrpcMessage {
+			for _, matcher := range g.matcher {
+				if !matcher.Match(msg, ctx) {
+					return msg
+				}
+			}
+			return handle(msg, ctx)
+		})
+}
+
+func (c *Config) filterGrpc(msg *GrpcMessage, ctx *Context) *GrpcMessage {
+	for _, handle := range c.grpcHandlers {
+		if msg = handle(msg, ctx); msg == nil {
+			return nil
+		}
+	}
+	return msg
+}
+
+type GrpcMatchFn func(*GrpcMessage, *Context) bool
+
+func (f GrpcMatchFn) Match(msg *GrpcMessage, ctx *Context) bool {
+	return f(msg, ctx)
+}
+
+// GrpcServiceIs matches messages of the given fully-qualified services,
+// e.g. "helloworld.Greeter".
+func GrpcServiceIs(services ...string) GrpcMatchFn {
+	match := make(map[string]struct{})
+	for _, service := range services {
+		match[service] = struct{}{}
+	}
+
+	return func(msg *GrpcMessage, ctx *Context) bool {
+		_, ok := match[msg.Service]
+		return ok
+	}
+}
+
+// GrpcMethodIs matches messages of the given methods, written as
+// "service/method", e.g. "helloworld.Greeter/SayHello".
+func GrpcMethodIs(methods ...string) GrpcMatchFn {
+	match := make(map[string]struct{})
+	for _, method := range methods {
+		match[method] = struct{}{}
+	}
+
+	return func(msg *GrpcMessage, ctx *Context) bool {
+		_, ok := match[msg.Service+"/"+msg.Method]
+		return ok
+	}
+}
+
+type HelloMatcher interface {
+	Match(hello *ClientHello, ctx *Context) bool
+}
+
+type HelloFilter struct {
+	cfg     *Config
+	matcher []HelloMatcher
+}
+
+func (c *Config) WithHelloMatcher(matcher ...HelloMatcher) *HelloFilter {
+	return &HelloFilter{cfg: c, matcher: matcher}
+}
+
+// Impersonate replays the client's ClientHello on the upstream TLS handshake
+// of matching connections instead of using crypto/tls.
+func (h *HelloFilter) Impersonate() {
+	h.cfg.impersonateFilters = append(h.cfg.impersonateFilters, h.matcher)
+}
+
+// impersonate reports whether the upstream handshake of ctx replays the
+// client's ClientHello.
+func (c *Config) impersonate(ctx *Context) bool {
+	if ctx.ClientHello == nil {
+		return false
+	}
+	for _, matchers := range c.impersonateFilters {
+		matched := true
+		for _, matcher := range matchers {
+			if !matcher.Match(ctx.ClientHello, ctx) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+type HelloMatchFn func(*ClientHello, *Context) bool
+
+func (f HelloMatchFn) Match(hello *ClientHello, ctx *Context) bool {
+	return f(hello, ctx)
+}
+
+// HelloHostIs matches connections whose SNI or destination host is one of
+// the given hosts, case-insensitively.
+func HelloHostIs(hosts ...string) HelloMatchFn {
+	match := make(map[string]struct{})
+	for _, host := range hosts {
+		match[strings.ToLower(host)] = struct{}{}
+	}
+
+	return func(hello *ClientHello, ctx *Context) bool {
+		if _, ok := match[strings.ToLower(hello.ServerName)]; ok {
+			return true
+		}
+		_, ok := match[strings.ToLower(ctx.DstHost)]
+		return ok
+	}
+}
+
+// HelloFingerprintIs matches clients with one of the given JA3 or JA4
+// fingerprints.
+func HelloFingerprintIs(fingerprints ...string) HelloMatchFn {
+	match := make(map[string]struct{})
+	for _, fingerprint := range fingerprints {
+		match[strings.ToLower(fingerprint)] = struct{}{}
+	}
+
+	return func(hello *ClientHello, ctx *Context) bool {
+		return matchClientFingerprint(match, ctx)
+	}
+}
@@ -4,9 +4,8 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
-	"net"
+	"io"
 	"net/http"
-	"strconv"
 )
 
 // Negotiator defines the handshake behavior for various protocols.
@@ -23,133 +22,173 @@ type HandshakeFn func(*Context) error
 // Handshake 方法直接调用函数本体。
 func (f HandshakeFn) Handshake(ctx *Context) error { return f(ctx) }
 
-var HttpNegotiator HandshakeFn = func(ctx *Context) error {
-	req, err := http.ReadRequest(bufio.NewReader(ctx.Conn.PeekRd))
-	if err != nil {
-		ctx.Error(err)
-		return err
+// httpAuthAttempts bounds how many 407 challenges are sent on a single
+// connection before the negotiator gives up.
+// httpAuthAttempts 限定单个连接上最多发送多少次 407 挑战。
+const httpAuthAttempts = 3
+
+// HttpOption configures a negotiator created by NewHttpNegotiator.
+// HttpOption 用于配置 NewHttpNegotiator 创建的握手器。
+type HttpOption func(*httpAuth)
+
+// WithHttpBasicAuth requires clients to present Basic proxy credentials
+// that are accepted by auth.
+// WithHttpBasicAuth 要求客户端提供可被 auth 校验通过的 Basic 代理凭据。
+func WithHttpBasicAuth(auth Authenticator) HttpOption {
+	return func(a *httpAuth) { a.basic = auth }
+}
+
+// WithHttpDigestAuth requires clients to present Digest proxy credentials,
+// using lookup to obtain the shared password of each user.
+// WithHttpDigestAuth 要求客户端提供 Digest 代理凭据，通过 lookup 获取用户密码。
+func WithHttpDigestAuth(lookup PasswordLookup) HttpOption {
+	return func(a *httpAuth) { a.digest = lookup }
+}
+
+// WithHttpAuthRealm sets the realm advertised in Proxy-Authenticate challenges.
+// WithHttpAuthRealm 设置 Proxy-Authenticate 挑战中的 realm。
+func WithHttpAuthRealm(realm string) HttpOption {
+	return func(a *httpAuth) { a.realm = realm }
+}
+
+// NewHttpNegotiator creates an HTTP proxy negotiator with the given options.
+// When authentication is enabled, unauthenticated requests are answered with
+// 407 Proxy Authentication Required.
+// NewHttpNegotiator 根据传入的选项创建 HTTP 代理握手器，
+// 启用认证后未认证的请求会收到 407 Proxy Authentication Required 响应。
+func NewHttpNegotiator(opts ...HttpOption) HandshakeFn {
+	auth := &httpAuth{realm: "proxy", secret: newAuthSecret()}
+	for _, opt := range opts {
+		opt(auth)
 	}
 
-	if req.Method == http.MethodConnect {
-		_, err = http.ReadRequest(bufio.NewReader(ctx.Conn))
+	return func(ctx *Context) error {
+		req, err := http.ReadRequest(bufio.NewReader(ctx.Conn.PeekRd))
 		if err != nil {
 			ctx.Error(err)
 			return err
 		}
 
-		status := "Connection Established"
-		resp := fmt.Sprintf("%s %d %s\r\n\r\n",
-			req.Proto, http.StatusOK, status)
-		_, err = ctx.Conn.Write([]byte(resp))
-		if err != nil {
-			ctx.Error(err)
-			return err
+		for attempt := 1; auth.enabled(); attempt++ {
+			user, ok := auth.authenticate(ctx, req)
+			if ok {
+				ctx.User = user
+				break
+			}
+
+			ctx.Warnf("HTTP proxy authentication required for %s", req.Host)
+			if err = rejectProxyAuth(ctx, req, auth.challenges()); err != nil {
+				ctx.Error(err)
+				return err
+			}
+			if attempt >= httpAuthAttempts || req.Close {
+				return ErrAuthFailed
+			}
+
+			// Wait for the client to retry with credentials on the same connection
+			// 等待客户端在同一连接上携带凭据重试
+			req, err = http.ReadRequest(bufio.NewReader(ctx.Conn.PeekRd))
+			if err != nil {
+				if IsEOF(err) {
+					return ErrAuthFailed
+				}
+				ctx.Error(err)
+				return err
+			}
 		}
-	}
 
-	ctx.DstHost = req.URL.Hostname()
-	ctx.DstPort = req.URL.Port()
-	if ctx.DstPort == "" {
-		switch req.Method {
-		case http.MethodConnect:
-			ctx.DstPort = "443"
-		default:
-			ctx.DstPort = "80"
+		if req.Method == http.MethodConnect {
+			_, err = http.ReadRequest(bufio.NewReader(ctx.Conn))
+			if err != nil {
+				ctx.Error(err)
+				return err
+			}
+
+			status := "Connection Established"
+			resp := fmt.Sprintf("%s %d %s\r\n\r\n",
+				req.Proto, http.StatusOK, status)
+			_, err = ctx.Conn.Write([]byte(resp))
+			if err != nil {
+				ctx.Error(err)
+				return err
+			}
 		}
-	}
-	return nil
-}
 
-// Socks5Negotiator handles SOCKS5 protocol negotiation as per RFC 1928.
-// Socks5Negotiator 按照 RFC 1928 实现 SOCKS5 协议握手。
-var Socks5Negotiator HandshakeFn = func(ctx *Context) error {
-	buf := make([]byte, 2)
-	if _, err := ctx.Conn.Read(buf); err != nil {
-		return err
-	}
-
-	// Check SOCKS version
-	// 检查 SOCKS 版本
-	if buf[0] != 0x05 {
-		return errors.New("unsupported version") // 不支持的 SOCKS 版本
-	}
-
-	// Read supported authentication methods
-	// 读取客户端支持的认证方法
-	methods := make([]byte, buf[1])
-	if _, err := ctx.Conn.Read(methods); err != nil {
-		return err
+		ctx.DstHost = req.URL.Hostname()
+		ctx.DstPort = req.URL.Port()
+		if ctx.DstPort == "" {
+			switch req.Method {
+			case http.MethodConnect:
+				ctx.DstPort = "443"
+			default:
+				ctx.DstPort = "80"
+			}
+		}
+		return nil
 	}
+}
 
-	// Send method selection response (no auth)
-	// 回复选择的认证方法（0x00 表示不需要认证）
-	if _, err := ctx.Conn.Write([]byte{0x05, 0x00}); err != nil {
+// rejectProxyAuth consumes the unauthenticated request and answers it with
+// 407 Proxy Authentication Required carrying the given challenges.
+// rejectProxyAuth 消费未认证的请求，并返回携带挑战信息的 407 响应。
+func rejectProxyAuth(ctx *Context, req *http.Request, challenges []string) error {
+	consumed, err := http.ReadRequest(bufio.NewReader(ctx.Conn))
+	if err != nil {
 		return err
 	}
-
-	// Read connection request header
-	// 读取连接请求头
-	buf = make([]byte, 4)
-	if _, err := ctx.Conn.Read(buf); err != nil {
-		return err
+	_, _ = io.Copy(io.Discard, consumed.Body)
+	_ = consumed.Body.Close()
+
+	resp := &http.Response{
+		StatusCode:    http.StatusProxyAuthRequired,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        http.Header{"Proxy-Authenticate": challenges},
+		ContentLength: 0,
+		Close:         req.Close,
 	}
+	return resp.Write(ctx.Conn)
+}
 
-	// Validate request type: 0x01 means CONNECT
-	// 校验请求类型：0x01 表示 CONNECT
-	if buf[0] != 0x05 || buf[1] != 0x01 {
-		return errors.New("unsupported request") // 不支持的请求类型
-	}
-
-	// Logging version and command
-	// 日志记录版本和命令字段
-	ctx.Debugf("Parsing SOCKS5 request: VER=0x%02X CMD=0x%02X", buf[0], buf[1])
-
-	switch buf[3] {
-	case 0x01: // IPv4 address
-		ipv4 := make([]byte, 4)
-		if _, err := ctx.Conn.Read(ipv4); err != nil {
-			return err
-		}
-		ctx.DstHost = net.IP(ipv4).String()
-
-	case 0x03: // Domain name
-		aLen := make([]byte, 1)
-		if _, err := ctx.Conn.Read(aLen); err != nil {
+// HttpNegotiator handles HTTP CONNECT and plain proxy requests without
+// authentication.
+// HttpNegotiator 处理 HTTP CONNECT 与普通代理请求（无认证）。
+var HttpNegotiator = NewHttpNegotiator()
+
+// NewMixedNegotiator creates a negotiator that serves HTTP, SOCKS4/4a and
+// SOCKS5 clients on the same port. It peeks the first byte of the stream and
+// delegates to the matching negotiator; a nil negotiator disables that protocol.
+// NewMixedNegotiator 创建一个可在同一端口上同时服务 HTTP、SOCKS4/4a 和 SOCKS5
+// 客户端的握手器。它会预读取首字节并交由对应的握手器处理，传入 nil 表示禁用该协议。
+func NewMixedNegotiator(http, socks4, socks5 Negotiator) HandshakeFn {
+	return func(ctx *Context) error {
+		raw, err := ctx.Conn.Peek(1)
+		if err != nil && len(raw) <= 0 {
 			return err
 		}
 
-		domain := make([]byte, aLen[0])
-		if _, err := ctx.Conn.Read(domain); err != nil {
-			return err
+		var negotiator Negotiator
+		switch raw[0] {
+		case socks5Version:
+			ctx.Debugf("Detected SOCKS5 handshake")
+			negotiator = socks5
+		case socks4Version:
+			ctx.Debugf("Detected SOCKS4 handshake")
+			negotiator = socks4
+		default:
+			ctx.Debugf("Detected HTTP handshake")
+			negotiator = http
 		}
-		ctx.DstHost = string(domain)
 
-	case 0x04: // IPv6 address
-		ipv6 := make([]byte, 16)
-		if _, err := ctx.Conn.Read(ipv6); err != nil {
-			return err
+		if negotiator == nil {
+			return errors.New("unsupported proxy protocol") // 不支持的代理协议
 		}
-		ctx.DstHost = net.IP(ipv6).String()
-
-	default:
-		return errors.New("unsupported address type") // 不支持的地址类型
+		return negotiator.Handshake(ctx)
 	}
-
-	// Read destination port (2 bytes)
-	// 读取目标端口（2 字节）
-	port := make([]byte, 2)
-	if _, err := ctx.Conn.Read(port); err != nil {
-		return err
-	}
-	ctx.DstPort = strconv.Itoa(int(port[0])<<8 | int(port[1]))
-
-	// Send success response
-	// 发送连接成功的响应
-	_, _ = ctx.Conn.Write([]byte{
-		0x05, 0x00, 0x00, 0x01, // Version, success, reserved, address type (IPv4)
-		0x00, 0x00, 0x00, 0x00, // BIND address (ignored here)
-		0x00, 0x00, // BIND port
-	})
-
-	return nil
 }
+
+// MixedNegotiator accepts HTTP, SOCKS4/4a and SOCKS5 clients on one port
+// using the unauthenticated built-in negotiators.
+// MixedNegotiator 使用内置的无认证握手器，在同一端口上接受 HTTP、SOCKS4/4a 和 SOCKS5 客户端。
+var MixedNegotiator = NewMixedNegotiator(HttpNegotiator, Socks4Negotiator, Socks5Negotiator)
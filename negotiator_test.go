@@ -1,8 +1,13 @@
 package proxy
 
 import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"testing"
 )
@@ -110,3 +115,163 @@ func TestHttpHandshake(t *testing.T) {
 
 	l.Close()
 }
+
+func TestHttpProxyAuth(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.Addr().String()
+
+	creds := StaticAuthenticator{"alice": "secret"}
+	negotiator := NewHttpNegotiator(WithHttpBasicAuth(creds), WithHttpDigestAuth(creds))
+
+	tests := []struct {
+		name      string
+		authorize func(challenges []string) string
+	}{
+		{"basic", func([]string) string {
+			return "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+		}},
+		{"digest", func(challenges []string) string {
+			var nonce string
+			for _, challenge := range challenges {
+				if scheme, params, _ := strings.Cut(challenge, " "); scheme == "Digest" {
+					nonce = parseAuthParams(params)["nonce"]
+				}
+			}
+			ha1 := md5Hex("alice:proxy:secret")
+			ha2 := md5Hex("CONNECT:example.com:443")
+			response := md5Hex(ha1 + ":" + nonce + ":00000001:abcdef:auth:" + ha2)
+			return fmt.Sprintf(`Digest username="alice", realm="proxy", nonce=%q, uri="example.com:443", `+
+				`qop=auth, nc=00000001, cnonce="abcdef", response=%q`, nonce, response)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			wg.Add(1)
+
+			var ctx *Context
+			var handshakeErr error
+			go func() {
+				defer wg.Done()
+				inner, err := l.Accept()
+				if err != nil {
+					handshakeErr = err
+					return
+				}
+				defer inner.Close()
+
+				ctx = NewContext(ctxLogger, "test", nil)
+				ctx.Conn = NewConn(inner)
+				handshakeErr = negotiator.Handshake(ctx)
+			}()
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+
+			req, err := http.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = "example.com:443"
+			req.URL = &url.URL{Opaque: "example.com:443"}
+			if err = req.Write(conn); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.ReadResponse(reader, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusProxyAuthRequired {
+				t.Fatalf("unexpected status: %s", resp.Status)
+			}
+
+			req.Header.Set("Proxy-Authorization", tt.authorize(resp.Header.Values("Proxy-Authenticate")))
+			if err = req.Write(conn); err != nil {
+				t.Fatal(err)
+			}
+			resp, err = http.ReadResponse(reader, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wg.Wait()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("unexpected status: %s", resp.Status)
+			}
+			if handshakeErr != nil {
+				t.Fatal(handshakeErr)
+			}
+			if ctx.User != "alice" || ctx.DstHost != "example.com" || ctx.DstPort != "443" {
+				t.Fatalf("unexpected context: user=%q dst=%s:%s", ctx.User, ctx.DstHost, ctx.DstPort)
+			}
+		})
+	}
+}
+
+func TestMixedHandshake(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.Addr().String()
+
+	tests := []struct {
+		name    string
+		request []byte
+	}{
+		{"http", []byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")},
+		{"socks4", append([]byte{0x04, 0x01, 0x01, 0xBB, 0, 0, 0, 1, 0x00}, append([]byte("example.com"), 0x00)...)},
+		{"socks5", append([]byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x03, 11},
+			append([]byte("example.com"), 0x01, 0xBB)...)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			wg.Add(1)
+
+			var ctx *Context
+			var handshakeErr error
+			go func() {
+				defer wg.Done()
+				inner, err := l.Accept()
+				if err != nil {
+					handshakeErr = err
+					return
+				}
+				defer inner.Close()
+
+				ctx = NewContext(ctxLogger, "test", nil)
+				ctx.Conn = NewConn(inner)
+				handshakeErr = MixedNegotiator.Handshake(ctx)
+			}()
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err = conn.Write(tt.request); err != nil {
+				t.Fatal(err)
+			}
+			wg.Wait()
+
+			if handshakeErr != nil {
+				t.Fatal(handshakeErr)
+			}
+			if ctx.DstHost != "example.com" || ctx.DstPort != "443" {
+				t.Fatalf("unexpected target: %s:%s", ctx.DstHost, ctx.DstPort)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package proxy
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// PassthroughListOption configures a PassthroughList.
+// PassthroughListOption 用于配置 PassthroughList。
+type PassthroughListOption func(*PassthroughList)
+
+// WithPassthroughThreshold sets how many consecutive client-side handshake
+// failures switch a server name to passthrough. It defaults to 3.
+// WithPassthroughThreshold 设置客户端连续握手失败多少次后将该域名切换为透传，默认为 3。
+func WithPassthroughThreshold(threshold int) PassthroughListOption {
+	return func(p *PassthroughList) { p.threshold = threshold }
+}
+
+// WithPassthroughMaxTracked bounds the number of server names whose failures
+// are counted, dropping the least recently failed first. It defaults to 1024.
+// WithPassthroughMaxTracked 设置记录握手失败次数的域名数量上限，超出时优先淘汰最久未失败的域名，默认为 1024。
+func WithPassthroughMaxTracked(size int) PassthroughListOption {
+	return func(p *PassthroughList) { p.maxTracked = size }
+}
+
+// WithPassthroughMaxHosts stops learning new server names once the list holds
+// size of them, hosts added by hand included. It defaults to 256.
+// WithPassthroughMaxHosts 设置名单中的域名数量（含手动添加的域名）达到 size 后不再自动学习新域名，默认为 256。
+func WithPassthroughMaxHosts(size int) PassthroughListOption {
+	return func(p *PassthroughList) { p.maxHosts = size }
+}
+
+// PassthroughList is the list of server names whose TLS streams are relayed as
+// raw TCP through the TcpHandler instead of being intercepted. Besides hosts
+// added by hand, it learns the server names whose clients keep rejecting the
+// forged certificate, e.g. because of certificate pinning: after a number of
+// consecutive handshakes aborted by a certificate alert from the client, the
+// name is added to the list. Other failures such as EOFs or resets are not
+// counted.
+// PassthroughList 是 TLS 流不做中间人、直接经 TcpHandler 按原始 TCP 转发的域名名单。
+// 除手动添加的域名外，它还会学习客户端持续拒绝伪造证书（例如启用了证书固定）的域名：
+// 客户端以证书相关告警连续中止握手达到一定次数后，该域名即被加入名单。EOF、连接重置等其他失败不计入。
+type PassthroughList struct {
+	threshold  int
+	maxTracked int
+	maxHosts   int
+	path       string
+	mu         sync.Mutex
+	lru        *list.List
+	failures   map[string]*list.Element
+	hosts      map[string]struct{}
+}
+
+type passthroughFailure struct {
+	host  string
+	count int
+}
+
+// NewPassthroughList creates an empty PassthroughList kept in memory only.
+// NewPassthroughList 创建仅保存在内存中的空 PassthroughList。
+func NewPassthroughList(opts ...PassthroughListOption) *PassthroughList {
+	p := &PassthroughList{
+		threshold:  3,
+		maxTracked: 1024,
+		maxHosts:   256,
+		lru:        list.New(),
+		failures:   make(map[string]*list.Element),
+		hosts:      make(map[string]struct{}),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// OpenPassthroughList creates a PassthroughList persisted to the file at
+// path, one server name per line, loading the names already listed there.
+// Lines that are blank or start with '#' are ignored, and a missing file is
+// created on the first change.
+// OpenPassthroughList 创建持久化到 path 文件的 PassthroughList（每行一个域名），并加载文件中已有的域名。
+// 空行与以 '#' 开头的行会被忽略，文件不存在时在第一次变更时创建。
+func OpenPassthroughList(path string, opts ...PassthroughListOption) (*PassthroughList, error) {
+	p := NewPassthroughList(opts...)
+	p.path = path
+
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			p.hosts[strings.ToLower(line)] = struct{}{}
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Contains reports whether host is passed through.
+// Contains 判断 host 是否透传。
+func (p *PassthroughList) Contains(host string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.hosts[strings.ToLower(host)]
+	return ok
+}
+
+// Hosts returns the passed-through server names in sorted order.
+// Hosts 按排序后的顺序返回所有透传域名。
+func (p *PassthroughList) Hosts() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	hosts := make([]string, 0, len(p.hosts))
+	for host := range p.hosts {
+		hosts = append(hosts, host)
+	}
+	slices.Sort(hosts)
+	return hosts
+}
+
+// Add passes the given hosts through.
+// Add 将指定域名加入透传名单。
+func (p *PassthroughList) Add(hosts ...string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, host := range hosts {
+		host = strings.ToLower(host)
+		p.hosts[host] = struct{}{}
+		p.forget(host)
+	}
+	return p.save()
+}
+
+// Remove intercepts the given hosts again and clears their failure counts.
+// Remove 恢复对指定域名的中间人拦截，并清空其握手失败计数。
+func (p *PassthroughList) Remove(hosts ...string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, host := range hosts {
+		host = strings.ToLower(host)
+		delete(p.hosts, host)
+		p.forget(host)
+	}
+	return p.save()
+}
+
+// Failures returns the number of consecutive failed handshakes recorded for
+// host.
+// Failures 返回 host 已记录的连续握手失败次数。
+func (p *PassthroughList) Failures(host string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if elem, ok := p.failures[strings.ToLower(host)]; ok {
+		return elem.Value.(*passthroughFailure).count
+	}
+	return 0
+}
+
+// passthrough reports whether the TLS stream to host is passed through. It
+// is false when p is nil.
+// passthrough 判断发往 host 的 TLS 流是否透传，p 为 nil 时返回 false。
+func (p *PassthroughList) passthrough(host string) bool {
+	return p != nil && p.Contains(host)
+}
+
+// fail records the client-side handshake of host that failed with err and
+// reports whether host has just been switched to passthrough. Only
+// certificate alerts sent by the client are counted. It does nothing when p
+// is nil.
+// fail 记录 host 一次以 err 失败的客户端握手，并返回其是否刚被切换为透传。
+// 仅统计客户端发送的证书相关告警，p 为 nil 时不做任何处理。
+func (p *PassthroughList) fail(host string, err error) (bool, error) {
+	if p == nil || !certificateRejected(err) {
+		return false, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	host = strings.ToLower(host)
+	if _, ok := p.hosts[host]; ok {
+		return false, nil
+	}
+
+	elem, ok := p.failures[host]
+	if ok {
+		p.lru.MoveToFront(elem)
+	} else {
+		elem = p.lru.PushFront(&passthroughFailure{host: host})
+		p.failures[host] = elem
+		for p.lru.Len() > p.maxTracked {
+			p.forget(p.lru.Back().Value.(*passthroughFailure).host)
+		}
+	}
+	failure := elem.Value.(*passthroughFailure)
+	failure.count++
+	if failure.count < p.threshold || len(p.hosts) >= p.maxHosts {
+		return false, nil
+	}
+	p.forget(host)
+	p.hosts[host] = struct{}{}
+	return true, p.save()
+}
+
+// succeed clears the failure count of host after a successful handshake.
+// succeed 在握手成功后清空 host 的失败计数。
+func (p *PassthroughList) succeed(host string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.forget(strings.ToLower(host))
+}
+
+// forget drops the failure count of host. The caller must hold p.mu.
+// forget 删除 host 的失败计数，调用方必须持有 p.mu。
+func (p *PassthroughList) forget(host string) {
+	if elem, ok := p.failures[host]; ok {
+		p.lru.Remove(elem)
+		delete(p.failures, host)
+	}
+}
+
+// rejectionAlerts are the alerts a client sends when it refuses the
+// certificate it was presented.
+// rejectionAlerts 是客户端拒绝所收到证书时发送的告警。
+var rejectionAlerts = map[string]struct{}{
+	"tls: bad certificate":                 {},
+	"tls: unsupported certificate":         {},
+	"tls: revoked certificate":             {},
+	"tls: expired certificate":             {},
+	"tls: unknown certificate":             {},
+	"tls: unknown certificate authority":   {},
+	"tls: access denied":                   {},
+	"tls: bad certificate hash value":      {},
+	"tls: bad certificate status response": {},
+}
+
+// certificateRejected reports whether the handshake failed because the
+// client sent an alert rejecting the certificate. crypto/tls reports alerts
+// received from the peer as a *net.OpError with Op "remote error".
+// certificateRejected 判断握手是否因客户端发送拒绝证书的告警而失败，
+// crypto/tls 将对端发来的告警报告为 Op 为 "remote error" 的 *net.OpError。
+func certificateRejected(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" || opErr.Err == nil {
+		return false
+	}
+	_, ok := rejectionAlerts[opErr.Err.Error()]
+	return ok
+}
+
+// save writes the list to p.path, if any. The caller must hold p.mu.
+// save 将名单写入 p.path（若已设置），调用方必须持有 p.mu。
+func (p *PassthroughList) save() error {
+	if p.path == "" {
+		return nil
+	}
+	hosts := make([]string, 0, len(p.hosts))
+	for host := range p.hosts {
+		hosts = append(hosts, host+"\n")
+	}
+	slices.Sort(hosts)
+
+	//先写入临时文件再重命名，避免其他进程读取到不完整的文件
+	tmp, err := os.CreateTemp(filepath.Dir(p.path), ".passthrough-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.WriteString(strings.Join(hosts, ""))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// remoteAlert mimics the error crypto/tls returns for an alert sent by the
+// peer.
+func remoteAlert(desc string) error {
+	return &net.OpError{Op: "remote error", Err: errors.New("tls: " + desc)}
+}
+
+func TestPassthroughList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passthrough.txt")
+	if err := os.WriteFile(path, []byte("# pinned apps\nA.test\n\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := OpenPassthroughList(path, WithPassthroughThreshold(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !list.Contains("a.TEST") {
+		t.Errorf("a.test not loaded, Hosts = %v", list.Hosts())
+	}
+	if err = list.Add("b.test"); err != nil {
+		t.Fatal(err)
+	}
+	if err = list.Remove("a.test"); err != nil {
+		t.Fatal(err)
+	}
+
+	rejected := remoteAlert("unknown certificate authority")
+	for i, want := range []bool{false, true, false} {
+		if switched, err := list.fail("c.test", rejected); err != nil || switched != want {
+			t.Errorf("fail #%d = %v, %v, want %v", i+1, switched, err, want)
+		}
+	}
+	_, _ = list.fail("d.test", rejected)
+	for _, err := range []error{io.EOF, &net.OpError{Op: "read", Err: errors.New("connection reset by peer")},
+		remoteAlert("handshake failure")} {
+		if _, _ = list.fail("d.test", err); list.Failures("d.test") != 1 {
+			t.Errorf("failure %v counted", err)
+		}
+	}
+	if list.Failures("d.test") != 1 {
+		t.Errorf("Failures(d.test) = %d, want 1", list.Failures("d.test"))
+	}
+	if list.succeed("d.test"); list.Failures("d.test") != 0 {
+		t.Errorf("Failures(d.test) = %d after success, want 0", list.Failures("d.test"))
+	}
+
+	reopened, err := OpenPassthroughList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := reopened.Hosts(), []string{"b.test", "c.test"}; !slices.Equal(got, want) {
+		t.Errorf("persisted Hosts = %v, want %v", got, want)
+	}
+
+	var nilList *PassthroughList
+	if switched, _ := nilList.fail("a.test", rejected); switched || nilList.passthrough("a.test") {
+		t.Error("nil list must intercept everything")
+	}
+}
+
+func TestPassthroughListLimits(t *testing.T) {
+	list := NewPassthroughList(WithPassthroughThreshold(2),
+		WithPassthroughMaxTracked(2), WithPassthroughMaxHosts(1))
+	rejected := remoteAlert("bad certificate")
+
+	for _, host := range []string{"a.test", "b.test", "c.test"} {
+		_, _ = list.fail(host, rejected)
+	}
+	if list.Failures("a.test") != 0 || list.Failures("c.test") != 1 {
+		t.Errorf("least recently failed host not evicted: a=%d c=%d",
+			list.Failures("a.test"), list.Failures("c.test"))
+	}
+
+	if switched, _ := list.fail("c.test", rejected); !switched {
+		t.Error("c.test not learned")
+	}
+	for range 3 {
+		if switched, _ := list.fail("b.test", rejected); switched {
+			t.Error("learned past the host limit")
+		}
+	}
+	if got := list.Hosts(); !slices.Equal(got, []string{"c.test"}) {
+		t.Errorf("Hosts = %v", got)
+	}
+}
+
+func TestPassthroughDispatch(t *testing.T) {
+	cfg := NewConfig(FromCA(Certificate, PrivateKey))
+	cfg.Resolver = NewResolver()
+	cfg.PassthroughList = NewPassthroughList(WithPassthroughThreshold(2))
+
+	var passed []byte
+	cfg.TcpHandler = HandleTcpFn(func(ctx *Context) error {
+		if ctx.Conn.IsTLS() {
+			t.Error("passed-through stream was terminated as TLS")
+		}
+		passed, _ = ctx.Conn.Peek(1)
+		return nil
+	})
+
+	for i, want := range []bool{false, false, true} {
+		client, server := net.Pipe()
+		go func() {
+			// A pinning client rejects the forged certificate
+			tlsClient := tls.Client(client, &tls.Config{ServerName: "pinned.test"})
+			_ = tlsClient.Handshake()
+			_ = tlsClient.Close()
+		}()
+
+		passed = nil
+		ctx := NewContext(ctxLogger, "test", cfg)
+		ctx.Conn = NewConn(server)
+		ctx.DstHost, ctx.DstPort = "pinned.test", "443"
+		err := ctx.Dispatcher.Dispatch(ctx)
+		_ = server.Close()
+
+		if got := len(passed) == 1 && passed[0] == 0x16; got != want {
+			t.Errorf("connection #%d passed through = %v, want %v (err %v)", i+1, got, want, err)
+		}
+	}
+	if got := cfg.PassthroughList.Hosts(); !slices.Equal(got, []string{"pinned.test"}) {
+		t.Errorf("Hosts = %v", got)
+	}
+}
@@ -0,0 +1,287 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// ProtoField is a single field of a protobuf message decoded without a
+// schema. Exactly one of the value fields is meaningful, depending on Type.
+// Length-delimited values that parse as a message are also decoded into
+// Message, since the wire format cannot tell the two apart.
+// ProtoField 表示在没有 schema 的情况下解码出的单个 protobuf 字段，
+// 根据 Type 只有一个值字段有意义。可以解析为消息的长度前缀字段同时解码到 Message 中，
+// 因为线格式本身无法区分两者。
+type ProtoField struct {
+	Number  protowire.Number // 字段编号
+	Type    protowire.Type   // 线格式类型
+	Varint  uint64           // VarintType
+	Fixed32 uint32           // Fixed32Type
+	Fixed64 uint64           // Fixed64Type
+	Bytes   []byte           // BytesType
+	Message []ProtoField     // BytesType 可解析为嵌套消息时，或 StartGroupType 的组内字段
+}
+
+// DecodeProto decodes a protobuf payload into a field tree without a schema.
+// DecodeProto 在没有 schema 的情况下将 protobuf 数据解码为字段树。
+func DecodeProto(b []byte) ([]ProtoField, error) {
+	fields, _, err := decodeProtoFields(b, 0)
+	return fields, err
+}
+
+// decodeProtoFields decodes fields until the end of b or, inside a group,
+// until the matching end-group tag. It returns the number of bytes consumed.
+// decodeProtoFields 解码字段直到 b 结束，或在组内直到遇到对应的组结束标记，返回消费的字节数。
+func decodeProtoFields(b []byte, group protowire.Number) ([]ProtoField, int, error) {
+	var fields []ProtoField
+	offset := 0
+	for offset < len(b) {
+		num, typ, n := protowire.ConsumeTag(b[offset:])
+		if n < 0 {
+			return nil, 0, protowire.ParseError(n)
+		}
+		if typ == protowire.EndGroupType {
+			if num != group {
+				return nil, 0, errors.New("mismatched end group") // 组结束标记不匹配
+			}
+			return fields, offset + n, nil
+		}
+		offset += n
+
+		field := ProtoField{Number: num, Type: typ}
+		switch typ {
+		case protowire.VarintType:
+			field.Varint, n = protowire.ConsumeVarint(b[offset:])
+		case protowire.Fixed32Type:
+			field.Fixed32, n = protowire.ConsumeFixed32(b[offset:])
+		case protowire.Fixed64Type:
+			field.Fixed64, n = protowire.ConsumeFixed64(b[offset:])
+		case protowire.BytesType:
+			field.Bytes, n = protowire.ConsumeBytes(b[offset:])
+			if n >= 0 && len(field.Bytes) > 0 && !isProtoText(field.Bytes) {
+				field.Message, _ = DecodeProto(field.Bytes)
+			}
+		case protowire.StartGroupType:
+			var err error
+			if field.Message, n, err = decodeProtoFields(b[offset:], num); err != nil {
+				return nil, 0, err
+			}
+		default:
+			return nil, 0, fmt.Errorf("invalid wire type %d", typ)
+		}
+		if n < 0 {
+			return nil, 0, protowire.ParseError(n)
+		}
+		offset += n
+		fields = append(fields, field)
+	}
+	if group != 0 {
+		return nil, 0, errors.New("unterminated group") // 组未结束
+	}
+	return fields, offset, nil
+}
+
+// isProtoText reports whether b reads as text rather than a nested message.
+// isProtoText 判断 b 更像文本而不是嵌套消息。
+func isProtoText(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && r != '\t' && r != '\r' && r != '\n' {
+			return false
+		}
+	}
+	return true
+}
+
+// FormatProto renders a field tree in the style of protoc --decode_raw.
+// FormatProto 以 protoc --decode_raw 的风格输出字段树。
+func FormatProto(fields []ProtoField) string {
+	var sb strings.Builder
+	formatProtoFields(&sb, fields, "")
+	return sb.String()
+}
+
+func formatProtoFields(sb *strings.Builder, fields []ProtoField, indent string) {
+	for _, field := range fields {
+		switch {
+		case field.Message != nil:
+			fmt.Fprintf(sb, "%s%d {\n", indent, field.Number)
+			formatProtoFields(sb, field.Message, indent+"  ")
+			fmt.Fprintf(sb, "%s}\n", indent)
+		case field.Type == protowire.VarintType:
+			fmt.Fprintf(sb, "%s%d: %d\n", indent, field.Number, field.Varint)
+		case field.Type == protowire.Fixed32Type:
+			fmt.Fprintf(sb, "%s%d: 0x%08x\n", indent, field.Number, field.Fixed32)
+		case field.Type == protowire.Fixed64Type:
+			fmt.Fprintf(sb, "%s%d: 0x%016x\n", indent, field.Number, field.Fixed64)
+		case field.Type == protowire.StartGroupType:
+			fmt.Fprintf(sb, "%s%d {\n%s}\n", indent, field.Number, indent)
+		case isProtoText(field.Bytes):
+			fmt.Fprintf(sb, "%s%d: %q\n", indent, field.Number, field.Bytes)
+		default:
+			fmt.Fprintf(sb, "%s%d: 0x%x\n", indent, field.Number, field.Bytes)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ProtoRegistry resolves message types from FileDescriptorSet files, as
+// produced by protoc --descriptor_set_out --include_imports.
+// ProtoRegistry 从 FileDescriptorSet 文件（由 protoc --descriptor_set_out --include_imports 生成）
+// 中解析消息类型。
+type ProtoRegistry struct {
+	files *protoregistry.Files
+	types *dynamicpb.Types
+}
+
+// LoadProtoDescriptors loads one or more binary FileDescriptorSet files.
+// LoadProtoDescriptors 加载一个或多个二进制 FileDescriptorSet 文件。
+func LoadProtoDescriptors(paths ...string) (*ProtoRegistry, error) {
+	set := new(descriptorpb.FileDescriptorSet)
+	seen := make(map[string]struct{})
+	for _, path := range paths {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		part := new(descriptorpb.FileDescriptorSet)
+		if err = proto.Unmarshal(raw, part); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for _, file := range part.GetFile() {
+			if _, ok := seen[file.GetName()]; !ok {
+				seen[file.GetName()] = struct{}{}
+				set.File = append(set.File, file)
+			}
+		}
+	}
+	return NewProtoRegistry(set)
+}
+
+// NewProtoRegistry creates a registry from an in-memory FileDescriptorSet.
+// NewProtoRegistry 基于内存中的 FileDescriptorSet 创建注册表。
+func NewProtoRegistry(set *descriptorpb.FileDescriptorSet) (*ProtoRegistry, error) {
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, err
+	}
+	return &ProtoRegistry{files: files, types: dynamicpb.NewTypes(files)}, nil
+}
+
+// FindMessage looks up a message by its full name, e.g. "helloworld.HelloRequest".
+// FindMessage 按全名查找消息类型，例如 "helloworld.HelloRequest"。
+func (r *ProtoRegistry) FindMessage(name string) (protoreflect.MessageDescriptor, bool) {
+	desc, err := r.files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, false
+	}
+	md, ok := desc.(protoreflect.MessageDescriptor)
+	return md, ok
+}
+
+// FindGrpcMessage returns the request (outbound) or response message type of
+// a gRPC method.
+// FindGrpcMessage 返回 gRPC 方法的请求（outbound）或响应消息类型。
+func (r *ProtoRegistry) FindGrpcMessage(service, method string, outbound bool) (protoreflect.MessageDescriptor, bool) {
+	desc, err := r.files.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil, false
+	}
+	sd, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, false
+	}
+	md := sd.Methods().ByName(protoreflect.Name(method))
+	if md == nil {
+		return nil, false
+	}
+	if outbound {
+		return md.Input(), true
+	}
+	return md.Output(), true
+}
+
+// ToJSON decodes payload as the message md and encodes it as JSON.
+// ToJSON 按消息类型 md 解码 payload，并编码为 JSON。
+func (r *ProtoRegistry) ToJSON(md protoreflect.MessageDescriptor, payload []byte) ([]byte, error) {
+	msg := dynamicpb.NewMessage(md)
+	if err := (proto.UnmarshalOptions{Resolver: r.types}).Unmarshal(payload, msg); err != nil {
+		return nil, err
+	}
+	return protojson.MarshalOptions{Resolver: r.types, Multiline: true}.Marshal(msg)
+}
+
+// FromJSON parses JSON as the message md and encodes it in wire format,
+// with fields in a deterministic order.
+// FromJSON 按消息类型 md 解析 JSON，并以确定的字段顺序编码为线格式。
+func (r *ProtoRegistry) FromJSON(md protoreflect.MessageDescriptor, data []byte) ([]byte, error) {
+	msg := dynamicpb.NewMessage(md)
+	if err := (protojson.UnmarshalOptions{Resolver: r.types}).Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+}
+
+// formatProtoPayload renders payload as JSON when md is known and registry
+// can decode it, or as a schema-less field tree otherwise.
+// formatProtoPayload 在已知消息类型且 registry 可以解码时以 JSON 输出 payload，否则输出无 schema 的字段树。
+func formatProtoPayload(registry *ProtoRegistry, md protoreflect.MessageDescriptor, payload []byte) string {
+	if registry != nil && md != nil {
+		if out, err := registry.ToJSON(md, payload); err == nil {
+			return string(out) + "\n"
+		}
+	}
+	fields, err := DecodeProto(payload)
+	if err != nil {
+		return fmt.Sprintf("<invalid protobuf: %v> 0x%x\n", err, payload)
+	}
+	return FormatProto(fields)
+}
+
+// FormatGrpcMessage renders msg for logging, using field names when
+// Config.ProtoDescriptors knows the method.
+// FormatGrpcMessage 输出 msg 用于日志记录，Config.ProtoDescriptors 中存在该方法时使用字段名。
+func (c *Context) FormatGrpcMessage(msg *GrpcMessage) string {
+	var md protoreflect.MessageDescriptor
+	if c.ProtoDescriptors != nil {
+		md, _ = c.ProtoDescriptors.FindGrpcMessage(msg.Service, msg.Method, msg.Outbound)
+	}
+	return formatProtoPayload(c.ProtoDescriptors, md, msg.Payload)
+}
+
+// isProtobuf reports whether contentType carries a protobuf payload and
+// returns the message type named in its parameters, if any.
+// isProtobuf 判断 contentType 是否表示 protobuf 数据，并返回参数中指定的消息类型。
+func isProtobuf(contentType string) (bool, string) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false, ""
+	}
+	switch mediaType {
+	case "application/x-protobuf", "application/protobuf",
+		"application/x-google-protobuf", "application/vnd.google.protobuf":
+		name := params["messagetype"]
+		if name == "" {
+			name = params["proto"]
+		}
+		return true, name
+	}
+	return false, ""
+}
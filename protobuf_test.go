@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// testProtoPayload encodes {name: "hello", count: 150, inner: {id: 7}}.
+func testProtoPayload() []byte {
+	var inner []byte
+	inner = protowire.AppendTag(inner, 1, protowire.VarintType)
+	inner = protowire.AppendVarint(inner, 7)
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, "hello")
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, 150)
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	return protowire.AppendBytes(b, inner)
+}
+
+func writeTestDescriptors(t *testing.T) string {
+	t.Helper()
+	field := func(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			Number:   proto.Int32(number),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     typ.Enum(),
+			JsonName: proto.String(name),
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("test.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("Inner"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_INT32, ""),
+			}},
+			{Name: proto.String("Hello"), Field: []*descriptorpb.FieldDescriptorProto{
+				field("name", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, ""),
+				field("count", 2, descriptorpb.FieldDescriptorProto_TYPE_INT32, ""),
+				field("inner", 3, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, ".test.Inner"),
+			}},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Echo"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       proto.String("Say"),
+				InputType:  proto.String(".test.Hello"),
+				OutputType: proto.String(".test.Hello"),
+			}},
+		}},
+	}}}
+
+	raw, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "test.pb")
+	if err = os.WriteFile(path, raw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDecodeProto(t *testing.T) {
+	fields, err := DecodeProto(testProtoPayload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "1: \"hello\"\n2: 150\n3 {\n  1: 7\n}\n"
+	if got := FormatProto(fields); got != want {
+		t.Fatalf("unexpected tree:\n%s\nwant:\n%s", got, want)
+	}
+
+	if _, err = DecodeProto([]byte{0x0a, 0x05, 'h'}); err == nil {
+		t.Fatal("expected error for truncated payload")
+	}
+}
+
+func TestProtoRegistry(t *testing.T) {
+	registry, err := LoadProtoDescriptors(writeTestDescriptors(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, ok := registry.FindGrpcMessage("test.Echo", "Say", true)
+	if !ok {
+		t.Fatal("method not found")
+	}
+
+	payload := testProtoPayload()
+	data, err := registry.ToJSON(md, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(strings.ReplaceAll(string(data), " ", ""), `"name":"hello"`) {
+		t.Fatalf("field names missing from JSON: %s", data)
+	}
+
+	back, err := registry.FromJSON(md, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, want := dynamicpb.NewMessage(md), dynamicpb.NewMessage(md)
+	if err = proto.Unmarshal(back, got); err != nil {
+		t.Fatal(err)
+	}
+	if err = proto.Unmarshal(payload, want); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(got, want) {
+		t.Fatalf("round trip mismatch: %x != %x", back, payload)
+	}
+}
+
+func TestDumpProtobufRequest(t *testing.T) {
+	payload := testProtoPayload()
+	newReq := func() *http.Request {
+		req, _ := http.NewRequest(http.MethodPost, "http://example.com/hello", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/x-protobuf; messageType=test.Hello")
+		return req
+	}
+
+	ctx := NewContext(ctxLogger, "test", NewConfig(nil))
+	req := newReq()
+	dump, err := ctx.DumpRequest(req, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(dump), "1: \"hello\"") {
+		t.Fatalf("schema-less dump missing tree:\n%s", dump)
+	}
+	if restored, _ := io.ReadAll(req.Body); !bytes.Equal(restored, payload) {
+		t.Fatal("body not restored after dump")
+	}
+
+	if ctx.ProtoDescriptors, err = LoadProtoDescriptors(writeTestDescriptors(t)); err != nil {
+		t.Fatal(err)
+	}
+	dump, err = ctx.DumpRequest(newReq(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(strings.ReplaceAll(string(dump), " ", ""), `"count":150`) {
+		t.Fatalf("descriptor dump missing field names:\n%s", dump)
+	}
+}
+
+func TestDumpGrpcStream(t *testing.T) {
+	// A streaming call whose body never reaches EOF
+	body, w := io.Pipe()
+	defer w.Close()
+
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com/test.Echo/Say", body)
+	req.Header.Set("Content-Type", "application/grpc")
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		ProtoMajor: 2,
+		Header:     http.Header{"Content-Type": {"application/grpc"}},
+		Body:       body,
+		Request:    req,
+	}
+
+	ctx := NewContext(ctxLogger, "test", NewConfig(nil))
+	done := make(chan error, 1)
+	go func() {
+		dump, err := ctx.DumpRequest(req, true)
+		if err == nil && !bytes.Contains(dump, []byte("application/grpc")) {
+			err = fmt.Errorf("request headers missing from dump:\n%s", dump)
+		}
+		if err == nil {
+			_, err = ctx.DumpResponse(resp, true)
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dump blocked on a gRPC stream")
+	}
+	if req.Body != body || resp.Body != body {
+		t.Error("gRPC body replaced by the dump")
+	}
+}
@@ -0,0 +1,264 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// proxyV2Signature is the fixed 12-byte prefix of a PROXY protocol v2 header.
+// proxyV2Signature 是 PROXY protocol v2 头部固定的 12 字节前缀。
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol limits and codes as defined by the HAProxy specification.
+// HAProxy 规范中定义的 PROXY protocol 长度限制与编码。
+const (
+	proxyV1MaxLen = 107
+
+	proxyV2CmdLocal = 0x00
+	proxyV2CmdProxy = 0x01
+
+	proxyV2FamTCP4 = 0x11
+	proxyV2FamUDP4 = 0x12
+	proxyV2FamTCP6 = 0x21
+	proxyV2FamUDP6 = 0x22
+)
+
+// ErrNoProxyHeader is returned when a connection that must carry a PROXY
+// protocol header starts with something else.
+// ErrNoProxyHeader 表示要求携带 PROXY protocol 头部的连接未以该头部开头。
+var ErrNoProxyHeader = errors.New("missing PROXY protocol header")
+
+// ProxyHeader holds the addresses carried by a PROXY protocol header.
+// Source and Destination are nil for LOCAL (v2) or UNKNOWN (v1) headers,
+// which load balancers use for health checks.
+// ProxyHeader 保存 PROXY protocol 头部携带的地址信息。
+// 对于负载均衡器健康检查使用的 LOCAL（v2）或 UNKNOWN（v1）头部，
+// Source 与 Destination 为 nil。
+type ProxyHeader struct {
+	Version     int      // 协议版本，1 或 2
+	Source      net.Addr // 原始客户端地址
+	Destination net.Addr // 原始目标地址
+}
+
+// ReadProxyHeader reads and consumes a PROXY protocol v1 or v2 header from conn.
+// ReadProxyHeader 从 conn 中读取并消费 PROXY protocol v1 或 v2 头部。
+func ReadProxyHeader(conn *Conn) (*ProxyHeader, error) {
+	raw, err := conn.Peek(5)
+	switch {
+	case bytes.Equal(raw, []byte("PROXY")):
+		return readProxyHeaderV1(conn)
+	case bytes.Equal(raw, proxyV2Signature[:5]):
+		raw, err = conn.Peek(len(proxyV2Signature))
+		if !bytes.Equal(raw, proxyV2Signature) {
+			if err != nil {
+				return nil, err
+			}
+			return nil, ErrNoProxyHeader
+		}
+		return readProxyHeaderV2(conn)
+	case err != nil:
+		return nil, err
+	default:
+		return nil, ErrNoProxyHeader
+	}
+}
+
+// readProxyHeaderV1 parses the text form, e.g.
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+// readProxyHeaderV1 解析文本格式的头部。
+func readProxyHeaderV1(r io.Reader) (*ProxyHeader, error) {
+	line := make([]byte, 0, proxyV1MaxLen)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, errors.New("PROXY v1 header too long") // PROXY v1 头部过长
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Fields(string(line))
+	header := &ProxyHeader{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return header, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header: %q", line)
+	}
+
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, srcErr := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, dstErr := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || srcErr != nil || dstErr != nil {
+		return nil, fmt.Errorf("malformed PROXY v1 header: %q", line)
+	}
+
+	header.Source = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	header.Destination = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return header, nil
+}
+
+// readProxyHeaderV2 parses the binary form. TLVs are skipped.
+// readProxyHeaderV2 解析二进制格式的头部，忽略 TLV 扩展字段。
+func readProxyHeaderV2(r io.Reader) (*ProxyHeader, error) {
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	if buf[12]>>4 != 0x02 {
+		return nil, errors.New("unsupported PROXY v2 version") // 不支持的 PROXY v2 版本
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(buf[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	header := &ProxyHeader{Version: 2}
+	switch buf[12] & 0x0F {
+	case proxyV2CmdLocal:
+		return header, nil
+	case proxyV2CmdProxy:
+	default:
+		return nil, errors.New("unsupported PROXY v2 command") // 不支持的 PROXY v2 命令
+	}
+
+	var ipLen int
+	switch buf[13] {
+	case proxyV2FamTCP4, proxyV2FamUDP4:
+		ipLen = net.IPv4len
+	case proxyV2FamTCP6, proxyV2FamUDP6:
+		ipLen = net.IPv6len
+	default:
+		// Unix sockets and unspecified families carry no usable address
+		// Unix 套接字与未指定的地址族不携带可用的地址信息
+		return header, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, errors.New("short PROXY v2 address block") // PROXY v2 地址块过短
+	}
+
+	srcIP := net.IP(payload[:ipLen])
+	dstIP := net.IP(payload[ipLen : 2*ipLen])
+	srcPort := int(binary.BigEndian.Uint16(payload[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(payload[2*ipLen+2:]))
+	if buf[13]&0x0F == 0x02 {
+		header.Source = &net.UDPAddr{IP: srcIP, Port: srcPort}
+		header.Destination = &net.UDPAddr{IP: dstIP, Port: dstPort}
+	} else {
+		header.Source = &net.TCPAddr{IP: srcIP, Port: srcPort}
+		header.Destination = &net.TCPAddr{IP: dstIP, Port: dstPort}
+	}
+	return header, nil
+}
+
+// Format encodes the header in the given PROXY protocol version (1 or 2).
+// A header without addresses is encoded as UNKNOWN (v1) or LOCAL (v2).
+// Format 将头部编码为指定版本（1 或 2）的 PROXY protocol 格式，
+// 不含地址的头部会编码为 UNKNOWN（v1）或 LOCAL（v2）。
+func (h *ProxyHeader) Format(version int) ([]byte, error) {
+	src, srcOK := h.Source.(*net.TCPAddr)
+	dst, dstOK := h.Destination.(*net.TCPAddr)
+	known := srcOK && dstOK && src != nil && dst != nil
+
+	var srcIP, dstIP net.IP
+	ipv4 := false
+	if known {
+		srcIP, dstIP = src.IP.To4(), dst.IP.To4()
+		ipv4 = srcIP != nil && dstIP != nil
+		if !ipv4 {
+			// Mixed families are sent as IPv6, with IPv4 addresses mapped
+			// 地址族不一致时统一以 IPv6 发送，IPv4 地址使用映射形式
+			srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+		}
+	}
+
+	switch version {
+	case 1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		if ipv4 {
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n",
+				srcIP, dstIP, src.Port, dst.Port)), nil
+		}
+		return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n",
+			proxyV1IPv6(srcIP), proxyV1IPv6(dstIP), src.Port, dst.Port)), nil
+
+	case 2:
+		b := append([]byte(nil), proxyV2Signature...)
+		if !known {
+			return append(b, 0x20|proxyV2CmdLocal, 0x00, 0x00, 0x00), nil
+		}
+
+		fam := byte(proxyV2FamTCP6)
+		if ipv4 {
+			fam = proxyV2FamTCP4
+		}
+		addrs := append(append([]byte(nil), srcIP...), dstIP...)
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(src.Port))
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(dst.Port))
+
+		b = append(b, 0x20|proxyV2CmdProxy, fam)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(addrs)))
+		return append(b, addrs...), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+}
+
+// proxyV1IPv6 formats ip in IPv6 notation, spelling IPv4 addresses in their
+// mapped form since net.IP.String would print them as dotted quads.
+// proxyV1IPv6 以 IPv6 形式输出地址，IPv4 地址使用映射形式表示。
+func proxyV1IPv6(ip net.IP) string {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return "::ffff:" + ipv4.String()
+	}
+	return ip.String()
+}
+
+// writeProxyHeader emits a PROXY protocol header describing the session of
+// ctx on an upstream connection, as configured by Config.SendProxyProtocol.
+// writeProxyHeader 按照 Config.SendProxyProtocol 的配置，
+// 在上游连接上发送描述当前会话的 PROXY protocol 头部。
+func writeProxyHeader(ctx *Context, upstream net.Conn) error {
+	header := &ProxyHeader{Source: ctx.ClientAddr(), Destination: proxyHeaderDestination(ctx, upstream)}
+	raw, err := header.Format(ctx.SendProxyProtocol)
+	if err != nil {
+		return err
+	}
+	_, err = upstream.Write(raw)
+	return err
+}
+
+// proxyHeaderDestination returns the target address of the session of ctx.
+// The remote address of upstream is only used for direct connections, since
+// through a proxy hop it is the hop itself; domain targets are resolved
+// otherwise, and a nil address, sent as UNKNOWN or LOCAL, is returned when
+// that fails.
+// proxyHeaderDestination 返回当前会话的目标地址。上游连接的远端地址仅在直连时使用，
+// 经过代理跳转时它是代理本身的地址；此时解析目标域名，解析失败返回 nil，按 UNKNOWN 或 LOCAL 发送。
+func proxyHeaderDestination(ctx *Context, upstream net.Conn) net.Addr {
+	port, _ := strconv.Atoi(ctx.DstPort)
+	if ip := net.ParseIP(ctx.DstHost); ip != nil {
+		return &net.TCPAddr{IP: ip, Port: port}
+	}
+	if _, direct := ctx.Dialer.(*net.Dialer); direct {
+		return upstream.RemoteAddr()
+	}
+	host, err := lookupHost(ctx, ctx.DstHost)
+	if err != nil {
+		ctx.Debugf("解析 PROXY protocol 目标地址失败：%v", err)
+		return nil
+	}
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: port}
+}
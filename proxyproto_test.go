@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	tests := []struct {
+		name    string
+		version int
+		dst     *net.TCPAddr
+	}{
+		{"v1 ipv4", 1, &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}},
+		{"v1 ipv6", 1, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}},
+		{"v2 ipv4", 2, &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}},
+		{"v2 ipv6", 2, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := (&ProxyHeader{Source: src, Destination: tt.dst}).Format(tt.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			go func() { _, _ = client.Write(append(raw, "hello"...)) }()
+
+			conn := NewConn(server)
+			header, err := ReadProxyHeader(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header.Version != tt.version {
+				t.Fatalf("unexpected version: %d", header.Version)
+			}
+
+			gotSrc := header.Source.(*net.TCPAddr)
+			gotDst := header.Destination.(*net.TCPAddr)
+			if !gotSrc.IP.Equal(src.IP) || gotSrc.Port != src.Port ||
+				!gotDst.IP.Equal(tt.dst.IP) || gotDst.Port != tt.dst.Port {
+				t.Fatalf("unexpected addresses: %s -> %s", gotSrc, gotDst)
+			}
+
+			buf := make([]byte, 5)
+			if _, err = conn.Read(buf); err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != "hello" {
+				t.Fatalf("header over-consumed the stream: %q", buf)
+			}
+		})
+	}
+}
+
+func TestListenerProxyHeader(t *testing.T) {
+	defer func(timeout time.Duration) { proxyHeaderTimeout = timeout }(proxyHeaderTimeout)
+	proxyHeaderTimeout = 100 * time.Millisecond
+
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+	tests := []struct {
+		name    string
+		version int // 0 表示客户端不发送任何数据
+	}{
+		{"v1", 1},
+		{"v2", 2},
+		{"silent client", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := make(chan *ProxyHeader, 1)
+			cfg := NewConfig(nil)
+			cfg.AcceptProxyProtocol = true
+			cfg.Negotiator = HandshakeFn(func(ctx *Context) error {
+				if ctx.ClientAddr() != ctx.ProxyHeader.Source {
+					t.Errorf("ClientAddr() = %s, want the PROXY header source", ctx.ClientAddr())
+				}
+				headers <- ctx.ProxyHeader
+				return io.EOF
+			})
+
+			l, err := Listen("tcp", "127.0.0.1:0", cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			go func() { _ = l.Serve() }()
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if tt.version == 0 {
+				_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+					t.Fatalf("silent client not dropped: %v", err)
+				}
+				return
+			}
+
+			raw, err := (&ProxyHeader{Source: src, Destination: dst}).Format(tt.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = conn.Write(raw); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case header := <-headers:
+				gotSrc := header.Source.(*net.TCPAddr)
+				gotDst := header.Destination.(*net.TCPAddr)
+				if !gotSrc.IP.Equal(src.IP) || gotSrc.Port != src.Port ||
+					!gotDst.IP.Equal(dst.IP) || gotDst.Port != dst.Port {
+					t.Fatalf("unexpected addresses: %s -> %s", gotSrc, gotDst)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("negotiator not reached")
+			}
+		})
+	}
+}
+
+func TestDialerProxyHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		dstHost string
+		hop     bool   // 经过代理跳转拨号
+		wantDst string // 为空表示 LOCAL 头部
+	}{
+		{"direct domain", "localhost", false, "127.0.0.1"},
+		{"proxy hop domain", "example.test", true, "198.51.100.7"},
+		{"proxy hop unresolved", "unknown.test", true, ""},
+		{"proxy hop ip", "203.0.113.9", true, "203.0.113.9"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer upstream.Close()
+			headers := make(chan *ProxyHeader, 1)
+			go func() {
+				conn, err := upstream.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				header, err := ReadProxyHeader(NewConn(conn))
+				if err != nil {
+					t.Error(err)
+				}
+				headers <- header
+			}()
+			_, port, _ := net.SplitHostPort(upstream.Addr().String())
+
+			cfg := NewConfig(nil)
+			cfg.SendProxyProtocol = 2
+			cfg.Resolver = testHostResolver{Resolver: NewResolver(), hosts: map[string]string{"example.test": "198.51.100.7"}}
+			if tt.hop {
+				cfg.Dialer = dialerFn(func(network, addr string) (net.Conn, error) {
+					return net.Dial(network, upstream.Addr().String())
+				})
+			}
+			client, server := net.Pipe()
+			defer client.Close()
+			ctx := NewContext(ctxLogger, "test", cfg)
+			ctx.Conn = NewConn(server)
+			ctx.ProxyHeader = &ProxyHeader{Source: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}}
+			ctx.DstHost, ctx.DstPort = tt.dstHost, port
+
+			conn, err := dialTarget(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			header := <-headers
+			if tt.wantDst == "" {
+				if header == nil || header.Source != nil || header.Destination != nil {
+					t.Fatalf("want a LOCAL header, got %+v", header)
+				}
+				return
+			}
+			gotSrc := header.Source.(*net.TCPAddr)
+			gotDst := header.Destination.(*net.TCPAddr)
+			if gotSrc.String() != "192.0.2.1:56324" || gotDst.String() != net.JoinHostPort(tt.wantDst, port) {
+				t.Fatalf("unexpected addresses: %s -> %s", gotSrc, gotDst)
+			}
+		})
+	}
+}
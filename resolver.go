@@ -1,6 +1,8 @@
 package proxy
 
 import (
+	"context"
+	"net"
 	"sync"
 )
 
@@ -9,6 +11,13 @@ type Resolver interface {
 	GetPTR(string) (string, bool)
 }
 
+// HostResolver is implemented by Resolvers that also resolve host names,
+// which the UDP relay needs as datagrams do not go through Config.Dialer.
+// HostResolver 由同时支持域名解析的 Resolver 实现。UDP 中继需要它，因为数据报不经过 Config.Dialer。
+type HostResolver interface {
+	LookupHost(host string) ([]string, error)
+}
+
 type StdResolver struct {
 	ReverseDNSRecord *sync.Map
 }
@@ -23,8 +32,46 @@ func (r StdResolver) GetPTR(ip string) (string, bool) {
 	return domain, ok && existed
 }
 
+// LookupHost resolves host through net.DefaultResolver and records each
+// address as a PTR of host, so later streams to those addresses are matched
+// back to the name.
+// LookupHost 通过 net.DefaultResolver 解析 host，并将每个地址的反向记录设置为 host，
+// 以便之后发往这些地址的数据流能够对应回该域名。
+func (r StdResolver) LookupHost(host string) ([]string, error) {
+	addrs, err := net.DefaultResolver.LookupHost(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		r.SetPTR(addr, host)
+	}
+	return addrs, nil
+}
+
 func NewResolver() Resolver {
 	return &StdResolver{ReverseDNSRecord: new(sync.Map)}
 }
 
 var defaultResolver = NewResolver()
+
+// lookupHost returns the first address of host, looking host names up
+// through ctx.Resolver when it is a HostResolver, or net.DefaultResolver
+// otherwise. IP addresses are returned as is.
+// lookupHost 返回 host 的第一个地址，ctx.Resolver 实现 HostResolver 时通过其解析域名，
+// 否则使用 net.DefaultResolver，IP 地址原样返回。
+func lookupHost(ctx *Context, host string) (string, error) {
+	if net.ParseIP(host) != nil {
+		return host, nil
+	}
+	var addrs []string
+	var err error
+	if resolver, ok := ctx.Resolver.(HostResolver); ok {
+		addrs, err = resolver.LookupHost(host)
+	} else {
+		addrs, err = net.DefaultResolver.LookupHost(context.Background(), host)
+	}
+	if err != nil {
+		return "", err
+	}
+	return addrs[0], nil
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS4 protocol constants. SOCKS4a extends SOCKS4 by allowing the
+// client to send a hostname after USERID when DSTIP is 0.0.0.x (x != 0).
+// SOCKS4 协议常量。SOCKS4a 在 DSTIP 为 0.0.0.x（x != 0）时，
+// 允许客户端在 USERID 之后附带域名。
+const (
+	socks4Version    = 0x04
+	socks4CmdConnect = 0x01
+
+	socks4Granted  = 0x5A
+	socks4Rejected = 0x5B
+
+	// socks4MaxField bounds the null-terminated USERID and hostname fields.
+	// socks4MaxField 限制以 NULL 结尾的 USERID 与域名字段的最大长度。
+	socks4MaxField = 255
+)
+
+// Socks4Option configures a negotiator created by NewSocks4Negotiator.
+// Socks4Option 用于配置 NewSocks4Negotiator 创建的握手器。
+type Socks4Option func(*socks4Options)
+
+type socks4Options struct {
+	auth Authenticator
+}
+
+// WithSocks4Auth requires the USERID sent by the client to be accepted by
+// auth, called with an empty password as SOCKS4 has none. Accepted IDs are
+// recorded as Context.User; other requests are rejected.
+// WithSocks4Auth 要求客户端发送的 USERID 通过 auth 校验（SOCKS4 没有密码，校验时密码为空），
+// 通过的 USERID 记录到 Context.User，否则拒绝请求。
+func WithSocks4Auth(auth Authenticator) Socks4Option {
+	return func(o *socks4Options) { o.auth = auth }
+}
+
+// Socks4Negotiator handles SOCKS4 and SOCKS4a CONNECT requests without
+// authentication. The USERID sent by the client is only recorded as
+// Context.Socks4UserID.
+// Socks4Negotiator 处理不需要认证的 SOCKS4 与 SOCKS4a CONNECT 请求，
+// 客户端发送的 USERID 仅记录到 Context.Socks4UserID。
+var Socks4Negotiator = NewSocks4Negotiator()
+
+// NewSocks4Negotiator creates a SOCKS4/4a negotiator with the given options.
+// NewSocks4Negotiator 根据传入的选项创建 SOCKS4/4a 握手器。
+func NewSocks4Negotiator(opts ...Socks4Option) HandshakeFn {
+	o := new(socks4Options)
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o.handshake
+}
+
+func (o *socks4Options) handshake(ctx *Context) error {
+	// Read request header: VN CD DSTPORT DSTIP
+	// 读取请求头：VN CD DSTPORT DSTIP
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(ctx.Conn, buf); err != nil {
+		return err
+	}
+
+	// Check SOCKS version
+	// 检查 SOCKS 版本
+	if buf[0] != socks4Version {
+		return errors.New("unsupported version") // 不支持的 SOCKS 版本
+	}
+
+	ctx.Debugf("Parsing SOCKS4 request: VN=0x%02X CD=0x%02X", buf[0], buf[1])
+
+	// Validate request type: 0x01 means CONNECT
+	// 校验请求类型：0x01 表示 CONNECT
+	if buf[1] != socks4CmdConnect {
+		_ = writeSocks4Reply(ctx.Conn, socks4Rejected)
+		return errors.New("unsupported request") // 不支持的请求类型
+	}
+
+	port := strconv.Itoa(int(buf[2])<<8 | int(buf[3]))
+	ip := net.IP(buf[4:8])
+
+	// USERID is NULL terminated
+	// USERID 以 NULL 结尾
+	userID, err := readSocks4String(ctx.Conn)
+	if err != nil {
+		return err
+	}
+
+	host := ip.String()
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		// SOCKS4a: the hostname follows USERID
+		// SOCKS4a：域名紧跟在 USERID 之后
+		host, err = readSocks4String(ctx.Conn)
+		if err != nil {
+			return err
+		}
+		if host == "" {
+			_ = writeSocks4Reply(ctx.Conn, socks4Rejected)
+			return errors.New("empty SOCKS4a hostname") // SOCKS4a 域名为空
+		}
+	}
+
+	ctx.DstHost, ctx.DstPort = host, port
+	ctx.Socks4UserID = userID
+
+	// USERID is free text, it only identifies the user once accepted
+	// USERID 是客户端任意填写的文本，只有通过认证后才作为用户名
+	if o.auth != nil {
+		if !o.auth.Authenticate(ctx, userID, "") {
+			_ = writeSocks4Reply(ctx.Conn, socks4Rejected)
+			return ErrAuthFailed
+		}
+		ctx.User = userID
+	}
+
+	// Send request granted response
+	// 发送请求已授权的响应
+	return writeSocks4Reply(ctx.Conn, socks4Granted)
+}
+
+// writeSocks4Reply writes a SOCKS4 reply with the given status code.
+// DSTPORT and DSTIP are ignored by CONNECT clients and left as zero.
+// writeSocks4Reply 写入指定状态码的 SOCKS4 响应，
+// CONNECT 客户端会忽略 DSTPORT 和 DSTIP，此处填 0。
+func writeSocks4Reply(w io.Writer, status byte) error {
+	_, err := w.Write([]byte{0x00, status, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	return err
+}
+
+// readSocks4String reads a NULL terminated string of at most socks4MaxField
+// bytes. It reads byte by byte so nothing past the terminator is consumed.
+// readSocks4String 读取以 NULL 结尾、最长 socks4MaxField 字节的字符串，
+// 逐字节读取以免多读结束符之后的数据。
+func readSocks4String(r io.Reader) (string, error) {
+	var field []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0x00 {
+			return string(field), nil
+		}
+		if len(field) >= socks4MaxField {
+			return "", errors.New("SOCKS4 field too long") // SOCKS4 字段过长
+		}
+		field = append(field, b[0])
+	}
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestSocks4Handshake(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.Addr().String()
+
+	auth := NewSocks4Negotiator(WithSocks4Auth(AuthenticateFn(func(_ *Context, username, _ string) bool {
+		return username == "bob"
+	})))
+
+	tests := []struct {
+		name       string
+		negotiator HandshakeFn
+		request    []byte
+		wantHost   string
+		wantID     string
+		wantUser   string
+		wantReply  byte
+	}{
+		{"socks4", Socks4Negotiator, []byte{0x04, 0x01, 0x01, 0xBB, 93, 184, 216, 34, 'b', 'o', 'b', 0x00},
+			"93.184.216.34", "bob", "", socks4Granted},
+		{"socks4a", Socks4Negotiator, append([]byte{0x04, 0x01, 0x01, 0xBB, 0, 0, 0, 1, 0x00},
+			append([]byte("example.com"), 0x00)...), "example.com", "", "", socks4Granted},
+		{"authenticated", auth, []byte{0x04, 0x01, 0x01, 0xBB, 93, 184, 216, 34, 'b', 'o', 'b', 0x00},
+			"93.184.216.34", "bob", "bob", socks4Granted},
+		{"rejected", auth, []byte{0x04, 0x01, 0x01, 0xBB, 93, 184, 216, 34, 'e', 'v', 'e', 0x00},
+			"93.184.216.34", "eve", "", socks4Rejected},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			wg.Add(1)
+
+			var ctx *Context
+			var handshakeErr error
+			go func() {
+				defer wg.Done()
+				inner, err := l.Accept()
+				if err != nil {
+					handshakeErr = err
+					return
+				}
+				defer inner.Close()
+
+				ctx = NewContext(ctxLogger, "test", nil)
+				ctx.Conn = NewConn(inner)
+				handshakeErr = tt.negotiator.Handshake(ctx)
+			}()
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err = conn.Write(tt.request); err != nil {
+				t.Fatal(err)
+			}
+			reply := make([]byte, 8)
+			if _, err = io.ReadFull(conn, reply); err != nil {
+				t.Fatal(err)
+			}
+			wg.Wait()
+
+			if (handshakeErr == nil) != (tt.wantReply == socks4Granted) {
+				t.Fatalf("unexpected handshake error: %v", handshakeErr)
+			}
+			if reply[1] != tt.wantReply {
+				t.Fatalf("unexpected reply code: 0x%02X", reply[1])
+			}
+			if ctx.DstHost != tt.wantHost || ctx.DstPort != "443" ||
+				ctx.Socks4UserID != tt.wantID || ctx.User != tt.wantUser {
+				t.Fatalf("unexpected context: id=%q user=%q dst=%s:%s",
+					ctx.Socks4UserID, ctx.User, ctx.DstHost, ctx.DstPort)
+			}
+		})
+	}
+}
@@ -0,0 +1,451 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 protocol constants as defined in RFC 1928 and RFC 1929.
+// RFC 1928 与 RFC 1929 中定义的 SOCKS5 协议常量。
+const (
+	socks5Version     = 0x05
+	socks5AuthVersion = 0x01
+
+	socks5MethodNoAuth       = 0x00
+	socks5MethodUserPass     = 0x02
+	socks5MethodNoAcceptable = 0xFF
+
+	socks5CmdConnect      = 0x01
+	socks5CmdBind         = 0x02
+	socks5CmdUdpAssociate = 0x03
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5AuthSuccess = 0x00
+	socks5AuthFailure = 0x01
+
+	// socks5BindTimeout bounds how long a BIND waits for the peer to connect.
+	// socks5BindTimeout 限定 BIND 等待对端连入的最长时间。
+	socks5BindTimeout = 2 * time.Minute
+
+	socks5RepSucceeded           = 0x00
+	socks5RepGeneralFailure      = 0x01
+	socks5RepNotAllowed          = 0x02
+	socks5RepNetUnreachable      = 0x03
+	socks5RepHostUnreachable     = 0x04
+	socks5RepConnRefused         = 0x05
+	socks5RepTTLExpired          = 0x06
+	socks5RepCmdNotSupported     = 0x07
+	socks5RepAddrTypeUnsupported = 0x08
+)
+
+// Socks5Option configures a negotiator created by NewSocks5Negotiator.
+// Socks5Option 用于配置 NewSocks5Negotiator 创建的握手器。
+type Socks5Option func(*socks5Options)
+
+type socks5Options struct {
+	auth      Authenticator
+	dialFirst bool
+	bind      bool
+	udp       bool
+}
+
+// WithSocks5Auth requires clients to authenticate with a username and password
+// (RFC 1929). Clients that do not offer method 0x02 are rejected.
+// WithSocks5Auth 要求客户端使用用户名/密码认证（RFC 1929），
+// 未提供 0x02 认证方法的客户端会被拒绝。
+func WithSocks5Auth(auth Authenticator) Socks5Option {
+	return func(o *socks5Options) { o.auth = auth }
+}
+
+// WithSocks5DialFirst dials the CONNECT target through Config.Dialer before
+// replying, so that the client receives a REP code reflecting the real dial
+// outcome and the actual local bind address. The established connection is
+// handed on to the handlers as Context.DstConn.
+// WithSocks5DialFirst 在响应 CONNECT 之前先通过 Config.Dialer 拨号目标地址，
+// 使客户端收到反映真实拨号结果的 REP 状态码和实际的本地绑定地址，
+// 建立的连接会作为 Context.DstConn 交给后续处理器。
+func WithSocks5DialFirst() Socks5Option {
+	return func(o *socks5Options) { o.dialFirst = true }
+}
+
+// WithSocks5Bind enables the BIND command used by reverse-connect protocols
+// such as active-mode FTP. The accepted peer connection is relayed through
+// Config.TcpHandler without protocol detection.
+// WithSocks5Bind 启用 BIND 命令，用于主动模式 FTP 等反向连接协议，
+// 对端连入后不经协议识别，直接交由 Config.TcpHandler 中继。
+func WithSocks5Bind() Socks5Option {
+	return func(o *socks5Options) { o.bind = true }
+}
+
+// WithSocks5Udp enables the UDP ASSOCIATE command. Each association binds a
+// UDP relay socket that lives as long as the TCP control connection, and its
+// datagrams are handled by Config.UdpHandler. Associations are refused when
+// Config.Dialer goes through an upstream proxy, i.e. is not a *net.Dialer.
+// WithSocks5Udp 启用 UDP ASSOCIATE 命令。每个关联会绑定一个 UDP 中继套接字，
+// 其生命周期与 TCP 控制连接一致，数据报由 Config.UdpHandler 处理。
+// Config.Dialer 经上游代理转发（即不是 *net.Dialer）时拒绝建立关联。
+func WithSocks5Udp() Socks5Option {
+	return func(o *socks5Options) { o.udp = true }
+}
+
+// NewSocks5Negotiator creates a SOCKS5 negotiator with the given options.
+// NewSocks5Negotiator 根据传入的选项创建 SOCKS5 握手器。
+func NewSocks5Negotiator(opts ...Socks5Option) HandshakeFn {
+	o := new(socks5Options)
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return func(ctx *Context) error {
+		if err := o.selectMethod(ctx); err != nil {
+			return err
+		}
+
+		// Read connection request header
+		// 读取连接请求头
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(ctx.Conn, buf); err != nil {
+			return err
+		}
+
+		// Logging version and command
+		// 日志记录版本和命令字段
+		ctx.Debugf("Parsing SOCKS5 request: VER=0x%02X CMD=0x%02X", buf[0], buf[1])
+
+		if buf[0] != socks5Version {
+			return errors.New("unsupported version") // 不支持的 SOCKS 版本
+		}
+
+		host, port, err := readSocks5Addr(ctx.Conn, buf[3])
+		if err != nil {
+			// Only an unknown ATYP gets a reply, I/O errors just close the connection
+			// 仅对未知的 ATYP 返回响应，I/O 错误直接关闭连接
+			if errors.Is(err, errSocks5AddrType) {
+				_ = writeSocks5Reply(ctx.Conn, socks5RepAddrTypeUnsupported, nil)
+			}
+			return err
+		}
+		ctx.DstHost, ctx.DstPort = host, port
+
+		switch {
+		case buf[1] == socks5CmdConnect && o.dialFirst:
+			return socks5Connect(ctx)
+
+		case buf[1] == socks5CmdConnect:
+			// Send success response
+			// 发送连接成功的响应
+			_ = writeSocks5Reply(ctx.Conn, socks5RepSucceeded, nil)
+			return nil
+
+		case buf[1] == socks5CmdBind && o.bind:
+			return socks5Bind(ctx)
+
+		case buf[1] == socks5CmdUdpAssociate && o.udp:
+			return socks5UdpAssociate(ctx)
+
+		default:
+			_ = writeSocks5Reply(ctx.Conn, socks5RepCmdNotSupported, nil)
+			return errors.New("unsupported request") // 不支持的请求类型
+		}
+	}
+}
+
+// socks5Connect dials the CONNECT target and replies with the REP code matching
+// the dial outcome.
+// socks5Connect 拨号 CONNECT 目标地址，并根据拨号结果返回对应的 REP 状态码。
+func socks5Connect(ctx *Context) error {
+	conn, err := dialTarget(ctx)
+	if err != nil {
+		_ = writeSocks5Reply(ctx.Conn, socks5DialRep(err), nil)
+		return err
+	}
+
+	if err = writeSocks5Reply(ctx.Conn, socks5RepSucceeded, conn.LocalAddr()); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	ctx.DstConn = conn
+	return nil
+}
+
+// socks5DialRep maps a dial error to the closest RFC 1928 REP code.
+// socks5DialRep 将拨号错误映射为最接近的 RFC 1928 REP 状态码。
+func socks5DialRep(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case IsConnRefused(err):
+		return socks5RepConnRefused
+	case IsHostUnreachable(err), errors.As(err, &dnsErr):
+		return socks5RepHostUnreachable
+	case IsNetUnreachable(err):
+		return socks5RepNetUnreachable
+	case IsTimeout(err):
+		return socks5RepTTLExpired
+	default:
+		return socks5RepGeneralFailure
+	}
+}
+
+// socks5Bind opens a listening socket next to the TCP control connection and sends
+// the two BIND replies of RFC 1928: first the bound address, then the address
+// of the peer that connected to it.
+// socks5Bind 在 TCP 控制连接所在地址上打开监听套接字，并按照 RFC 1928 发送两次 BIND
+// 响应：第一次为监听地址，第二次为连入的对端地址。
+func socks5Bind(ctx *Context) error {
+	local, ok := ctx.Conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		_ = writeSocks5Reply(ctx.Conn, socks5RepGeneralFailure, nil)
+		return errors.New("unsupported control connection") // 不支持的控制连接类型
+	}
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		_ = writeSocks5Reply(ctx.Conn, socks5RepGeneralFailure, nil)
+		return err
+	}
+	defer ln.Close()
+
+	if err = writeSocks5Reply(ctx.Conn, socks5RepSucceeded, ln.Addr()); err != nil {
+		return err
+	}
+	ctx.Debugf("SOCKS5 BIND listening on %s", ln.Addr())
+
+	_ = ln.SetDeadline(time.Now().Add(socks5BindTimeout))
+	peer, err := ln.AcceptTCP()
+	if err != nil {
+		_ = writeSocks5Reply(ctx.Conn, socks5RepGeneralFailure, nil)
+		return err
+	}
+
+	// DST.ADDR names the application server expected to connect back
+	// DST.ADDR 指明预期回连的应用服务器地址
+	remote := peer.RemoteAddr().(*net.TCPAddr)
+	if expected := net.ParseIP(ctx.DstHost); expected != nil &&
+		!expected.IsUnspecified() && !expected.Equal(remote.IP) {
+		_ = peer.Close()
+		_ = writeSocks5Reply(ctx.Conn, socks5RepNotAllowed, nil)
+		return errors.New("unexpected BIND peer " + remote.String()) // BIND 对端地址不符
+	}
+
+	if err = writeSocks5Reply(ctx.Conn, socks5RepSucceeded, remote); err != nil {
+		_ = peer.Close()
+		return err
+	}
+
+	ctx.DstHost, ctx.DstPort = remote.IP.String(), strconv.Itoa(remote.Port)
+	ctx.DstConn = peer
+	ctx.Passthrough = true
+	return nil
+}
+
+// socks5UdpAssociate binds the UDP relay socket on the wildcard address, so it can
+// reach remote peers whatever interface the client came in on, and tells the
+// client to send its datagrams to the address of the TCP control connection.
+// Datagrams cannot be relayed through an upstream proxy, so the command is
+// refused unless Config.Dialer is a *net.Dialer.
+// socks5UdpAssociate 在通配地址上绑定 UDP 中继套接字，使其无论客户端从哪个网卡接入都能访问远端，
+// 并告知客户端将数据报发送到 TCP 控制连接所在的地址。数据报无法经上游代理转发，
+// 因此 Config.Dialer 不是 *net.Dialer 时拒绝该命令。
+func socks5UdpAssociate(ctx *Context) error {
+	local, ok := ctx.Conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		_ = writeSocks5Reply(ctx.Conn, socks5RepGeneralFailure, nil)
+		return errors.New("unsupported control connection") // 不支持的控制连接类型
+	}
+	if _, ok = ctx.Dialer.(*net.Dialer); !ok {
+		_ = writeSocks5Reply(ctx.Conn, socks5RepCmdNotSupported, nil)
+		return errors.New("UDP ASSOCIATE is not supported through an upstream proxy") // 无法经上游代理中继 UDP
+	}
+
+	relay, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		_ = writeSocks5Reply(ctx.Conn, socks5RepGeneralFailure, nil)
+		return err
+	}
+
+	bound := &net.UDPAddr{IP: local.IP, Port: relay.LocalAddr().(*net.UDPAddr).Port, Zone: local.Zone}
+	if err = writeSocks5Reply(ctx.Conn, socks5RepSucceeded, bound); err != nil {
+		_ = relay.Close()
+		return err
+	}
+
+	ctx.Debugf("SOCKS5 UDP relay bound on %s", bound)
+	ctx.UdpConn = relay
+	return nil
+}
+
+// selectMethod performs the method selection sub-negotiation and, when an
+// Authenticator is configured, the username/password sub-negotiation.
+// selectMethod 执行认证方法协商，如果配置了认证器则继续执行用户名/密码认证。
+func (o *socks5Options) selectMethod(ctx *Context) error {
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(ctx.Conn, buf); err != nil {
+		return err
+	}
+
+	// Check SOCKS version
+	// 检查 SOCKS 版本
+	if buf[0] != socks5Version {
+		return errors.New("unsupported version") // 不支持的 SOCKS 版本
+	}
+
+	// Read supported authentication methods
+	// 读取客户端支持的认证方法
+	methods := make([]byte, buf[1])
+	if _, err := io.ReadFull(ctx.Conn, methods); err != nil {
+		return err
+	}
+
+	if o.auth == nil {
+		// Send method selection response (no auth)
+		// 回复选择的认证方法（0x00 表示不需要认证）
+		_, err := ctx.Conn.Write([]byte{socks5Version, socks5MethodNoAuth})
+		return err
+	}
+
+	offered := false
+	for _, method := range methods {
+		if method == socks5MethodUserPass {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		// No acceptable methods, the client must close the connection
+		// 没有可接受的认证方法，客户端应关闭连接
+		_, _ = ctx.Conn.Write([]byte{socks5Version, socks5MethodNoAcceptable})
+		return errors.New("no acceptable authentication methods")
+	}
+
+	if _, err := ctx.Conn.Write([]byte{socks5Version, socks5MethodUserPass}); err != nil {
+		return err
+	}
+
+	// Username/password request: VER ULEN UNAME PLEN PASSWD
+	// 用户名/密码认证请求：VER ULEN UNAME PLEN PASSWD
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(ctx.Conn, header); err != nil {
+		return err
+	}
+	if header[0] != socks5AuthVersion {
+		return errors.New("unsupported auth version") // 不支持的认证版本
+	}
+
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(ctx.Conn, username); err != nil {
+		return err
+	}
+
+	pLen := make([]byte, 1)
+	if _, err := io.ReadFull(ctx.Conn, pLen); err != nil {
+		return err
+	}
+
+	password := make([]byte, pLen[0])
+	if _, err := io.ReadFull(ctx.Conn, password); err != nil {
+		return err
+	}
+
+	if !o.auth.Authenticate(ctx, string(username), string(password)) {
+		_, _ = ctx.Conn.Write([]byte{socks5AuthVersion, socks5AuthFailure})
+		ctx.Warnf("SOCKS5 authentication failed for user %q", username)
+		return ErrAuthFailed
+	}
+
+	if _, err := ctx.Conn.Write([]byte{socks5AuthVersion, socks5AuthSuccess}); err != nil {
+		return err
+	}
+	ctx.User = string(username)
+	return nil
+}
+
+var errSocks5AddrType = errors.New("unsupported address type") // 不支持的地址类型
+
+// readSocks5Addr reads a DST.ADDR/DST.PORT pair of the given address type.
+// readSocks5Addr 根据地址类型读取 DST.ADDR 和 DST.PORT。
+func readSocks5Addr(r io.Reader, atyp byte) (string, string, error) {
+	var host string
+	switch atyp {
+	case socks5AtypIPv4: // IPv4 address
+		ipv4 := make([]byte, 4)
+		if _, err := io.ReadFull(r, ipv4); err != nil {
+			return "", "", err
+		}
+		host = net.IP(ipv4).String()
+
+	case socks5AtypDomain: // Domain name
+		aLen := make([]byte, 1)
+		if _, err := io.ReadFull(r, aLen); err != nil {
+			return "", "", err
+		}
+
+		domain := make([]byte, aLen[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", "", err
+		}
+		host = string(domain)
+
+	case socks5AtypIPv6: // IPv6 address
+		ipv6 := make([]byte, 16)
+		if _, err := io.ReadFull(r, ipv6); err != nil {
+			return "", "", err
+		}
+		host = net.IP(ipv6).String()
+
+	default:
+		return "", "", errSocks5AddrType
+	}
+
+	// Read destination port (2 bytes)
+	// 读取目标端口（2 字节）
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", "", err
+	}
+	return host, strconv.Itoa(int(port[0])<<8 | int(port[1])), nil
+}
+
+// writeSocks5Reply writes a SOCKS5 reply with the given REP code. A nil addr
+// is encoded as the IPv4 wildcard address 0.0.0.0:0.
+// writeSocks5Reply 写入指定 REP 状态码的 SOCKS5 响应，addr 为 nil 时写入 0.0.0.0:0。
+func writeSocks5Reply(w io.Writer, rep byte, addr net.Addr) error {
+	reply := []byte{socks5Version, rep, 0x00}
+	reply = append(reply, socks5AddrBytes(addr)...)
+	_, err := w.Write(reply)
+	return err
+}
+
+// socks5AddrBytes encodes addr as ATYP, BND.ADDR and BND.PORT.
+// socks5AddrBytes 将 addr 编码为 ATYP、BND.ADDR 与 BND.PORT。
+func socks5AddrBytes(addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	var b []byte
+	if ipv4 := ip.To4(); ipv4 != nil || ip == nil {
+		if ipv4 == nil {
+			ipv4 = net.IPv4zero.To4()
+		}
+		b = append([]byte{socks5AtypIPv4}, ipv4...)
+	} else {
+		b = append([]byte{socks5AtypIPv6}, ip.To16()...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+// Socks5Negotiator handles SOCKS5 protocol negotiation as per RFC 1928
+// without authentication.
+// Socks5Negotiator 按照 RFC 1928 实现 SOCKS5 协议握手（无认证）。
+var Socks5Negotiator = NewSocks5Negotiator()
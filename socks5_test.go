@@ -0,0 +1,476 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+func TestSocks5Auth(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.Addr().String()
+
+	negotiator := NewSocks5Negotiator(WithSocks5Auth(StaticAuthenticator{"alice": "secret"}))
+
+	tests := []struct {
+		name    string
+		auth    *proxy.Auth
+		wantErr bool
+	}{
+		{"valid", &proxy.Auth{User: "alice", Password: "secret"}, false},
+		{"wrong password", &proxy.Auth{User: "alice", Password: "wrong"}, true},
+		{"no auth", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			wg.Add(1)
+
+			var ctx *Context
+			var handshakeErr error
+			go func() {
+				defer wg.Done()
+				inner, err := l.Accept()
+				if err != nil {
+					handshakeErr = err
+					return
+				}
+				defer inner.Close()
+
+				ctx = NewContext(ctxLogger, "test", nil)
+				ctx.Conn = NewConn(inner)
+				handshakeErr = negotiator.Handshake(ctx)
+			}()
+
+			dialer, err := proxy.SOCKS5("tcp", addr, tt.auth, proxy.Direct)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := dialer.Dial("tcp", "example.com:443")
+			if conn != nil {
+				conn.Close()
+			}
+			wg.Wait()
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dial error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (handshakeErr != nil) != tt.wantErr {
+				t.Fatalf("handshake error = %v, wantErr %v", handshakeErr, tt.wantErr)
+			}
+			if !tt.wantErr {
+				if ctx.User != "alice" || ctx.DstHost != "example.com" || ctx.DstPort != "443" {
+					t.Fatalf("unexpected context: user=%q dst=%s:%s", ctx.User, ctx.DstHost, ctx.DstPort)
+				}
+			}
+		})
+	}
+}
+
+func TestSocks5UdpAssociate(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	cfg := NewConfig(nil)
+	cfg.Negotiator = NewSocks5Negotiator(WithSocks5Udp())
+	cfg.Resolver = testHostResolver{Resolver: NewResolver(), hosts: map[string]string{"echo.test": "127.0.0.1"}}
+	cfg.WithUdpMatcher(UdpPortIs(strconv.Itoa(echo.LocalAddr().(*net.UDPAddr).Port))).
+		Handle(func(dgram *Datagram, ctx *Context) *Datagram {
+			if dgram.Outbound {
+				dgram.Payload = bytes.ToUpper(dgram.Payload)
+			}
+			return dgram
+		})
+
+	l, err := Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() { _ = l.Serve() }()
+
+	ctrl, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+
+	if _, err = ctrl.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	if _, err = io.ReadFull(ctrl, method); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ctrl.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err = io.ReadFull(ctrl, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socks5RepSucceeded {
+		t.Fatalf("unexpected reply code: 0x%02X", reply[1])
+	}
+	relayAddr := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])}
+
+	client, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	header, err := buildSocks5UdpHeader(echoAddr.IP.String(), strconv.Itoa(echoAddr.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Write(append(header, "hello"...)); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, payload, err := parseSocks5UdpHeader(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if net.JoinHostPort(host, port) != echoAddr.String() || string(payload) != "HELLO" {
+		t.Fatalf("unexpected datagram from %s:%s: %q", host, port, payload)
+	}
+
+	// Host names are resolved through Config.Resolver
+	header, err = buildSocks5UdpHeader("echo.test", strconv.Itoa(echoAddr.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Write(append(header, "world"...)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err = client.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, payload, err = parseSocks5UdpHeader(buf[:n]); err != nil || string(payload) != "WORLD" {
+		t.Fatalf("unexpected datagram %q, %v", payload, err)
+	}
+}
+
+// testHostResolver resolves the host names in hosts.
+type testHostResolver struct {
+	Resolver
+	hosts map[string]string
+}
+
+func (r testHostResolver) LookupHost(host string) ([]string, error) {
+	if addr, ok := r.hosts[host]; ok {
+		return []string{addr}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestSocks5UdpAssociateUpstreamProxy(t *testing.T) {
+	cfg := NewConfig(nil)
+	cfg.Negotiator = NewSocks5Negotiator(WithSocks5Udp())
+	cfg.Dialer = dialerFn(func(network, addr string) (net.Conn, error) {
+		return nil, net.ErrClosed
+	})
+
+	l, err := Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() { _ = l.Serve() }()
+
+	ctrl, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	if _, err = ctrl.Write([]byte{0x05, 0x01, 0x00, 0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 12)
+	if _, err = io.ReadFull(ctrl, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[3] != socks5RepCmdNotSupported {
+		t.Fatalf("unexpected reply code: 0x%02X", reply[3])
+	}
+}
+
+func TestSocks5Bind(t *testing.T) {
+	cfg := NewConfig(nil)
+	cfg.Negotiator = NewSocks5Negotiator(WithSocks5Bind())
+
+	l, err := Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() { _ = l.Serve() }()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if _, err = client.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	if _, err = io.ReadFull(client, method); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Write([]byte{0x05, 0x02, 0x00, 0x01, 127, 0, 0, 1, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := make([]byte, 10)
+	if _, err = io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != socks5RepSucceeded {
+		t.Fatalf("unexpected first reply code: 0x%02X", reply[1])
+	}
+	bound := &net.TCPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])}
+
+	peer, err := net.DialTCP("tcp", nil, bound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	if _, err = io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	peerPort := int(reply[8])<<8 | int(reply[9])
+	if reply[1] != socks5RepSucceeded || peerPort != peer.LocalAddr().(*net.TCPAddr).Port {
+		t.Fatalf("unexpected second reply: %v", reply)
+	}
+
+	if _, err = peer.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(client, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("unexpected data from peer: %q", buf)
+	}
+}
+
+func TestSocks5DialFirst(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().(*net.TCPAddr)
+	closed.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.Addr().String()
+
+	cfg := NewConfig(nil)
+	negotiator := NewSocks5Negotiator(WithSocks5DialFirst())
+
+	tests := []struct {
+		name    string
+		target  *net.TCPAddr
+		wantRep byte
+	}{
+		{"succeeded", target.Addr().(*net.TCPAddr), socks5RepSucceeded},
+		{"refused", closedAddr, socks5RepConnRefused},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			wg.Add(1)
+
+			var ctx *Context
+			go func() {
+				defer wg.Done()
+				inner, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer inner.Close()
+
+				ctx = NewContext(ctxLogger, "test", cfg)
+				ctx.Conn = NewConn(inner)
+				_ = negotiator.Handshake(ctx)
+				if ctx.DstConn != nil {
+					ctx.DstConn.Close()
+				}
+			}()
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			request := []byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x01}
+			request = append(request, tt.target.IP.To4()...)
+			request = append(request, byte(tt.target.Port>>8), byte(tt.target.Port))
+			if _, err = conn.Write(request); err != nil {
+				t.Fatal(err)
+			}
+
+			reply := make([]byte, 12)
+			if _, err = io.ReadFull(conn, reply); err != nil {
+				t.Fatal(err)
+			}
+			wg.Wait()
+
+			if reply[3] != tt.wantRep {
+				t.Fatalf("unexpected reply code: 0x%02X", reply[3])
+			}
+			if tt.wantRep == socks5RepSucceeded && (ctx.DstConn == nil || int(reply[10])<<8|int(reply[11]) == 0) {
+				t.Fatalf("missing bind address or upstream connection: %v", reply)
+			}
+		})
+	}
+}
+
+func TestUdpRemotes(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name  string
+		setup func(r udpRemotes)
+		addr  string
+		want  bool
+	}{
+		{"recent", func(r udpRemotes) { r.add("192.0.2.1:53", now.Add(-time.Minute)) }, "192.0.2.1:53", true},
+		{"idle", func(r udpRemotes) { r.add("192.0.2.1:53", now.Add(-udpRemoteTimeout-time.Second)) }, "192.0.2.1:53", false},
+		{"never sent", func(r udpRemotes) { r.add("192.0.2.1:53", now) }, "192.0.2.2:53", false},
+		{"evicted when full", func(r udpRemotes) {
+			r.add("192.0.2.1:53", now.Add(-time.Minute))
+			for i := range udpMaxRemotes {
+				r.add(net.JoinHostPort("198.51.100.1", strconv.Itoa(i)), now)
+			}
+		}, "192.0.2.1:53", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := make(udpRemotes)
+			tt.setup(r)
+			if got := r.known(tt.addr, now); got != tt.want {
+				t.Errorf("known(%s) = %v, want %v", tt.addr, got, tt.want)
+			}
+			if len(r) > udpMaxRemotes {
+				t.Errorf("tracking %d remotes, cap is %d", len(r), udpMaxRemotes)
+			}
+		})
+	}
+}
+
+func TestSocks5AddrError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	tests := []struct {
+		name      string
+		request   []byte
+		wantReply []byte // nil 表示不应返回响应
+	}{
+		{"unknown atyp", []byte{socks5Version, socks5CmdConnect, 0x00, 0x05}, []byte{socks5Version, socks5RepAddrTypeUnsupported}},
+		{"truncated address", []byte{socks5Version, socks5CmdConnect, 0x00, socks5AtypIPv4, 127}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done := make(chan error, 1)
+			go func() {
+				inner, err := l.Accept()
+				if err != nil {
+					done <- err
+					return
+				}
+				defer inner.Close()
+				ctx := NewContext(ctxLogger, "test", nil)
+				ctx.Conn = NewConn(inner)
+				done <- NewSocks5Negotiator().Handshake(ctx)
+			}()
+
+			client, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+			// No authentication, then the request, then half-close
+			if _, err = client.Write([]byte{socks5Version, 0x01, 0x00}); err != nil {
+				t.Fatal(err)
+			}
+			method := make([]byte, 2)
+			if _, err = io.ReadFull(client, method); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = client.Write(tt.request); err != nil {
+				t.Fatal(err)
+			}
+			_ = client.(*net.TCPConn).CloseWrite()
+
+			reply, err := io.ReadAll(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = <-done; err == nil {
+				t.Fatal("handshake succeeded")
+			}
+			if tt.wantReply == nil && len(reply) != 0 {
+				t.Fatalf("unexpected reply %x", reply)
+			}
+			if tt.wantReply != nil && !bytes.HasPrefix(reply, tt.wantReply) {
+				t.Fatalf("reply = %x, want prefix %x", reply, tt.wantReply)
+			}
+		})
+	}
+}
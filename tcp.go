@@ -1,7 +1,6 @@
 package proxy
 
 import (
-	"crypto/tls"
 	"io"
 	"net"
 	"sync"
@@ -16,18 +15,13 @@ type HandleTcpFn func(*Context) error
 func (f HandleTcpFn) HandleTcp(ctx *Context) error { return f(ctx) }
 
 var defaultTcpHandler HandleTcpFn = func(ctx *Context) error {
-	proxyAddr := net.JoinHostPort(ctx.DstHost, ctx.DstPort)
-	proxyConn, err := ctx.Dialer.Dial("tcp", proxyAddr)
+	proxyConn, err := dialUpstream(ctx)
 	if err != nil {
 		ctx.Error(err)
 		return err
 	}
 	defer proxyConn.Close()
 
-	if ctx.Conn.IsTLS() {
-		proxyConn = tls.Client(proxyConn, ctx.ClientTLSConfig)
-	}
-
 	wg := new(sync.WaitGroup)
 	wg.Add(2)
 	go tcpCopy(wg, proxyConn, ctx.Conn, ctx)
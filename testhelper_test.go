@@ -14,3 +14,9 @@ func clientConn(network, addr string) error {
 	_, err = conn.Write([]byte("hello world"))
 	return err
 }
+
+// dialerFn adapts a function to proxy.Dialer, for tests that redirect or
+// refuse upstream dials.
+type dialerFn func(network, addr string) (net.Conn, error)
+
+func (f dialerFn) Dial(network, addr string) (net.Conn, error) { return f(network, addr) }
@@ -1,14 +1,21 @@
 package proxy
 
 import (
+	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"errors"
 	"github.com/elazarl/goproxy"
 	"math/big"
+	"net"
+	"strings"
 	"time"
 )
 
@@ -112,3 +119,259 @@ func From(cert *x509.Certificate, privateKey crypto.PrivateKey) TLSConfigFn {
 		}, nil
 	}
 }
+
+////////////////////////////////////////////////////////////////////////////////
+
+// ContextTLSConfig is implemented by TLSConfigs that need the proxy session,
+// e.g. to reach the upstream server, before forging a certificate. The
+// dispatcher prefers FromContext over From when it is available.
+// ContextTLSConfig 由需要访问代理会话（例如连接上游服务器）才能伪造证书的 TLSConfig 实现，
+// 调度器优先调用 FromContext 而非 From。
+type ContextTLSConfig interface {
+	TLSConfig
+	FromContext(*Context, string) (*tls.Config, error)
+}
+
+// tlsConfigFor returns the server-side tls.Config for serverName.
+// tlsConfigFor 返回 serverName 对应的服务端 tls.Config。
+func tlsConfigFor(ctx *Context, serverName string) (*tls.Config, error) {
+	if cfg, ok := ctx.TLSConfig.(ContextTLSConfig); ok {
+		return cfg.FromContext(ctx, serverName)
+	}
+	return ctx.TLSConfig.From(serverName)
+}
+
+// UpstreamTLSConfig forges leaf certificates that mimic the real upstream
+// certificate. It handshakes with the upstream through Config.Dialer and
+// copies the Subject, DNS and IP SANs, validity window (clamped to the CA's)
+// and key type of the upstream leaf into a certificate signed by the CA. The
+// upstream chain is kept in Context.UpstreamCerts. Forged leaves are cached
+// per server name, so the upstream is only probed when no leaf is cached;
+// Context.UpstreamCerts is only set by a probe.
+// UpstreamTLSConfig 伪造与上游真实证书相仿的服务端证书。它通过 Config.Dialer 与上游握手，
+// 将上游证书的 Subject、DNS 与 IP SAN、有效期（限制在 CA 有效期内）以及密钥类型复制到由 CA 签名的证书中，
+// 上游证书链保存在 Context.UpstreamCerts 中。伪造的证书按服务名称缓存，仅在没有缓存时才会探测上游，
+// 也只有探测时才会设置 Context.UpstreamCerts。
+type UpstreamTLSConfig struct {
+	cert       *x509.Certificate
+	privateKey crypto.PrivateKey
+	cache      *CertCache
+}
+
+// upstreamProbeTimeout bounds the handshake that fetches the upstream
+// certificate, so a silent upstream cannot stall the client's handshake.
+// upstreamProbeTimeout 限制获取上游证书的握手时长，避免无响应的上游阻塞客户端握手。
+var upstreamProbeTimeout = 10 * time.Second
+
+// FromUpstream creates an UpstreamTLSConfig signing with the given CA.
+// FromUpstream 创建使用指定 CA 签名的 UpstreamTLSConfig。
+func FromUpstream(cert *x509.Certificate, privateKey crypto.PrivateKey) *UpstreamTLSConfig {
+	c := &UpstreamTLSConfig{cert: cert, privateKey: privateKey}
+	c.cache = NewCertCache(upstreamProbe{c})
+	return c
+}
+
+// From signs a leaf for san alone, as no upstream is known without a session.
+// From 仅为 san 签发证书，因为没有会话时无法得知上游。
+func (c *UpstreamTLSConfig) From(san string) (*tls.Config, error) {
+	return c.sign(san, nil)
+}
+
+// FromContext handshakes with the upstream of ctx and signs a leaf mimicking
+// its certificate. If the upstream cannot be reached, it falls back to a
+// leaf for san alone.
+// FromContext 与 ctx 的上游握手，并签发仿冒其证书的服务端证书；无法连接上游时回退为仅包含 san 的证书。
+func (c *UpstreamTLSConfig) FromContext(ctx *Context, san string) (*tls.Config, error) {
+	cfg, err := c.cache.FromContext(ctx, san)
+	if err != nil {
+		//回退证书不缓存，下次连接时重新探测上游
+		ctx.Warnf("获取上游证书失败：%v", err)
+		return c.sign(san, nil)
+	}
+	return cfg, nil
+}
+
+// upstreamProbe is the TLSConfig behind the cache of an UpstreamTLSConfig:
+// it fails rather than falling back, so that only mimicking leaves are cached.
+// upstreamProbe 是 UpstreamTLSConfig 缓存背后的 TLSConfig：探测失败时直接返回错误而不回退，
+// 确保只缓存仿冒上游的证书。
+type upstreamProbe struct {
+	c *UpstreamTLSConfig
+}
+
+func (p upstreamProbe) From(san string) (*tls.Config, error) {
+	return nil, errors.New("no upstream without a session") // 没有会话时无法得知上游
+}
+
+func (p upstreamProbe) FromContext(ctx *Context, san string) (*tls.Config, error) {
+	certs, err := fetchUpstreamCerts(ctx, san)
+	if err != nil {
+		return nil, err
+	}
+	ctx.UpstreamCerts = certs
+	return p.c.sign(san, certs[0])
+}
+
+// fetchUpstreamCerts handshakes with the upstream of ctx using
+// ClientTLSConfig and returns the certificate chain it presents. A
+// connection already dialed in ctx.DstConn is used, and kept there as the
+// upstream TLS connection; otherwise a probe connection is dialed and closed.
+// fetchUpstreamCerts 使用 ClientTLSConfig 与 ctx 的上游握手，并返回其证书链。
+// ctx.DstConn 中已有连接时直接使用，握手后的 TLS 连接保存回 ctx.DstConn 作为上游连接；
+// 否则拨号一条探测连接，用完即关闭。
+func fetchUpstreamCerts(ctx *Context, san string) ([]*x509.Certificate, error) {
+	c, cancel := context.WithTimeout(context.Background(), upstreamProbeTimeout)
+	defer cancel()
+
+	conn, reuse := ctx.DstConn, ctx.DstConn != nil
+	if _, ok := conn.(tlsClientConn); ok {
+		return nil, errors.New("upstream connection already uses TLS") // 上游连接已经是 TLS 连接
+	}
+	if !reuse {
+		var err error
+		if conn, err = dialTargetContext(c, ctx); err != nil {
+			return nil, err
+		}
+	}
+	deadline, _ := c.Deadline()
+	_ = conn.SetDeadline(deadline)
+
+	cfg := clientTLSConfig(ctx).Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = san
+	}
+	cfg.NextProtos = nil
+	tlsConn, err := upstreamTLSClient(ctx, conn, cfg)
+	if err == nil {
+		err = tlsConn.HandshakeContext(c)
+	}
+	if err != nil {
+		_ = conn.Close()
+		if reuse {
+			ctx.DstConn = nil
+		}
+		return nil, err
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if reuse {
+		_ = conn.SetDeadline(time.Time{})
+		ctx.DstConn = tlsConn
+	} else {
+		_ = tlsConn.Close()
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("upstream presented no certificate") // 上游未提供证书
+	}
+	return certs, nil
+}
+
+// sign issues a leaf for san, copying the identity of upstream when non-nil.
+// sign 为 san 签发证书，upstream 非 nil 时复制其身份信息。
+func (c *UpstreamTLSConfig) sign(san string, upstream *x509.Certificate) (*tls.Config, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: san},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	algorithm := x509.RSA
+	bits := 2048
+	var curve elliptic.Curve
+	if upstream != nil {
+		template.Subject = upstream.Subject
+		template.Subject.ExtraNames = nil
+		template.DNSNames = append(template.DNSNames, upstream.DNSNames...)
+		template.IPAddresses = append(template.IPAddresses, upstream.IPAddresses...)
+		//有效期不超出 CA 证书的有效期
+		template.NotBefore = upstream.NotBefore
+		if template.NotBefore.Before(c.cert.NotBefore) {
+			template.NotBefore = c.cert.NotBefore
+		}
+		template.NotAfter = upstream.NotAfter
+		if template.NotAfter.After(c.cert.NotAfter) {
+			template.NotAfter = c.cert.NotAfter
+		}
+
+		algorithm = upstream.PublicKeyAlgorithm
+		switch pub := upstream.PublicKey.(type) {
+		case *rsa.PublicKey:
+			bits = pub.N.BitLen()
+		case *ecdsa.PublicKey:
+			curve = pub.Curve
+		}
+	}
+	addSAN(template, san)
+
+	privateKey, err := generateLeafKey(algorithm, bits, curve)
+	if err != nil {
+		return nil, err
+	}
+	if algorithm == x509.RSA {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, c.cert, privateKey.Public(), c.privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{
+			{
+				Certificate: [][]byte{certDER, c.cert.Raw},
+				PrivateKey:  privateKey,
+			},
+		},
+	}, nil
+}
+
+// addSAN adds san to template as a DNS or IP SAN unless already present.
+// addSAN 将 san 作为 DNS 或 IP SAN 添加到 template 中（已存在时跳过）。
+func addSAN(template *x509.Certificate, san string) {
+	if ip := net.ParseIP(san); ip != nil {
+		for _, addr := range template.IPAddresses {
+			if addr.Equal(ip) {
+				return
+			}
+		}
+		template.IPAddresses = append(template.IPAddresses, ip)
+		return
+	}
+	for _, name := range template.DNSNames {
+		if strings.EqualFold(name, san) {
+			return
+		}
+	}
+	template.DNSNames = append(template.DNSNames, san)
+}
+
+// generateLeafKey creates a key of the given algorithm, RSA with bits or
+// ECDSA on curve, defaulting to RSA 2048 for unknown algorithms.
+// generateLeafKey 生成指定算法的私钥（RSA 使用 bits 位，ECDSA 使用 curve 曲线），
+// 未知算法默认使用 RSA 2048。
+func generateLeafKey(algorithm x509.PublicKeyAlgorithm, bits int, curve elliptic.Curve) (crypto.Signer, error) {
+	switch algorithm {
+	case x509.ECDSA:
+		if curve == nil {
+			curve = elliptic.P256()
+		}
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	case x509.Ed25519:
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		return privateKey, err
+	default:
+		if bits < 2048 {
+			bits = 2048
+		}
+		return rsa.GenerateKey(rand.Reader, bits)
+	}
+}
@@ -1,7 +1,20 @@
 package proxy
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestTLS(t *testing.T) {
@@ -26,3 +39,218 @@ func TestTLS(t *testing.T) {
 
 	t.Logf("from: \n%v", tlsCfg)
 }
+
+func TestUpstreamTLSConfig(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Now().Add(48 * time.Hour).Truncate(time.Second).UTC()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "upstream.test", Organization: []string{"Upstream Org"}},
+		DNSNames:     []string{"upstream.test", "*.upstream.test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour).Truncate(time.Second).UTC(),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &ecdsaKey.PublicKey, ecdsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecdsaServer := httptest.NewUnstartedServer(http.NotFoundHandler())
+	ecdsaServer.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: ecdsaKey}}}
+	ecdsaServer.StartTLS()
+	defer ecdsaServer.Close()
+
+	rsaServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer rsaServer.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(Certificate)
+
+	newCtx := func(addr string) *Context {
+		cfg := NewConfig(FromUpstream(Certificate, PrivateKey))
+		cfg.ClientTLSConfig = &tls.Config{InsecureSkipVerify: true}
+		ctx := NewContext(ctxLogger, "test", cfg)
+		ctx.DstHost, ctx.DstPort, _ = net.SplitHostPort(addr)
+		return ctx
+	}
+
+	tests := []struct {
+		name      string
+		addr      string
+		san       string
+		algorithm x509.PublicKeyAlgorithm
+		dnsNames  []string
+		org       string
+		notAfter  time.Time
+		upstream  bool
+	}{
+		{"ecdsa upstream", ecdsaServer.Listener.Addr().String(), "127.0.0.1", x509.ECDSA,
+			[]string{"upstream.test", "*.upstream.test"}, "Upstream Org", notAfter, true},
+		{"rsa upstream", rsaServer.Listener.Addr().String(), "example.com", x509.RSA,
+			[]string{"example.com", "*.example.com"}, "Acme Co", Certificate.NotAfter, true},
+		{"unreachable upstream", "127.0.0.1:1", "fallback.test", x509.RSA,
+			[]string{"fallback.test"}, "", time.Time{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := newCtx(tt.addr)
+			tlsCfg, err := tlsConfigFor(ctx, tt.san)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			leaf, err := x509.ParseCertificate(tlsCfg.Certificates[0].Certificate[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = leaf.Verify(x509.VerifyOptions{DNSName: tt.san, Roots: roots, CurrentTime: leaf.NotBefore.Add(time.Minute)}); err != nil {
+				t.Fatalf("verify: %v", err)
+			}
+			if leaf.PublicKeyAlgorithm != tt.algorithm {
+				t.Errorf("key algorithm = %v, want %v", leaf.PublicKeyAlgorithm, tt.algorithm)
+			}
+			if fmt.Sprint(leaf.DNSNames) != fmt.Sprint(tt.dnsNames) {
+				t.Errorf("DNS SANs = %v, want %v", leaf.DNSNames, tt.dnsNames)
+			}
+			if !tt.upstream {
+				if ctx.UpstreamCerts != nil {
+					t.Errorf("UpstreamCerts = %v, want nil", ctx.UpstreamCerts)
+				}
+				return
+			}
+
+			if len(leaf.IPAddresses) == 0 || !leaf.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")) {
+				t.Errorf("IP SANs = %v, want 127.0.0.1", leaf.IPAddresses)
+			}
+			if fmt.Sprint(leaf.Subject.Organization) != fmt.Sprint([]string{tt.org}) {
+				t.Errorf("organization = %v, want %s", leaf.Subject.Organization, tt.org)
+			}
+			if !leaf.NotAfter.Equal(tt.notAfter) {
+				t.Errorf("NotAfter = %v, want %v", leaf.NotAfter, tt.notAfter)
+			}
+			if len(ctx.UpstreamCerts) == 0 || ctx.UpstreamCerts[0].SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+				t.Errorf("UpstreamCerts not recorded: %v", ctx.UpstreamCerts)
+			}
+		})
+	}
+}
+
+// countingListener counts the connections accepted by a listener.
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+func TestUpstreamTLSConfigProbe(t *testing.T) {
+	newCtx := func(cfg *Config, addr string) *Context {
+		ctx := NewContext(ctxLogger, "test", cfg)
+		ctx.DstHost, ctx.DstPort, _ = net.SplitHostPort(addr)
+		return ctx
+	}
+
+	t.Run("cached", func(t *testing.T) {
+		upstream := httptest.NewUnstartedServer(http.NotFoundHandler())
+		counter := &countingListener{Listener: upstream.Listener}
+		upstream.Listener = counter
+		upstream.StartTLS()
+		defer upstream.Close()
+
+		cfg := NewConfig(FromUpstream(Certificate, PrivateKey))
+		cfg.ClientTLSConfig = &tls.Config{InsecureSkipVerify: true}
+		for i := range 2 {
+			ctx := newCtx(cfg, upstream.Listener.Addr().String())
+			if _, err := tlsConfigFor(ctx, "example.com"); err != nil {
+				t.Fatal(err)
+			}
+			if got := ctx.UpstreamCerts != nil; got != (i == 0) {
+				t.Errorf("connection #%d probed = %v", i+1, got)
+			}
+		}
+		if n := counter.accepted.Load(); n != 1 {
+			t.Errorf("upstream accepted %d connections, want 1", n)
+		}
+	})
+
+	t.Run("pre-dialed", func(t *testing.T) {
+		upstream := httptest.NewUnstartedServer(http.NotFoundHandler())
+		counter := &countingListener{Listener: upstream.Listener}
+		upstream.Listener = counter
+		upstream.StartTLS()
+		defer upstream.Close()
+
+		cfg := NewConfig(FromUpstream(Certificate, PrivateKey))
+		cfg.ClientTLSConfig = &tls.Config{InsecureSkipVerify: true}
+		ctx := newCtx(cfg, upstream.Listener.Addr().String())
+		conn, err := net.Dial("tcp", upstream.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx.DstConn = conn
+		defer func() { _ = ctx.DstConn.Close() }()
+
+		if _, err = tlsConfigFor(ctx, "example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := ctx.DstConn.(tlsClientConn); !ok || ctx.UpstreamCerts == nil {
+			t.Fatalf("pre-dialed connection not used for the probe: %T", ctx.DstConn)
+		}
+		if n := counter.accepted.Load(); n != 1 {
+			t.Errorf("upstream accepted %d connections, want 1", n)
+		}
+	})
+
+	t.Run("silent upstream", func(t *testing.T) {
+		defer func(timeout time.Duration) { upstreamProbeTimeout = timeout }(upstreamProbeTimeout)
+		upstreamProbeTimeout = 100 * time.Millisecond
+
+		// Accepts TCP but never answers the handshake
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+
+		cfg := NewConfig(FromUpstream(Certificate, PrivateKey))
+		ctx := newCtx(cfg, l.Addr().String())
+		done := make(chan error, 1)
+		go func() {
+			_, err := tlsConfigFor(ctx, "silent.test")
+			done <- err
+		}()
+		select {
+		case err = <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("probe of a silent upstream did not time out")
+		}
+		if ctx.UpstreamCerts != nil {
+			t.Error("UpstreamCerts set for a silent upstream")
+		}
+	})
+}
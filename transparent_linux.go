@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// errNotRedirected is returned by TransparentNegotiator for connections that
+// reached the listener directly.
+// errNotRedirected 表示连接未经重定向而直接连到了监听器，由 TransparentNegotiator 返回。
+var errNotRedirected = errors.New("connection was not redirected") // 连接未经过重定向
+
+// TransparentNegotiator recovers the original destination of a connection
+// redirected by iptables/nftables REDIRECT (or DNAT) through
+// getsockopt(SO_ORIGINAL_DST), for both IPv4 and IPv6, and stores it in
+// Context.DstHost and Context.DstPort.
+// TransparentNegotiator 通过 getsockopt(SO_ORIGINAL_DST) 获取被 iptables/nftables
+// REDIRECT（或 DNAT）重定向的连接的原始目标地址（支持 IPv4 与 IPv6），
+// 并写入 Context.DstHost 和 Context.DstPort。
+var TransparentNegotiator HandshakeFn = func(ctx *Context) error {
+	dst, err := originalDst(ctx.Conn.Conn)
+	if err != nil {
+		return err
+	}
+
+	// A connection that was not redirected reports the listener itself,
+	// dialing it would loop back into the proxy.
+	// 未被重定向的连接返回的是监听地址本身，拨号会回环到代理自身。
+	if !redirected(ctx.Conn.LocalAddr(), dst) {
+		return errNotRedirected
+	}
+
+	ctx.Debugf("Original destination: %s", dst)
+	ctx.DstHost, ctx.DstPort = dst.IP.String(), strconv.Itoa(dst.Port)
+	return nil
+}
+
+// TProxyNegotiator takes the original destination of a connection accepted by
+// a TPROXY listener (see ListenTProxy) from the socket's local address.
+// TProxyNegotiator 从 TPROXY 监听器（参见 ListenTProxy）接受的连接的本地地址中
+// 获取原始目标地址。
+var TProxyNegotiator HandshakeFn = func(ctx *Context) error {
+	local, ok := ctx.Conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return errors.New("unsupported connection type") // 不支持的连接类型
+	}
+
+	ctx.Debugf("Original destination: %s", local)
+	ctx.DstHost, ctx.DstPort = local.IP.String(), strconv.Itoa(local.Port)
+	return nil
+}
+
+// redirected reports whether dst, the original destination of a connection
+// accepted on local, differs from local.
+// redirected 判断在 local 上接受的连接的原始目标地址 dst 是否与 local 不同。
+func redirected(local net.Addr, dst *net.TCPAddr) bool {
+	addr, ok := local.(*net.TCPAddr)
+	return !ok || !addr.IP.Equal(dst.IP) || addr.Port != dst.Port
+}
+
+// ListenTProxy creates a Listener whose socket has IP_TRANSPARENT (or
+// IPV6_TRANSPARENT) set, so it can accept connections steered to it by an
+// iptables TPROXY rule. It requires CAP_NET_ADMIN. Pair it with
+// TProxyNegotiator.
+// ListenTProxy 创建一个设置了 IP_TRANSPARENT（或 IPV6_TRANSPARENT）的监听器，
+// 用于接收 iptables TPROXY 规则转发的连接，需要 CAP_NET_ADMIN 权限，
+// 应与 TProxyNegotiator 搭配使用。
+func ListenTProxy(network, addr string, cfg *Config) (*Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				if network == "tcp6" {
+					// Dual-stack sockets also receive IPv4 traffic, so IP_TRANSPARENT
+					// is set on a best-effort basis.
+					// 双栈套接字同样会接收 IPv4 流量，因此尽量同时设置 IP_TRANSPARENT。
+					_ = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+					sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+					return
+				}
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+
+	ln, err := lc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(ln, cfg), nil
+}
+
+// originalDst reads SO_ORIGINAL_DST from the socket of conn. The IPv4 option
+// is tried first since it also covers IPv4-mapped connections on IPv6 sockets.
+// originalDst 读取 conn 套接字的 SO_ORIGINAL_DST，优先尝试 IPv4 选项，
+// 因为它同样适用于 IPv6 套接字上的 IPv4 映射连接。
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("unsupported connection type") // 不支持的连接类型
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var dst *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		// sockaddr_in fits in the 20 bytes of an ipv6_mreq
+		// sockaddr_in 可以放入 ipv6_mreq 的 20 字节中
+		mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+		if err == nil {
+			dst = sockaddrInDst(mreq)
+			return
+		}
+
+		// sockaddr_in6 is the leading member of ip6_mtuinfo
+		// sockaddr_in6 是 ip6_mtuinfo 的首个成员
+		info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, unix.SO_ORIGINAL_DST)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		dst = sockaddrIn6Dst(info)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dst, sockErr
+}
+
+// sockaddrInDst decodes the sockaddr_in that SO_ORIGINAL_DST wrote into mreq.
+// sockaddrInDst 解析 SO_ORIGINAL_DST 写入 mreq 的 sockaddr_in。
+func sockaddrInDst(mreq *unix.IPv6Mreq) *net.TCPAddr {
+	addr := mreq.Multiaddr
+	return &net.TCPAddr{
+		IP:   net.IPv4(addr[4], addr[5], addr[6], addr[7]),
+		Port: int(binary.BigEndian.Uint16(addr[2:4])),
+	}
+}
+
+// sockaddrIn6Dst decodes the sockaddr_in6 that SO_ORIGINAL_DST wrote into
+// info.
+// sockaddrIn6Dst 解析 SO_ORIGINAL_DST 写入 info 的 sockaddr_in6。
+func sockaddrIn6Dst(info *unix.IPv6MTUInfo) *net.TCPAddr {
+	// sin6_port is stored in network byte order
+	// sin6_port 以网络字节序存储
+	port := binary.NativeEndian.AppendUint16(nil, info.Addr.Port)
+	return &net.TCPAddr{
+		IP:   append(net.IP(nil), info.Addr.Addr[:]...),
+		Port: int(binary.BigEndian.Uint16(port)),
+	}
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// loopbackConn returns the server side of a TCP connection accepted on
+// 127.0.0.1, closing both ends when the test ends.
+func loopbackConn(t *testing.T) net.Conn {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return server
+}
+
+func TestTProxyNegotiator(t *testing.T) {
+	t.Run("tcp", func(t *testing.T) {
+		conn := loopbackConn(t)
+		ctx := NewContext(ctxLogger, "test", NewConfig(nil))
+		ctx.Conn = NewConn(conn)
+		if err := TProxyNegotiator.Handshake(ctx); err != nil {
+			t.Fatal(err)
+		}
+		local := conn.LocalAddr().(*net.TCPAddr)
+		if ctx.DstHost != "127.0.0.1" || ctx.DstPort != strconv.Itoa(local.Port) {
+			t.Errorf("destination = %s:%s, want %s", ctx.DstHost, ctx.DstPort, local)
+		}
+	})
+
+	t.Run("pipe", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		ctx := NewContext(ctxLogger, "test", NewConfig(nil))
+		ctx.Conn = NewConn(server)
+		if err := TProxyNegotiator.Handshake(ctx); err == nil {
+			t.Error("expected an error for a non-TCP connection")
+		}
+	})
+}
+
+func TestTransparentNegotiatorNotRedirected(t *testing.T) {
+	ctx := NewContext(ctxLogger, "test", NewConfig(nil))
+	ctx.Conn = NewConn(loopbackConn(t))
+
+	// With conntrack loaded the original destination is the listener itself,
+	// without it SO_ORIGINAL_DST fails; either way nothing must be dialed
+	err := TransparentNegotiator.Handshake(ctx)
+	if err == nil || ctx.DstHost != "" || ctx.DstPort != "" {
+		t.Fatalf("Handshake = %v with destination %q:%q, want an error", err, ctx.DstHost, ctx.DstPort)
+	}
+	if !errors.Is(err, errNotRedirected) {
+		t.Logf("SO_ORIGINAL_DST unavailable: %v", err)
+	}
+}
+
+func TestRedirected(t *testing.T) {
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}
+	tests := []struct {
+		name  string
+		local net.Addr
+		dst   *net.TCPAddr
+		want  bool
+	}{
+		{"listener itself", local, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8080}, false},
+		{"other port", local, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 443}, true},
+		{"other host", local, &net.TCPAddr{IP: net.ParseIP("93.184.216.34"), Port: 8080}, true},
+		{"non-TCP local address", &net.UnixAddr{Name: "sock", Net: "unix"}, &net.TCPAddr{Port: 8080}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redirected(tt.local, tt.dst); got != tt.want {
+				t.Errorf("redirected = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestOriginalDstLayout checks the decoding of the sockaddr_in and
+// sockaddr_in6 that SO_ORIGINAL_DST writes into the IPv6Mreq and
+// IPv6MTUInfo buffers, laid out as the kernel does.
+func TestOriginalDstLayout(t *testing.T) {
+	t.Run("sockaddr_in", func(t *testing.T) {
+		var mreq unix.IPv6Mreq
+		binary.NativeEndian.PutUint16(mreq.Multiaddr[0:], unix.AF_INET)
+		binary.BigEndian.PutUint16(mreq.Multiaddr[2:], 8443)
+		copy(mreq.Multiaddr[4:], []byte{93, 184, 216, 34})
+
+		dst := sockaddrInDst(&mreq)
+		if !dst.IP.Equal(net.IPv4(93, 184, 216, 34)) || dst.Port != 8443 {
+			t.Errorf("decoded %s, want 93.184.216.34:8443", dst)
+		}
+	})
+
+	t.Run("sockaddr_in6", func(t *testing.T) {
+		var info unix.IPv6MTUInfo
+		info.Addr.Family = unix.AF_INET6
+		// sin6_port holds network byte order in host memory
+		info.Addr.Port = binary.NativeEndian.Uint16(binary.BigEndian.AppendUint16(nil, 8443))
+		want := net.ParseIP("2001:db8::1")
+		copy(info.Addr.Addr[:], want)
+
+		dst := sockaddrIn6Dst(&info)
+		if !dst.IP.Equal(want) || dst.Port != 8443 {
+			t.Errorf("decoded %s, want [2001:db8::1]:8443", dst)
+		}
+	})
+}
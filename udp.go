@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// UdpHandler defines the interface for relaying the datagrams of a UDP
+// association, e.g. one created by the SOCKS5 UDP ASSOCIATE command.
+// UdpHandler 定义了 UDP 关联（例如 SOCKS5 UDP ASSOCIATE）的数据报中继接口。
+type UdpHandler interface {
+	HandleUdp(*Context) error
+}
+
+// HandleUdpFn is a function type adapter that implements the UdpHandler interface.
+// HandleUdpFn 是一个函数类型适配器，用于实现 UdpHandler 接口。
+type HandleUdpFn func(*Context) error
+
+// HandleUdp calls the function itself to relay the UDP association.
+// HandleUdp 会直接调用函数本身来中继 UDP 关联。
+func (f HandleUdpFn) HandleUdp(ctx *Context) error { return f(ctx) }
+
+// Datagram is a single UDP packet relayed through a UDP association.
+// Host and Port always name the remote peer, whichever way the packet flows.
+// Datagram 表示经 UDP 关联中继的单个数据包，
+// 无论数据流向如何，Host 与 Port 始终表示远端地址。
+type Datagram struct {
+	Host     string // 远端主机
+	Port     string // 远端端口
+	Payload  []byte // 数据内容
+	Outbound bool   // true 表示客户端发往远端，false 表示远端发往客户端
+}
+
+// udpBufferSize is large enough for any UDP payload plus the SOCKS5 header.
+// udpBufferSize 足以容纳任意 UDP 数据及 SOCKS5 头部。
+const udpBufferSize = 64 * 1024
+
+// A remote peer may answer for udpRemoteTimeout after the client last sent it
+// a datagram, and at most udpMaxRemotes peers are tracked per association.
+// 客户端最后一次向远端发送数据报后，远端可在 udpRemoteTimeout 内回复，每个关联最多记录 udpMaxRemotes 个远端。
+const (
+	udpRemoteTimeout = 2 * time.Minute
+	udpMaxRemotes    = 1024
+)
+
+// udpRemotes records when the client last sent a datagram to each remote peer.
+// udpRemotes 记录客户端最后一次向各个远端发送数据报的时间。
+type udpRemotes map[string]time.Time
+
+// add records a datagram sent to addr, evicting peers when the map is full.
+// add 记录发往 addr 的数据报，记录已满时先淘汰远端。
+func (r udpRemotes) add(addr string, now time.Time) {
+	if _, ok := r[addr]; !ok && len(r) >= udpMaxRemotes {
+		r.evict(now)
+	}
+	r[addr] = now
+}
+
+// known reports whether addr may still send datagrams to the client.
+// known 判断 addr 是否仍可向客户端发送数据报。
+func (r udpRemotes) known(addr string, now time.Time) bool {
+	last, ok := r[addr]
+	if ok && now.Sub(last) > udpRemoteTimeout {
+		delete(r, addr)
+		return false
+	}
+	return ok
+}
+
+// evict drops the idle peers, or the least recently used one if none is idle.
+// evict 淘汰空闲的远端，没有空闲远端时淘汰最久未使用的一个。
+func (r udpRemotes) evict(now time.Time) {
+	var oldest string
+	var oldestAt time.Time
+	for addr, last := range r {
+		if now.Sub(last) > udpRemoteTimeout {
+			delete(r, addr)
+			continue
+		}
+		if oldest == "" || last.Before(oldestAt) {
+			oldest, oldestAt = addr, last
+		}
+	}
+	if len(r) >= udpMaxRemotes {
+		delete(r, oldest)
+	}
+}
+
+// defaultUdpHandler relays datagrams between the client and remote peers
+// over ctx.UdpConn, using the RFC 1928 UDP request header. The association
+// ends when the TCP control connection closes.
+// defaultUdpHandler 基于 ctx.UdpConn 在客户端与远端之间中继数据报，
+// 使用 RFC 1928 定义的 UDP 请求头。TCP 控制连接关闭时关联随之结束。
+var defaultUdpHandler HandleUdpFn = func(ctx *Context) error {
+	relay := ctx.UdpConn
+	defer relay.Close()
+
+	// Tear the relay down once the control connection goes away.
+	// 控制连接断开后关闭中继。
+	go func() {
+		_, _ = io.Copy(io.Discard, ctx.Conn)
+		_ = relay.Close()
+	}()
+
+	var clientIP net.IP
+	if addr, ok := ctx.Conn.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = addr.IP
+	}
+
+	var client *net.UDPAddr
+	remotes := make(udpRemotes)
+
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, src, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			ctx.Error(err)
+			return err
+		}
+
+		if src.IP.Equal(clientIP) && (client == nil || src.Port == client.Port) {
+			// Client -> remote: strip the SOCKS5 header and forward.
+			// 客户端 -> 远端：去掉 SOCKS5 头部后转发。
+			host, port, payload, err := parseSocks5UdpHeader(buf[:n])
+			if err != nil {
+				ctx.Debugf("Dropping UDP datagram from client: %v", err)
+				continue
+			}
+			client = src
+
+			dgram := ctx.filterUdp(&Datagram{Host: host, Port: port, Payload: payload, Outbound: true}, ctx)
+			if dgram == nil {
+				continue
+			}
+
+			dst, err := resolveUdpAddr(ctx, dgram.Host, dgram.Port)
+			if err != nil {
+				ctx.Error(err)
+				continue
+			}
+
+			remotes.add(dst.String(), time.Now())
+
+			if _, err = relay.WriteToUDP(dgram.Payload, dst); err != nil {
+				ctx.Error(err)
+			}
+			continue
+		}
+
+		// Remote -> client: only accept peers the client has recently talked to.
+		// 远端 -> 客户端：只接受客户端近期主动联系过的远端。
+		if client == nil || !remotes.known(src.String(), time.Now()) {
+			continue
+		}
+
+		dgram := ctx.filterUdp(&Datagram{
+			Host:    src.IP.String(),
+			Port:    strconv.Itoa(src.Port),
+			Payload: append([]byte(nil), buf[:n]...),
+		}, ctx)
+		if dgram == nil {
+			continue
+		}
+
+		packet, err := buildSocks5UdpHeader(dgram.Host, dgram.Port)
+		if err != nil {
+			ctx.Error(err)
+			continue
+		}
+		if _, err = relay.WriteToUDP(append(packet, dgram.Payload...), client); err != nil {
+			ctx.Error(err)
+		}
+	}
+}
+
+// resolveUdpAddr resolves the remote peer of a datagram through lookupHost.
+// resolveUdpAddr 通过 lookupHost 解析数据报的远端地址。
+func resolveUdpAddr(ctx *Context, host, port string) (*net.UDPAddr, error) {
+	ip, err := lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(ip, port))
+}
+
+// parseSocks5UdpHeader decapsulates a client datagram:
+// RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA. Fragments are not supported.
+// parseSocks5UdpHeader 解析客户端数据报：RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA，
+// 不支持分片。
+func parseSocks5UdpHeader(b []byte) (string, string, []byte, error) {
+	if len(b) < 4 {
+		return "", "", nil, errors.New("short UDP datagram") // UDP 数据报过短
+	}
+	if b[2] != 0x00 {
+		return "", "", nil, errors.New("fragmented UDP datagram") // 不支持分片的 UDP 数据报
+	}
+
+	rd := bytes.NewReader(b[4:])
+	host, port, err := readSocks5Addr(rd, b[3])
+	if err != nil {
+		return "", "", nil, err
+	}
+	return host, port, b[len(b)-rd.Len():], nil
+}
+
+// buildSocks5UdpHeader encapsulates the source of a remote datagram.
+// buildSocks5UdpHeader 为远端数据报构造包含来源地址的头部。
+func buildSocks5UdpHeader(host, port string) ([]byte, error) {
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+	header := []byte{0x00, 0x00, 0x00}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		if len(host) > 255 {
+			return nil, errors.New("hostname too long") // 域名过长
+		}
+		header = append(header, socks5AtypDomain, byte(len(host)))
+		header = append(header, host...)
+		return append(header, byte(p>>8), byte(p)), nil
+	}
+	return append(header, socks5AddrBytes(&net.UDPAddr{IP: ip, Port: p})...), nil
+}
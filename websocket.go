@@ -2,7 +2,6 @@ package proxy
 
 import (
 	"bufio"
-	"crypto/tls"
 	"errors"
 	"github.com/gobwas/ws"
 	"io"
@@ -30,24 +29,17 @@ func (f HandleWsFn) HandleWs(ctx *Context) error { return f(ctx) }
 // defaultWsHandler 会建立到目标地址的代理连接，并转发 WebSocket 流量。
 // 它会转发 WebSocket 握手，并在客户端和目标之间进行帧级转发。
 var defaultWsHandler HandleWsFn = func(ctx *Context) error {
-	// Dial to the target WebSocket server.
-	// 拨号连接目标 WebSocket 服务端。
-	proxyAddr := net.JoinHostPort(ctx.DstHost, ctx.DstPort)
-	proxyConn, err := ctx.Dialer.Dial("tcp", proxyAddr)
+	// Dial to the target WebSocket server, wrapping it with TLS using
+	// ClientTLSConfig if the client connection is already TLS.
+	// 拨号连接目标 WebSocket 服务端，如果客户端连接已经是 TLS（HTTPS 请求），
+	// 则使用 ctx.ClientTLSConfig 在上游连接上建立 TLS 隧道。
+	proxyConn, err := dialUpstream(ctx)
 	if err != nil {
 		ctx.Error(err)
 		return err
 	}
 	defer proxyConn.Close()
 
-	// Check if the client connection is already TLS
-	// 如果客户端连接已经是 TLS（HTTPS 请求）
-	if ctx.Conn.IsTLS() {
-		// Wrap the upstream connection with TLS using ClientTLSConfig
-		// 使用 ctx.ClientTLSConfig 在上游连接上建立 TLS 隧道
-		proxyConn = tls.Client(proxyConn, ctx.ClientTLSConfig)
-	}
-
 	req, err := http.ReadRequest(bufio.NewReader(ctx.Conn))
 	if err != nil {
 		ctx.Error(err)
@@ -57,6 +49,10 @@ var defaultWsHandler HandleWsFn = func(ctx *Context) error {
 	// Remove unsupported extensions to avoid negotiation issues.
 	// 删除扩展字段，避免协商失败。
 	req.Header.Del("Sec-WebSocket-Extensions")
+
+	// Proxy credentials are meant for this hop only, never forward them.
+	// 代理凭据仅用于当前跳，不能转发给上游。
+	req.Header.Del("Proxy-Authorization")
 	if err = req.WriteProxy(proxyConn); err != nil {
 		ctx.Error(err)
 		return err